@@ -0,0 +1,52 @@
+package bg
+
+import (
+	"log/slog"
+	"time"
+
+	"p2p-drive/agent/client"
+	"p2p-drive/agent/storage"
+)
+
+// Inventory periodically sends the server the list of locally held chunks
+// and deletes the ones it reports as orphaned.
+type Inventory struct {
+	Client   *client.Client
+	Store    storage.ChunkStore
+	Interval time.Duration
+}
+
+func NewInventory(c *client.Client, s storage.ChunkStore, interval time.Duration) *Inventory {
+	return &Inventory{Client: c, Store: s, Interval: interval}
+}
+
+func (inv *Inventory) Start() {
+	go func() {
+		ticker := time.NewTicker(inv.Interval)
+		for range ticker.C {
+			inv.Send()
+		}
+	}()
+}
+
+// Send reports one inventory and applies the server's verdict.
+func (inv *Inventory) Send() {
+	ids, err := inv.Store.ListChunks()
+	if err != nil {
+		slog.Error("Inventory: failed to list chunks", "err", err)
+		return
+	}
+
+	orphans, err := inv.Client.SendInventory(ids)
+	if err != nil {
+		slog.Error("Inventory: failed to send", "err", err)
+		return
+	}
+
+	for _, chunkID := range orphans {
+		if err := inv.Store.DeleteChunk(chunkID); err != nil {
+			slog.Warn("Inventory: failed to delete orphan", "chunk", chunkID, "err", err)
+		}
+	}
+	slog.Info("Inventory sent", "chunks", len(ids), "orphans_removed", len(orphans))
+}
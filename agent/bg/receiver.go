@@ -1,30 +1,51 @@
 package bg
 
 import (
+	"context"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+
 	"p2p-drive/agent/client"
 	"p2p-drive/agent/storage"
-	"p2p-drive/agent/transfer"
 	"p2p-drive/shared"
 )
 
+var messagesHandled = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gendrive_agent_messages_handled_total",
+	Help: "Relay messages handled by the receiver, by message type.",
+}, []string{"type"})
+
 type Receiver struct {
 	Client *client.Client
 	Store  storage.ChunkStore
 	MyID   string
+
+	// Messages polled from the relay, waiting to be handled in order
+	queue chan shared.RelayMessage
 }
 
 func NewReceiver(c *client.Client, s storage.ChunkStore, myID string) *Receiver {
-	return &Receiver{Client: c, Store: s, MyID: myID}
+	return &Receiver{Client: c, Store: s, MyID: myID, queue: make(chan shared.RelayMessage, 64)}
 }
 
 func (r *Receiver) Start() {
 	go r.loop()
+	go r.work()
+}
+
+// QueueDepth is the number of relay messages received but not yet handled.
+func (r *Receiver) QueueDepth() int {
+	return len(r.queue)
 }
 
 func (r *Receiver) loop() {
@@ -32,8 +53,11 @@ func (r *Receiver) loop() {
 
 	for {
 		// Poll Relay
-		data, err := transfer.DownloadChunk(r.Client.Client, r.Client.ServerURL, r.MyID, session)
+		data, err := r.Client.RelayRecv(session)
 		if err != nil {
+			if !errors.Is(err, client.ErrNoMessage) {
+				r.Client.RecordError("relay_recv")
+			}
 			time.Sleep(1 * time.Second)
 			continue
 		}
@@ -41,73 +65,178 @@ func (r *Receiver) loop() {
 		// Decode Message
 		var msg shared.RelayMessage
 		if err := json.Unmarshal(data, &msg); err != nil {
-			log.Printf("Received invalid message: %v", err)
+			slog.Warn("Received invalid message", "err", err)
+			r.Client.RecordError("relay_recv")
 			continue
 		}
 
+		r.queue <- msg
+	}
+}
+
+func (r *Receiver) work() {
+	for msg := range r.queue {
 		r.handleMessage(msg)
 	}
 }
 
 func (r *Receiver) handleMessage(msg shared.RelayMessage) {
+	defer messagesHandled.WithLabelValues(msg.Type).Inc()
+	// Log lines carry the ID of the server request that sent the message
+	ctx := shared.WithRequestID(context.Background(), msg.RequestID)
+	// Spans join the trace of that request
+	ctx = shared.ExtractTrace(ctx, msg.Trace)
 	if msg.Type == shared.RelayTypeStore {
-		r.handleStore(msg.Payload)
+		r.handleStore(ctx, msg.Payload, msg.Session)
 	} else if msg.Type == shared.RelayTypeRetrieve {
-		r.handleRetrieve(msg.Payload)
+		r.handleRetrieve(ctx, msg.Payload, msg.Session)
 	} else if msg.Type == shared.RelayTypeDelete {
-		r.handleDelete(msg.Payload)
+		r.handleDelete(ctx, msg.Payload)
+	} else if msg.Type == shared.RelayTypeChallenge {
+		r.handleChallenge(ctx, msg.Payload, msg.Session)
 	}
 }
 
-func (r *Receiver) handleDelete(data []byte) {
+// replySession is the session the server asked us to answer on. Servers that
+// don't name one wait on a session derived from the chunk or challenge ID.
+func (r *Receiver) replySession(session, kind, id string) string {
+	if session != "" {
+		return session
+	}
+	return shared.ServerSession(kind, r.MyID, id)
+}
+
+func (r *Receiver) handleDelete(ctx context.Context, data []byte) {
 	chunkID := string(data)
-	log.Printf("Deleting chunk: %s", chunkID)
+	slog.InfoContext(ctx, "Deleting chunk", "chunk", chunkID)
 	if err := r.Store.DeleteChunk(chunkID); err != nil {
-		log.Printf("Failed to delete chunk %s: %v", chunkID, err)
+		slog.ErrorContext(ctx, "Failed to delete chunk", "chunk", chunkID, "err", err)
+		r.Client.RecordError("store")
 	}
 }
 
-func (r *Receiver) handleRetrieve(data []byte) {
+func (r *Receiver) handleRetrieve(ctx context.Context, data []byte, session string) {
 	chunkID := string(data)
-	log.Printf("Retrieving chunk request: %s", chunkID)
+	ctx, span := startSpan(ctx, "handleRetrieve", attribute.String("chunk", chunkID))
+	var err error
+	defer func() { endSpan(span, err) }()
+	slog.InfoContext(ctx, "Retrieving chunk", "chunk", chunkID)
 
 	// 1. Get Chunk
-	chunkData, err := r.Store.GetChunk(chunkID)
+	var chunkData []byte
+	err = traced(ctx, "GetChunk", func() (err error) {
+		chunkData, err = r.Store.GetChunk(chunkID)
+		return err
+	})
 	if err != nil {
-		log.Printf("Chunk not found: %s", chunkID)
+		slog.WarnContext(ctx, "Chunk not found", "chunk", chunkID)
+		r.Client.RecordError("retrieve")
+		return
+	}
+
+	// Never serve bytes that no longer match their hash
+	if !storage.ChunkMatches(chunkID, chunkData) {
+		slog.WarnContext(ctx, "Chunk failed verification, removing", "chunk", chunkID)
+		r.Client.RecordError("corrupt")
+		err = fmt.Errorf("chunk %s failed verification", chunkID)
+		r.Store.DeleteChunk(chunkID)
+		report := shared.ChunkHealthReport{Checked: 1, Corrupt: []string{chunkID}}
+		if err := r.Client.ReportChunkHealth(report); err != nil {
+			slog.ErrorContext(ctx, "Failed to report corrupt chunk", "chunk", chunkID, "err", err)
+		}
 		return
 	}
 
 	// 2. Send back to Server
-	// Target: "server", Session: "chunk-{id}"
+	// Target: "server", Session: "chunk-{operation}-{device}"
 	// We use a new helper in Client or raw request?
 	// Let's add RelaySend to Client.
-	err = r.Client.RelaySend("server", "chunk-"+chunkID, chunkData)
+	err = traced(ctx, "RelaySend", func() error {
+		return r.Client.RelaySend("server", r.replySession(session, shared.RelaySessionChunk, chunkID), chunkData)
+	})
 	if err != nil {
-		log.Printf("Failed to send chunk %s: %v", chunkID, err)
+		slog.ErrorContext(ctx, "Failed to send chunk", "chunk", chunkID, "err", err)
+		r.Client.RecordError("relay_send")
 	}
 }
 
-func (r *Receiver) handleStore(data []byte) {
+func (r *Receiver) handleStore(ctx context.Context, data []byte, session string) {
 	// 1. Calculate Hash (chunkID)
 	hash := sha256.Sum256(data)
 	chunkID := hex.EncodeToString(hash[:])
-
-	// 2. Save to Store
-	if err := r.Store.SaveChunk(chunkID, data); err != nil {
-		log.Printf("Failed to save chunk %s: %v", chunkID, err)
+	ctx, span := startSpan(ctx, "handleStore", attribute.String("chunk", chunkID), attribute.Int("bytes", len(data)))
+	var err error
+	defer func() { endSpan(span, err) }()
+	session = r.replySession(session, shared.RelaySessionAck, chunkID)
+
+	// 2. Refuse if this would exceed the owner's cap or the disk
+	if reason := r.checkCapacity(int64(len(data))); reason != "" {
+		slog.WarnContext(ctx, "Refusing chunk", "chunk", chunkID, "reason", reason)
+		err = errors.New(reason)
+		if err := r.Client.RelaySend("server", session, []byte("FULL")); err != nil {
+			slog.ErrorContext(ctx, "Failed to send refusal", "chunk", chunkID, "err", err)
+		}
 		return
 	}
-	log.Printf("Stored chunk: %s", chunkID)
 
-	// 3. Report to Server
-	if err := r.Client.ReportChunkLocation(chunkID); err != nil {
-		log.Printf("Failed to report chunk location: %v", err)
+	// 3. Save to Store
+	if err = traced(ctx, "SaveChunk", func() error { return r.Store.SaveChunk(chunkID, data) }); err != nil {
+		slog.ErrorContext(ctx, "Failed to save chunk", "chunk", chunkID, "err", err)
+		r.Client.RecordError("store")
+		return
 	}
+	slog.InfoContext(ctx, "Stored chunk", "chunk", chunkID, "bytes", len(data))
 
 	// 4. Send ACK to Server (Critical for reliability)
-	// Server waits for this on "ack-{chunkID}"
-	if err := r.Client.RelaySend("server", "ack-"+chunkID, []byte("OK")); err != nil {
-		log.Printf("Failed to send ACK for chunk %s: %v", chunkID, err)
+	// The server records the location once it has the ACK
+	// Server waits for this on "ack-{operation}-{device}"
+	if err = traced(ctx, "RelaySend", func() error { return r.Client.RelaySend("server", session, []byte("OK")) }); err != nil {
+		slog.ErrorContext(ctx, "Failed to send ACK", "chunk", chunkID, "err", err)
+		r.Client.RecordError("relay_send")
+	}
+}
+
+// checkCapacity returns why a chunk of the given size can't be stored, or "".
+func (r *Receiver) checkCapacity(size int64) string {
+	if limit := r.Client.StorageCap(); limit > 0 {
+		used, _, err := r.Store.GetTotalUsage()
+		if err == nil && used+size > limit {
+			return fmt.Sprintf("storage cap of %d bytes reached", limit)
+		}
+	}
+	if total, free, err := r.Store.Capacity(); err == nil && total > 0 && free < size {
+		return "disk full"
+	}
+	return ""
+}
+
+func (r *Receiver) handleChallenge(ctx context.Context, data []byte, session string) {
+	var ch shared.StorageChallenge
+	if err := json.Unmarshal(data, &ch); err != nil {
+		slog.WarnContext(ctx, "Invalid challenge", "err", err)
+		return
+	}
+
+	// An empty proof tells the server we can't answer rather than timing out
+	var proof []byte
+	chunkData, err := r.Store.GetChunk(ch.ChunkID)
+	if err != nil {
+		slog.WarnContext(ctx, "Challenge: chunk not found", "challenge", ch.ID, "chunk", ch.ChunkID)
+	} else {
+		start, end := ch.Offset, ch.Offset+ch.Length
+		if start < 0 || start > int64(len(chunkData)) {
+			start = int64(len(chunkData))
+		}
+		if end > int64(len(chunkData)) || end < start {
+			end = int64(len(chunkData))
+		}
+		mac := hmac.New(sha256.New, ch.Nonce)
+		mac.Write(chunkData[start:end])
+		proof = mac.Sum(nil)
+	}
+
+	if err := r.Client.RelaySend("server", r.replySession(session, shared.RelaySessionProof, ch.ID), proof); err != nil {
+		slog.ErrorContext(ctx, "Failed to answer challenge", "challenge", ch.ID, "err", err)
+		r.Client.RecordError("relay_send")
 	}
 }
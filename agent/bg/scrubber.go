@@ -0,0 +1,81 @@
+package bg
+
+import (
+	"log/slog"
+	"time"
+
+	"p2p-drive/agent/client"
+	"p2p-drive/agent/storage"
+	"p2p-drive/shared"
+)
+
+// Scrubber periodically re-hashes every locally stored chunk and reports
+// corrupt or missing ones so the server can re-replicate them.
+type Scrubber struct {
+	Client   *client.Client
+	Store    storage.ChunkStore
+	Interval time.Duration
+}
+
+func NewScrubber(c *client.Client, s storage.ChunkStore, interval time.Duration) *Scrubber {
+	return &Scrubber{Client: c, Store: s, Interval: interval}
+}
+
+func (s *Scrubber) Start() {
+	go func() {
+		ticker := time.NewTicker(s.Interval)
+		for range ticker.C {
+			s.Scrub()
+		}
+	}()
+}
+
+// Scrub runs a single verification pass over the store.
+func (s *Scrubber) Scrub() {
+	local, err := s.Store.ListChunks()
+	if err != nil {
+		slog.Error("Scrub: failed to list chunks", "err", err)
+		return
+	}
+
+	var report shared.ChunkHealthReport
+	present := make(map[string]bool, len(local))
+
+	for _, chunkID := range local {
+		data, err := s.Store.GetChunk(chunkID)
+		report.Checked++
+		if err == nil && storage.ChunkMatches(chunkID, data) {
+			present[chunkID] = true
+			continue
+		}
+
+		// Unreadable or bit-rotted: drop it so a healthy copy can replace it
+		slog.Warn("Scrub: chunk is corrupt, removing", "chunk", chunkID)
+		s.Store.DeleteChunk(chunkID)
+		report.Corrupt = append(report.Corrupt, chunkID)
+	}
+
+	// Compare against what the server expects us to hold
+	assigned, err := s.Client.GetAssignedChunks()
+	if err != nil {
+		slog.Error("Scrub: failed to fetch assigned chunks", "err", err)
+	} else {
+		corrupt := make(map[string]bool, len(report.Corrupt))
+		for _, id := range report.Corrupt {
+			corrupt[id] = true
+		}
+		for _, chunkID := range assigned {
+			if !present[chunkID] && !corrupt[chunkID] {
+				report.Missing = append(report.Missing, chunkID)
+			}
+		}
+	}
+
+	slog.Info("Scrub complete", "checked", report.Checked, "corrupt", len(report.Corrupt), "missing", len(report.Missing))
+	if len(report.Corrupt) == 0 && len(report.Missing) == 0 {
+		return
+	}
+	if err := s.Client.ReportChunkHealth(report); err != nil {
+		slog.Error("Scrub: failed to report chunk health", "err", err)
+	}
+}
@@ -0,0 +1,40 @@
+package bg
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"p2p-drive/shared"
+)
+
+var tracer = otel.Tracer("p2p-drive/agent")
+
+// startSpan starts a span tagged with the request ID of the server request
+// that sent the message being handled.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if id := shared.RequestID(ctx); id != "" {
+		attrs = append(attrs, attribute.String("request_id", id))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// traced runs one step of a handler in its own child span.
+func traced(ctx context.Context, name string, fn func() error) error {
+	_, span := startSpan(ctx, name)
+	err := fn()
+	endSpan(span, err)
+	return err
+}
+
+// endSpan ends a span, marking it failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
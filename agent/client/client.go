@@ -3,11 +3,24 @@ package client
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"strconv"
+	"sync/atomic"
 	"time"
 
 	"p2p-drive/shared"
@@ -17,6 +30,18 @@ type Client struct {
 	ServerURL string
 	ID        string
 	Client    *http.Client
+
+	// Telemetry, if set, fills in the device stats sent with each heartbeat.
+	Telemetry func(req *shared.HeartbeatRequest)
+
+	// Throughput of chunk data sent to and received from the relay
+	Upload   Meter
+	Download Meter
+	errors   errorLog
+
+	storageCap atomic.Int64
+	pending    atomic.Bool
+	key        *rsa.PrivateKey
 }
 
 func NewClient(serverURL, deviceID string) *Client {
@@ -42,14 +67,76 @@ func NewClient(serverURL, deviceID string) *Client {
 		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
 	}
 
-	return &Client{
+	c := &Client{
 		ServerURL: serverURL,
 		ID:        deviceID,
-		Client: &http.Client{
-			Timeout:   30 * time.Second,
-			Transport: transport,
-		},
 	}
+	c.Client = &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &signingTransport{base: transport, client: c},
+	}
+	return c
+}
+
+// SetKey loads the device's PEM private key. Once set, every request to the
+// server is signed with it.
+func (c *Client) SetKey(privatePEM []byte) error {
+	block, _ := pem.Decode(privatePEM)
+	if block == nil {
+		return fmt.Errorf("invalid private key")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	c.key = key
+	return nil
+}
+
+// signingTransport adds the device signature headers to outgoing requests.
+type signingTransport struct {
+	base   http.RoundTripper
+	client *Client
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.client.key == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	// The body is part of the signature
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+	digest := sha256.Sum256(shared.DeviceSigningString(t.client.ID, req.Method, req.URL.RequestURI(), ts, nonceHex, body))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, t.client.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(req.Context())
+	if req.Body != nil {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	req.Header.Set(shared.HeaderDeviceID, t.client.ID)
+	req.Header.Set(shared.HeaderDeviceTimestamp, ts)
+	req.Header.Set(shared.HeaderDeviceNonce, nonceHex)
+	req.Header.Set(shared.HeaderDeviceSignature, base64.StdEncoding.EncodeToString(sig))
+	return t.base.RoundTrip(req)
 }
 
 func (c *Client) Register(publicKey, name, deviceID, claimToken string) (string, error) {
@@ -81,6 +168,9 @@ func (c *Client) Register(publicKey, name, deviceID, claimToken string) (string,
 
 func (c *Client) SendHeartbeat() error {
 	req := shared.HeartbeatRequest{DeviceID: c.ID}
+	if c.Telemetry != nil {
+		c.Telemetry(&req)
+	}
 	body, _ := json.Marshal(req)
 
 	resp, err := c.Client.Post(c.ServerURL+"/heartbeat", "application/json", bytes.NewBuffer(body))
@@ -92,15 +182,31 @@ func (c *Client) SendHeartbeat() error {
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("heartbeat failed: %d", resp.StatusCode)
 	}
+
+	var res shared.HeartbeatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err == nil {
+		c.storageCap.Store(res.StorageCap)
+		if c.pending.Swap(res.Pending) != res.Pending && res.Pending {
+			slog.Warn("Device is pending: claim it from the dashboard to start storing chunks")
+		}
+	}
 	return nil
 }
 
+// StorageCap is the owner-set limit on bytes this device stores (0 = no cap),
+// as of the last heartbeat.
+func (c *Client) StorageCap() int64 {
+	return c.storageCap.Load()
+}
+
 func (c *Client) StartHeartbeat(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	go func() {
 		for range ticker.C {
 			if err := c.SendHeartbeat(); err != nil {
-				fmt.Printf("Heartbeat error: %v\n", err)
+				c.RecordError("heartbeat")
+				heartbeatFailures.Inc()
+				slog.Warn("Heartbeat failed", "err", err)
 			}
 		}
 	}()
@@ -138,25 +244,6 @@ func (c *Client) GetFileMetadata(id string) (*shared.FileMetadata, error) {
 	return &meta, nil
 }
 
-func (c *Client) ReportChunkLocation(chunkID string) error {
-	req := shared.ChunkLocationRequest{
-		ChunkID:  chunkID,
-		DeviceID: c.ID,
-	}
-
-	body, _ := json.Marshal(req)
-	resp, err := c.Client.Post(c.ServerURL+"/chunk/location", "application/json", bytes.NewBuffer(body))
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("report location failed: %d", resp.StatusCode)
-	}
-	return nil
-}
-
 func (c *Client) GetPeers() ([]shared.Device, error) {
 	resp, err := c.Client.Get(c.ServerURL + "/peers")
 	if err != nil {
@@ -173,6 +260,7 @@ func (c *Client) GetPeers() ([]shared.Device, error) {
 
 func (c *Client) RelaySend(to, session string, data []byte) error {
 	url := fmt.Sprintf("%s/relay/send?to=%s&session=%s", c.ServerURL, to, session)
+	start := time.Now()
 	resp, err := c.Client.Post(url, "application/octet-stream", bytes.NewBuffer(data))
 	if err != nil {
 		return err
@@ -182,9 +270,43 @@ func (c *Client) RelaySend(to, session string, data []byte) error {
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("relay send failed: %d", resp.StatusCode)
 	}
+	c.Upload.Observe(len(data), time.Since(start))
 	return nil
 }
 
+// ErrNoMessage is returned by RelayRecv when the long poll ends without a
+// message.
+var ErrNoMessage = errors.New("no relay message")
+
+// RelayRecv waits for the next message to this device on a relay session.
+func (c *Client) RelayRecv(session string) ([]byte, error) {
+	url := fmt.Sprintf("%s/relay/recv?me=%s&session=%s", c.ServerURL, c.ID, session)
+	resp, err := c.Client.Get(url)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, ErrNoMessage
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGatewayTimeout {
+		return nil, ErrNoMessage
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("relay recv failed: %d", resp.StatusCode)
+	}
+	// Timed from the response headers, so the long poll wait isn't counted
+	start := time.Now()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	c.Download.Observe(len(data), time.Since(start))
+	return data, nil
+}
+
 func (c *Client) GetDeletions(since time.Time) ([]shared.DeletionEvent, error) {
 	url := fmt.Sprintf("%s/api/sync/deletions?since=%s", c.ServerURL, since.Format(time.RFC3339))
 	resp, err := c.Client.Get(url)
@@ -203,3 +325,60 @@ func (c *Client) GetDeletions(since time.Time) ([]shared.DeletionEvent, error) {
 	}
 	return events, nil
 }
+
+// GetAssignedChunks returns the chunk IDs the server believes this device holds.
+func (c *Client) GetAssignedChunks() ([]string, error) {
+	resp, err := c.Client.Get(c.ServerURL + "/chunk/list?device_id=" + c.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("get assigned chunks failed: %d", resp.StatusCode)
+	}
+
+	var ids []string
+	if err := json.NewDecoder(resp.Body).Decode(&ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func (c *Client) ReportChunkHealth(report shared.ChunkHealthReport) error {
+	report.DeviceID = c.ID
+	body, _ := json.Marshal(report)
+	resp, err := c.Client.Post(c.ServerURL+"/chunk/report", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("report chunk health failed: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SendInventory reports every chunk held locally and returns the ones the
+// server no longer references.
+func (c *Client) SendInventory(ids []string) ([]string, error) {
+	inv := shared.EncodeInventory(ids)
+	inv.DeviceID = c.ID
+	body, _ := json.Marshal(inv)
+	resp, err := c.Client.Post(c.ServerURL+"/chunk/inventory", "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("send inventory failed: %d", resp.StatusCode)
+	}
+
+	var res shared.InventoryResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return res.Delete, nil
+}
@@ -0,0 +1,93 @@
+package client
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// errorWindow is how far back RecentErrors counts.
+const errorWindow = 5 * time.Minute
+
+// minMeteredBytes keeps small transfers, dominated by latency, out of the
+// throughput averages.
+const minMeteredBytes = 64 * 1024
+
+// Meter tracks transfer throughput as a moving average in bytes/sec.
+type Meter struct {
+	mu   sync.Mutex
+	rate float64
+}
+
+// Observe records a transfer of n bytes that took d.
+func (m *Meter) Observe(n int, d time.Duration) {
+	if n < minMeteredBytes || d <= 0 {
+		return
+	}
+	r := float64(n) / d.Seconds()
+	m.mu.Lock()
+	if m.rate == 0 {
+		m.rate = r
+	} else {
+		m.rate = m.rate*0.8 + r*0.2
+	}
+	m.mu.Unlock()
+}
+
+// Rate returns the average throughput, 0 before any transfer was measured.
+func (m *Meter) Rate() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(m.rate)
+}
+
+var heartbeatFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "gendrive_agent_heartbeat_failures_total",
+	Help: "Heartbeats that failed to reach the server.",
+})
+
+type errorEvent struct {
+	kind string
+	at   time.Time
+}
+
+// errorLog remembers recent errors by kind.
+type errorLog struct {
+	mu     sync.Mutex
+	events []errorEvent
+}
+
+// RecordError counts an error of the given kind (e.g. "relay_send") towards
+// the counts reported with heartbeats.
+func (c *Client) RecordError(kind string) {
+	c.errors.mu.Lock()
+	c.errors.events = append(c.errors.prune(), errorEvent{kind: kind, at: time.Now()})
+	c.errors.mu.Unlock()
+}
+
+// RecentErrors counts the errors of the last five minutes by kind.
+func (c *Client) RecentErrors() map[string]int {
+	c.errors.mu.Lock()
+	defer c.errors.mu.Unlock()
+	c.errors.events = c.errors.prune()
+	if len(c.errors.events) == 0 {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, e := range c.errors.events {
+		counts[e.kind]++
+	}
+	return counts
+}
+
+// prune drops events older than errorWindow. Callers hold mu.
+func (l *errorLog) prune() []errorEvent {
+	cutoff := time.Now().Add(-errorWindow)
+	i := 0
+	for i < len(l.events) && l.events[i].at.Before(cutoff) {
+		i++
+	}
+	return l.events[i:]
+}
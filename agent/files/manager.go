@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -70,7 +71,7 @@ func (m *Manager) UploadFile(path string) error {
 		targetPeers = targetPeers[:2]
 	}
 
-	fmt.Printf("Replicating file to %d peers: %v\n", len(targetPeers), targetPeers)
+	slog.Info("Replicating file", "peers", targetPeers)
 
 	// 3. Chunk and Upload
 	buffer := make([]byte, transfer.ChunkSize)
@@ -104,8 +105,8 @@ func (m *Manager) UploadFile(path string) error {
 
 		// Send to ALL targets
 		for _, peer := range targetPeers {
-			if err := transfer.UploadChunk(m.Client.ServerURL, peer.ID, targetSession, msgBytes); err != nil {
-				fmt.Printf("Warning: Failed to upload chunk to %s: %v\n", peer.ID, err)
+			if err := transfer.UploadChunk(m.Client.Client, m.Client.ServerURL, peer.ID, targetSession, msgBytes); err != nil {
+				slog.Warn("Failed to upload chunk", "device", peer.ID, "err", err)
 				// Continue trying other peers?
 			}
 		}
@@ -123,6 +124,6 @@ func (m *Manager) UploadFile(path string) error {
 		return fmt.Errorf("failed to publish metadata: %v", err)
 	}
 
-	fmt.Printf("File uploaded successfully: %s\n", meta.Path)
+	slog.Info("File uploaded", "path", meta.Path)
 	return nil
 }
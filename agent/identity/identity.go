@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"os"
+	"strings"
 
 	"github.com/google/uuid"
 )
@@ -33,7 +34,8 @@ func LoadOrGenerate(path string) (*Identity, error) {
 
 	// Generate new
 	id := &Identity{
-		DeviceID: uuid.New().String(),
+		// No dashes: the server refuses them in new device IDs
+		DeviceID: strings.ReplaceAll(uuid.New().String(), "-", ""),
 	}
 
 	privKey, err := rsa.GenerateKey(rand.Reader, 2048)
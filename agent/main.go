@@ -1,27 +1,44 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
 	"p2p-drive/agent/bg"
 	"p2p-drive/agent/client"
 	"p2p-drive/agent/identity"
 	"p2p-drive/agent/storage"
+	"p2p-drive/shared"
 )
 
+// Version is set at build time with -ldflags "-X main.Version=...".
+var Version = "dev"
+
 func main() {
 	mode := flag.String("mode", "disk", "Storage mode: 'disk' or 'gdrive'")
 	credsPath := flag.String("creds", "credentials.json", "Path to GDrive credentials.json (required for gdrive mode)")
 	serverURL := flag.String("server", "http://localhost:8085", "Control Server URL")
 	dataDir := flag.String("data", "./agent_data", "Data directory")
+	scrubInterval := flag.Duration("scrub-interval", 6*time.Hour, "How often to re-verify stored chunks")
+	inventoryInterval := flag.Duration("inventory-interval", time.Hour, "How often to report held chunks for garbage collection")
+	metricsAddr := flag.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. 127.0.0.1:9101 (empty = off)")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	logJSON := flag.Bool("log-json", false, "Write logs as JSON lines")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP collector to export traces to, e.g. http://localhost:4318 (empty = off)")
 	
 	// Default name with random suffix to avoid collisions
 	randBytes := make([]byte, 2)
@@ -32,6 +49,17 @@ func main() {
 
 	flag.Parse()
 
+	if err := shared.SetupLogging(os.Stderr, *logLevel, *logJSON); err != nil {
+		log.Fatal(err)
+	}
+	shutdownTracing, err := setupTracing(context.Background(), "gendrive-agent", *otlpEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *otlpEndpoint != "" {
+		flushTracingOnExit(shutdownTracing)
+	}
+
 	if err := os.MkdirAll(*dataDir, 0755); err != nil {
 		log.Fatal(err)
 	}
@@ -42,20 +70,24 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to load/generate identity: %v", err)
 	}
-	log.Printf("Device ID: %s", id.DeviceID)
+	slog.Info("Device identity loaded", "device", id.DeviceID)
 
 	// Generate Claim Token
 	claimToken := generateToken()
 
 	// 2. Client & Registration
 	c := client.NewClient(*serverURL, id.DeviceID)
+	if err := c.SetKey(id.PrivateKey); err != nil {
+		log.Fatalf("Failed to load device key: %v", err)
+	}
 	registeredID, err := c.Register(string(id.PublicKey), *name, id.DeviceID, claimToken)
 	if err != nil {
-		log.Printf("Registration warning: %v", err)
+		slog.Warn("Registration failed", "err", err)
 	} else {
 		if registeredID != id.DeviceID {
-			log.Printf("WARNING: Server assigned different ID: %s", registeredID)
+			slog.Warn("Server assigned a different device ID", "device", registeredID)
 			id.DeviceID = registeredID
+			c.ID = registeredID
 		}
 	}
 
@@ -63,7 +95,7 @@ func main() {
 	var store storage.ChunkStore
 
 	if *mode == "gdrive" {
-		log.Println("Initializing Google Drive Store...")
+		slog.Info("Initializing Google Drive store")
 		gStore, err := storage.NewGDriveStore(*credsPath)
 		if err != nil {
 			log.Fatalf("Failed to init GDrive: %v", err)
@@ -75,10 +107,57 @@ func main() {
 			log.Fatal(err)
 		}
 	}
+	store = storage.MeteredStore{ChunkStore: store}
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			slog.Info("Serving metrics", "addr", *metricsAddr)
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				slog.Error("Metrics listener failed", "err", err)
+			}
+		}()
+	}
+
+	// Capacity is sampled by the stats ticker; heartbeats send the latest
+	// sample. The chunk count comes from the same scan as the usage.
+	var statsMu sync.Mutex
+	var stats shared.HeartbeatRequest
+	refreshStats := func() int64 {
+		total, free, _ := store.Capacity()
+		used, chunks, _ := store.GetTotalUsage()
+		statsMu.Lock()
+		stats.TotalBytes, stats.FreeBytes, stats.UsedBytes = total, free, used
+		stats.ChunkCount = chunks
+		statsMu.Unlock()
+		return used
+	}
+	refreshStats()
 
 	receiver := bg.NewReceiver(c, store, id.DeviceID)
 	receiver.Start()
 
+	c.Telemetry = func(req *shared.HeartbeatRequest) {
+		statsMu.Lock()
+		req.TotalBytes, req.FreeBytes, req.UsedBytes = stats.TotalBytes, stats.FreeBytes, stats.UsedBytes
+		req.ChunkCount = stats.ChunkCount
+		statsMu.Unlock()
+		req.AgentVersion = Version
+		req.Platform = runtime.GOOS + "/" + runtime.GOARCH
+		req.StoreType = *mode
+		req.RelayQueue = receiver.QueueDepth()
+		req.Errors = c.RecentErrors()
+		req.UploadBps = c.Upload.Rate()
+		req.DownloadBps = c.Download.Rate()
+	}
+
+	scrubber := bg.NewScrubber(c, store, *scrubInterval)
+	scrubber.Start()
+
+	inventory := bg.NewInventory(c, store, *inventoryInterval)
+	inventory.Start()
+
 	// 4. Heartbeat
 	c.StartHeartbeat(5 * time.Second)
 
@@ -105,7 +184,7 @@ func main() {
 			// Sync
 			events, err := c.GetDeletions(lastSync)
 			if err == nil && len(events) > 0 {
-				log.Printf("Syncing %d deletions...", len(events))
+				slog.Info("Syncing deletions", "count", len(events))
 				for _, evt := range events {
 					for _, chunkID := range evt.ChunkIDs {
 						store.DeleteChunk(chunkID)
@@ -124,7 +203,8 @@ func main() {
 					os.WriteFile(configPath, data, 0644)
 				}
 			} else if err != nil {
-				log.Printf("Sync error: %v", err)
+				slog.Warn("Deletion sync failed", "err", err)
+				c.RecordError("sync")
 			}
 			
 			<-syncTicker.C
@@ -141,14 +221,14 @@ func main() {
 	fmt.Println(" Go to your Dashboard to Add this Device.")
 	fmt.Println("========================================")
 
-	log.Println("Agent running (Headless). Press Ctrl+C to stop.")
+	slog.Info("Agent running (headless). Press Ctrl+C to stop.")
 
 	// Stats ticker
 	go func() {
 		for {
 			time.Sleep(10 * time.Second) // Updates every 10s for demo
-			usage, _ := store.GetTotalUsage()
-			fmt.Printf("[%s] Storage Used: %.2f MB\n", time.Now().Format("15:04:05"), float64(usage)/1024/1024)
+			usage := refreshStats()
+			slog.Info("Storage used", "bytes", usage)
 		}
 	}()
 
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package storage
+
+import "errors"
+
+func diskSpace(path string) (int64, int64, error) {
+	return 0, 0, errors.New("disk space reporting not supported on this platform")
+}
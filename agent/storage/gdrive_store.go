@@ -128,12 +128,55 @@ func (s *GDriveStore) DeleteChunk(chunkID string) error {
 	return s.Service.Files.Delete(fileID).Do()
 }
 
-func (s *GDriveStore) GetTotalUsage() (int64, error) {
+// GetTotalUsage sums the chunks in the GenDrive folder, not the whole Drive.
+func (s *GDriveStore) GetTotalUsage() (int64, int, error) {
+	q := fmt.Sprintf("'%s' in parents and trashed = false", s.FolderID)
+	var size int64
+	var count int
+	err := s.Service.Files.List().Q(q).Fields("nextPageToken, files(size)").PageSize(1000).
+		Pages(context.Background(), func(r *drive.FileList) error {
+			for _, f := range r.Files {
+				size += f.Size
+			}
+			count += len(r.Files)
+			return nil
+		})
+	return size, count, err
+}
+
+// Capacity reports the account quota. Unlimited accounts report a total of 0.
+func (s *GDriveStore) Capacity() (int64, int64, error) {
 	about, err := s.Service.About.Get().Fields("storageQuota").Do()
 	if err != nil {
-		return 0, err
+		return 0, 0, err
+	}
+	if about.StorageQuota.Limit == 0 {
+		return 0, 0, nil
+	}
+	return about.StorageQuota.Limit, about.StorageQuota.Limit - about.StorageQuota.Usage, nil
+}
+
+func (s *GDriveStore) ListChunks() ([]string, error) {
+	q := fmt.Sprintf("'%s' in parents and trashed = false", s.FolderID)
+	var ids []string
+	pageToken := ""
+	for {
+		call := s.Service.Files.List().Q(q).Fields("nextPageToken, files(name)").PageSize(1000)
+		if pageToken != "" {
+			call = call.PageToken(pageToken)
+		}
+		r, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range r.Files {
+			ids = append(ids, f.Name)
+		}
+		if r.NextPageToken == "" {
+			return ids, nil
+		}
+		pageToken = r.NextPageToken
 	}
-	return about.StorageQuota.Usage, nil
 }
 
 // Helpers
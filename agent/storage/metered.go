@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	storeOps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gendrive_agent_store_operations_total",
+		Help: "Chunk store operations, by operation (save, get, delete) and result.",
+	}, []string{"op", "result"})
+	storeDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gendrive_agent_store_duration_seconds",
+		Help:    "Time taken by chunk store operations, by operation.",
+		Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10},
+	}, []string{"op"})
+)
+
+// MeteredStore counts and times the chunk operations of another store.
+type MeteredStore struct {
+	ChunkStore
+}
+
+func (s MeteredStore) SaveChunk(chunkID string, data []byte) error {
+	defer observeStore("save", time.Now())
+	err := s.ChunkStore.SaveChunk(chunkID, data)
+	countStore("save", err)
+	return err
+}
+
+func (s MeteredStore) GetChunk(chunkID string) ([]byte, error) {
+	defer observeStore("get", time.Now())
+	data, err := s.ChunkStore.GetChunk(chunkID)
+	countStore("get", err)
+	return data, err
+}
+
+func (s MeteredStore) DeleteChunk(chunkID string) error {
+	defer observeStore("delete", time.Now())
+	err := s.ChunkStore.DeleteChunk(chunkID)
+	countStore("delete", err)
+	return err
+}
+
+func observeStore(op string, start time.Time) {
+	storeDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
+
+func countStore(op string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	storeOps.WithLabelValues(op, result).Inc()
+}
@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -13,7 +15,15 @@ type ChunkStore interface {
 	GetChunk(chunkID string) ([]byte, error)
 	HasChunk(chunkID string) bool
 	DeleteChunk(chunkID string) error
-	GetTotalUsage() (int64, error)
+	GetTotalUsage() (bytes int64, chunks int, err error) // Chunk bytes and count
+	ListChunks() ([]string, error)
+	Capacity() (total int64, free int64, err error)
+}
+
+// ChunkMatches reports whether data still hashes to its content-addressed ID.
+func ChunkMatches(chunkID string, data []byte) bool {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) == chunkID
 }
 
 type DiskStore struct {
@@ -49,17 +59,36 @@ func (s *DiskStore) DeleteChunk(chunkID string) error {
 	return os.Remove(path)
 }
 
-func (s *DiskStore) GetTotalUsage() (int64, error) {
+func (s *DiskStore) GetTotalUsage() (int64, int, error) {
 	var size int64
+	var count int
 	err := filepath.Walk(s.Root, func(_ string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		if !info.IsDir() {
 			size += info.Size()
+			count++
 		}
 		return nil
 	})
-	return size, err
+	return size, count, err
 }
 
+func (s *DiskStore) ListChunks() ([]string, error) {
+	entries, err := os.ReadDir(s.Root)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
+
+func (s *DiskStore) Capacity() (int64, int64, error) {
+	return diskSpace(s.Root)
+}
@@ -1,7 +1,7 @@
 package uiserver
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 
 	"p2p-drive/agent/client"
@@ -34,9 +34,9 @@ func (s *UIServer) Start() {
 	fs := http.FileServer(http.Dir(s.WebDir))
 	mux.Handle("/", fs)
 
-	log.Printf("Agent UI starting on http://localhost:%s", s.Port)
+	slog.Info("Agent UI starting", "url", "http://localhost:"+s.Port)
 	if err := http.ListenAndServe(":"+s.Port, mux); err != nil {
-		log.Printf("Agent UI Error: %v", err)
+		slog.Error("Agent UI failed", "err", err)
 	}
 }
 
@@ -54,11 +54,11 @@ func (s *UIServer) handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 
 	go func() {
-		log.Printf("Starting distributed upload of %s", filePath)
+		slog.Info("Starting distributed upload", "path", filePath)
 		if err := s.Manager.UploadFile(filePath); err != nil {
-			log.Printf("Upload failed: %v", err)
+			slog.Error("Upload failed", "path", filePath, "err", err)
 		} else {
-			log.Printf("Upload success: %s", filePath)
+			slog.Info("Upload succeeded", "path", filePath)
 		}
 	}()
 
@@ -0,0 +1,354 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// User roles.
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// RequireAdmin lets only admins through. Wrap it inside Middleware, which
+// has already refused tokens without the admin scope.
+func (a *AuthHandler) RequireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var role string
+		a.DB.QueryRow("SELECT COALESCE(role, 'user') FROM users WHERE id = ?", r.Header.Get("X-User-ID")).Scan(&role)
+		if role != RoleAdmin {
+			http.Error(w, "Admin only", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// newUserRole is the SQL expression for a new account's role: the very
+// first account is an admin. It is evaluated inside the INSERT, so two
+// concurrent first signups can't both see an empty table.
+const newUserRole = "CASE WHEN EXISTS (SELECT 1 FROM users) THEN '" + RoleUser + "' ELSE '" + RoleAdmin + "' END"
+
+// MakeAdminByEmail is the CLI bootstrap for granting the admin role.
+func MakeAdminByEmail(db *sql.DB, email string) error {
+	res, err := db.Exec("UPDATE users SET role = ? WHERE email = ?", RoleAdmin, email)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no user with email %s", email)
+	}
+	return nil
+}
+
+// AdminUser is one row of the admin user list.
+type AdminUser struct {
+	ID        string `json:"id"`
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	Suspended bool   `json:"suspended"`
+	TOTP      bool   `json:"totp_enabled"`
+	CreatedAt string `json:"created_at"`
+	Devices   int    `json:"devices"`
+	Files     int    `json:"files"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// AdminListUsers lists every account with its usage.
+func (s *Server) AdminListUsers(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.DB.Query(`
+		SELECT u.id, u.email, COALESCE(u.role, 'user'), COALESCE(u.suspended, 0), COALESCE(u.totp_enabled, 0),
+			COALESCE(u.created_at, ''),
+			(SELECT COUNT(*) FROM devices d WHERE d.user_id = u.id),
+			(SELECT COUNT(*) FROM files f WHERE f.user_id = u.id),
+			(SELECT COALESCE(SUM(f.size), 0) FROM files f WHERE f.user_id = u.id)
+		FROM users u ORDER BY u.created_at`)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	users := []AdminUser{}
+	for rows.Next() {
+		var u AdminUser
+		if err := rows.Scan(&u.ID, &u.Email, &u.Role, &u.Suspended, &u.TOTP, &u.CreatedAt, &u.Devices, &u.Files, &u.Bytes); err != nil {
+			continue
+		}
+		users = append(users, u)
+	}
+	json.NewEncoder(w).Encode(users)
+}
+
+// AdminUserRequest targets one user with an admin action.
+type AdminUserRequest struct {
+	UserID    string `json:"user_id"`
+	Suspended bool   `json:"suspended"`
+	Role      string `json:"role"`
+}
+
+// AdminSuspendUser suspends (or reinstates) an account. Suspension ends the
+// user's sessions; their tokens stop working until reinstated.
+func (s *Server) AdminSuspendUser(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.decodeAdminUserRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.UserID == r.Header.Get("X-User-ID") {
+		http.Error(w, "You can't suspend yourself", http.StatusBadRequest)
+		return
+	}
+	s.DB.Exec("UPDATE users SET suspended = ? WHERE id = ?", req.Suspended, req.UserID)
+	if req.Suspended {
+		s.DB.Exec("DELETE FROM sessions WHERE user_id = ?", req.UserID)
+	}
+	slog.InfoContext(r.Context(), "Admin changed suspension", "admin", r.Header.Get("X-User-ID"), "user", req.UserID, "suspended", req.Suspended)
+	w.WriteHeader(http.StatusOK)
+}
+
+// AdminSetRole grants or revokes the admin role.
+func (s *Server) AdminSetRole(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.decodeAdminUserRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.Role != RoleAdmin && req.Role != RoleUser {
+		http.Error(w, "Role must be admin or user", http.StatusBadRequest)
+		return
+	}
+	if req.UserID == r.Header.Get("X-User-ID") && req.Role != RoleAdmin {
+		http.Error(w, "You can't demote yourself", http.StatusBadRequest)
+		return
+	}
+	s.DB.Exec("UPDATE users SET role = ? WHERE id = ?", req.Role, req.UserID)
+	slog.InfoContext(r.Context(), "Admin changed role", "admin", r.Header.Get("X-User-ID"), "user", req.UserID, "role", req.Role)
+	w.WriteHeader(http.StatusOK)
+}
+
+// AdminResetTOTP turns off 2FA for a user locked out of it.
+func (s *Server) AdminResetTOTP(w http.ResponseWriter, r *http.Request) {
+	req, ok := s.decodeAdminUserRequest(w, r)
+	if !ok {
+		return
+	}
+	resetTOTP(s.DB, req.UserID)
+	slog.InfoContext(r.Context(), "Admin reset 2FA", "admin", r.Header.Get("X-User-ID"), "user", req.UserID)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) decodeAdminUserRequest(w http.ResponseWriter, r *http.Request) (AdminUserRequest, bool) {
+	var req AdminUserRequest
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return req, false
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return req, false
+	}
+	var exists int
+	s.DB.QueryRow("SELECT 1 FROM users WHERE id = ?", req.UserID).Scan(&exists)
+	if exists == 0 {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return req, false
+	}
+	return req, true
+}
+
+// ClusterStats summarises the whole installation.
+type ClusterStats struct {
+	Users          int            `json:"users"`
+	Devices        int            `json:"devices"`
+	DevicesOnline  int            `json:"devices_online"`
+	DevicesByType  map[string]int `json:"devices_by_type"`
+	DevicesByState map[string]int `json:"devices_by_state"`
+	Files          int            `json:"files"`
+	LogicalBytes   int64          `json:"logical_bytes"`
+	Chunks         int            `json:"chunks"`
+	Replicas       int            `json:"replicas"`
+	StoredBytes    int64          `json:"stored_bytes"`
+	UnplacedChunks int            `json:"unplaced_chunks"` // No replica at all
+	SingleReplica  int            `json:"single_replica"`  // Exactly one replica
+	RepairQueue    int            `json:"repair_queue"`    // Repairs waiting
+	CapacityBytes  int64          `json:"capacity_bytes"`  // Reported total of all devices
+	FreeBytes      int64          `json:"free_bytes"`      // Reported free of all devices
+}
+
+// AdminStats reports global device and chunk statistics.
+func (s *Server) AdminStats(w http.ResponseWriter, r *http.Request) {
+	st := ClusterStats{
+		DevicesByType:  make(map[string]int),
+		DevicesByState: make(map[string]int),
+		RepairQueue:    len(s.repairs),
+	}
+
+	s.DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&st.Users)
+	s.DB.QueryRow(`SELECT COUNT(*), COALESCE(SUM(online), 0), COALESCE(SUM(total_bytes), 0), COALESCE(SUM(free_bytes), 0)
+		FROM devices`).Scan(&st.Devices, &st.DevicesOnline, &st.CapacityBytes, &st.FreeBytes)
+	s.DB.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM files").Scan(&st.Files, &st.LogicalBytes)
+	s.DB.QueryRow("SELECT COUNT(*) FROM chunks").Scan(&st.Chunks)
+	s.DB.QueryRow(`SELECT COUNT(*), COALESCE(SUM(c.size), 0) FROM chunk_locations cl
+		JOIN chunks c ON c.id = cl.chunk_id`).Scan(&st.Replicas, &st.StoredBytes)
+	s.DB.QueryRow(`SELECT COUNT(*) FROM chunks c
+		WHERE NOT EXISTS (SELECT 1 FROM chunk_locations cl WHERE cl.chunk_id = c.id)`).Scan(&st.UnplacedChunks)
+	s.DB.QueryRow(`SELECT COUNT(*) FROM (SELECT chunk_id FROM chunk_locations GROUP BY chunk_id HAVING COUNT(*) = 1)`).Scan(&st.SingleReplica)
+
+	rows, err := s.DB.Query("SELECT COALESCE(type, 'agent'), COALESCE(state, 'active'), COUNT(*) FROM devices GROUP BY 1, 2")
+	if err == nil {
+		for rows.Next() {
+			var dType, state string
+			var n int
+			rows.Scan(&dType, &state, &n)
+			st.DevicesByType[dType] += n
+			st.DevicesByState[state] += n
+		}
+		rows.Close()
+	}
+
+	json.NewEncoder(w).Encode(st)
+}
+
+// AdminRepair forces a repair pass: of one chunk (?chunk_id=), or of every
+// chunk in the database. Chunks that already satisfy their policy are left
+// alone, so a full pass is safe to run at any time.
+func (s *Server) AdminRepair(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if chunkID := r.URL.Query().Get("chunk_id"); chunkID != "" {
+		go s.RepairChunk(repairRequest{ChunkID: chunkID})
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"chunks":1}`))
+		return
+	}
+
+	rows, err := s.DB.Query("SELECT id FROM chunks")
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	ctx := detachedContext(r.Context())
+	go func() {
+		start := time.Now()
+		for _, id := range ids {
+			s.RepairChunk(repairRequest{ChunkID: id})
+		}
+		slog.InfoContext(ctx, "Forced repair pass complete", "chunks", len(ids), "duration", time.Since(start))
+	}()
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf(`{"chunks":%d}`, len(ids))))
+}
+
+// GCResult counts what a garbage collection pass removed.
+type GCResult struct {
+	StaleLocations  int `json:"stale_locations"` // Locations of chunks no file uses
+	OrphanChunks    int `json:"orphan_chunks"`   // Chunk rows of deleted files
+	ExpiredSessions int `json:"expired_sessions"`
+	ExpiredTokens   int `json:"expired_tokens"`
+}
+
+// AdminGC runs a server-side garbage collection pass. Chunks stranded on
+// agents without any record are handled by inventory reconciliation.
+func (s *Server) AdminGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	json.NewEncoder(w).Encode(s.CollectGarbage(r.Context()))
+}
+
+// CollectGarbage removes database rows nothing depends on anymore and tells
+// devices to delete the chunks behind stale locations.
+func (s *Server) CollectGarbage(ctx context.Context) GCResult {
+	var res GCResult
+	now := time.Now().UTC().Format(time.RFC3339)
+
+	// 1. Chunk rows whose file is gone
+	if r, err := s.DB.Exec("DELETE FROM chunks WHERE file_id IS NULL OR file_id NOT IN (SELECT id FROM files)"); err == nil {
+		n, _ := r.RowsAffected()
+		res.OrphanChunks = int(n)
+	}
+
+	// 2. Locations of chunks that no longer exist
+	rows, err := s.DB.Query(`SELECT cl.chunk_id, cl.device_id FROM chunk_locations cl
+		WHERE NOT EXISTS (SELECT 1 FROM chunks c WHERE c.id = cl.chunk_id)`)
+	if err == nil {
+		type loc struct{ chunkID, deviceID string }
+		var stale []loc
+		for rows.Next() {
+			var l loc
+			rows.Scan(&l.chunkID, &l.deviceID)
+			stale = append(stale, l)
+		}
+		rows.Close()
+		for _, l := range stale {
+			s.releaseChunk(ctx, l.chunkID, l.deviceID)
+		}
+		res.StaleLocations = len(stale)
+	}
+	s.DB.Exec("DELETE FROM chunk_challenges WHERE chunk_id NOT IN (SELECT id FROM chunks)")
+
+	// 3. Expired credentials
+	if r, err := s.DB.Exec("DELETE FROM sessions WHERE expires_at < ?", now); err == nil {
+		n, _ := r.RowsAffected()
+		res.ExpiredSessions = int(n)
+	}
+	if r, err := s.DB.Exec("DELETE FROM api_tokens WHERE expires_at IS NOT NULL AND expires_at < ?", now); err == nil {
+		n, _ := r.RowsAffected()
+		res.ExpiredTokens = int(n)
+	}
+
+	slog.InfoContext(ctx, "GC complete", "stale_locations", res.StaleLocations, "orphan_chunks", res.OrphanChunks,
+		"expired_sessions", res.ExpiredSessions, "expired_tokens", res.ExpiredTokens)
+	return res
+}
+
+// AdminRebalance rebalances every user's devices (or one user's, with
+// ?user_id=) in the background.
+func (s *Server) AdminRebalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var users []string
+	if id := r.URL.Query().Get("user_id"); id != "" {
+		users = []string{id}
+	} else {
+		rows, err := s.DB.Query("SELECT DISTINCT user_id FROM devices WHERE user_id IS NOT NULL AND user_id != ''")
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			var id string
+			rows.Scan(&id)
+			users = append(users, id)
+		}
+		rows.Close()
+	}
+
+	go func() {
+		for _, id := range users {
+			s.TriggerRebalance(id)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf(`{"users":%d}`, len(users))))
+}
@@ -2,27 +2,59 @@ package api
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	sessionCookie = "session_token"
+
+	// Sessions expire after sessionIdle without use, and never live longer
+	// than sessionMaxAge however active they are.
+	sessionIdle   = 7 * 24 * time.Hour
+	sessionMaxAge = 30 * 24 * time.Hour
+
+	// Activity only pushes expiry out once this much has passed, so busy
+	// sessions don't write to the DB on every request.
+	sessionRenewAfter = time.Minute
+
+	// A login waiting for its second factor must complete within this
+	sessionPendingMFA = 5 * time.Minute
+)
+
+// session is a row of the sessions table.
+type session struct {
+	TokenHash string
+	UserID    string
+	Pending   bool // Password checked, second factor still due
+	Created   time.Time
+	LastSeen  time.Time
+	Expires   time.Time
+}
+
 type AuthHandler struct {
-	DB       *sql.DB
-	Sessions map[string]string // Token -> UserID
-	mu       sync.Mutex
+	DB *sql.DB
+
+	// SecureCookies marks session cookies Secure even on plain HTTP requests
+	// (e.g. behind a TLS proxy that doesn't set X-Forwarded-Proto).
+	SecureCookies bool
 }
 
 func NewAuthHandler(db *sql.DB) *AuthHandler {
-	return &AuthHandler{
-		DB:       db,
-		Sessions: make(map[string]string),
-	}
+	a := &AuthHandler{DB: db}
+	a.migratePasswords()
+	a.ensureAdmin()
+	return a
 }
 
 type Credentials struct {
@@ -33,16 +65,20 @@ type Credentials struct {
 // Signup
 func (a *AuthHandler) Signup(w http.ResponseWriter, r *http.Request) {
 	var creds Credentials
-	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil || creds.Email == "" || creds.Password == "" {
+		http.Error(w, "Invalid credentials", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(creds.Password), bcrypt.DefaultCost)
+	if err != nil {
 		http.Error(w, "Invalid credentials", http.StatusBadRequest)
 		return
 	}
 
 	id := uuid.New().String()
-	// Storing plaintext password for prototype speed.
-	// Production: Use bcrypt (`golang.org/x/crypto/bcrypt`)
-	_, err := a.DB.Exec("INSERT INTO users (id, email, password, created_at) VALUES (?, ?, ?, ?)",
-		id, creds.Email, creds.Password, time.Now().Format(time.RFC3339))
+	_, err = a.DB.Exec("INSERT INTO users (id, email, password, created_at, role) SELECT ?, ?, ?, ?, "+newUserRole,
+		id, creds.Email, string(hash), time.Now().Format(time.RFC3339))
 
 	if err != nil {
 		http.Error(w, "User already exists or DB error", http.StatusConflict)
@@ -60,54 +96,289 @@ func (a *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var id string
-	err := a.DB.QueryRow("SELECT id FROM users WHERE email = ? AND password = ?", creds.Email, creds.Password).Scan(&id)
-	if err != nil {
+	var id, hash string
+	var suspended bool
+	err := a.DB.QueryRow("SELECT id, password, COALESCE(suspended, 0) FROM users WHERE email = ?", creds.Email).Scan(&id, &hash, &suspended)
+	if err != nil || hash == "" {
+		// Spend the same time as for a real account, so response times
+		// don't reveal which emails are registered
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(creds.Password))
 		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
 		return
 	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(creds.Password)) != nil {
+		http.Error(w, "Invalid email or password", http.StatusUnauthorized)
+		return
+	}
+	if suspended {
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	}
 
-	// Create Session
-	token := generateToken()
-	a.mu.Lock()
-	a.Sessions[token] = id
-	a.mu.Unlock()
-
-	http.SetCookie(w, &http.Cookie{
-		Name:  "session_token",
-		Value: token,
-		Path:  "/",
-	})
+	pending, err := a.startSession(w, r, id)
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	if pending {
+		// The client finishes with POST /api/login/2fa
+		json.NewEncoder(w).Encode(map[string]interface{}{"mfa_required": true})
+		return
+	}
 
 	json.NewEncoder(w).Encode(map[string]string{"user_id": id})
 }
 
-// Middleware
+// Logout ends the current session.
+func (a *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		a.DB.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(c.Value))
+	}
+	a.clearCookie(w, r)
+	w.WriteHeader(http.StatusOK)
+}
+
+// LogoutAll ends every session of the current user, on all browsers.
+func (a *AuthHandler) LogoutAll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Header.Get("X-User-ID")
+	res, err := a.DB.Exec("DELETE FROM sessions WHERE user_id = ?", userID)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	n, _ := res.RowsAffected()
+	a.clearCookie(w, r)
+	json.NewEncoder(w).Encode(map[string]int64{"sessions_ended": n})
+}
+
+// Middleware authenticates the request by session cookie or by an
+// "Authorization: Bearer" personal API token.
 func (a *AuthHandler) Middleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		c, err := r.Cookie("session_token")
-		if err != nil {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+		var userID, scope, sessionID string
+
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			var valid bool
+			userID, scope, valid = a.checkToken(strings.TrimSpace(bearer))
+			if !valid {
+				http.Error(w, "Invalid token", http.StatusUnauthorized)
+				return
+			}
+		} else {
+			c, err := r.Cookie(sessionCookie)
+			if err != nil {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			sess, valid := a.checkSession(w, r, c.Value)
+			if !valid {
+				a.clearCookie(w, r)
+				http.Error(w, "Invalid session", http.StatusUnauthorized)
+				return
+			}
+			if sess.Pending {
+				http.Error(w, "Two-factor verification required", http.StatusUnauthorized)
+				return
+			}
+			userID, sessionID, scope = sess.UserID, sess.TokenHash, ScopeSession
 		}
 
-		a.mu.Lock()
-		userID, ok := a.Sessions[c.Value]
-		a.mu.Unlock()
+		var suspended bool
+		a.DB.QueryRow("SELECT COALESCE(suspended, 0) FROM users WHERE id = ?", userID).Scan(&suspended)
+		if suspended {
+			http.Error(w, "Account suspended", http.StatusForbidden)
+			return
+		}
 
-		if !ok {
-			http.Error(w, "Invalid session", http.StatusUnauthorized)
+		if !scopeAllows(scope, r) {
+			http.Error(w, "Token scope does not allow this request", http.StatusForbidden)
 			return
 		}
 
 		// Inject UserID into Header for handlers to access
 		r.Header.Set("X-User-ID", userID)
+		r.Header.Set("X-Auth-Scope", scope)
+		r.Header.Set("X-Session-ID", sessionID) // Empty for API tokens
 		next(w, r)
 	}
 }
 
+// startSession creates a session for the user and sets its cookie. Users
+// with two-factor authentication get a short-lived pending session that
+// only LoginSecondFactor can complete.
+func (a *AuthHandler) startSession(w http.ResponseWriter, r *http.Request, userID string) (pending bool, err error) {
+	now := time.Now().UTC()
+	a.DB.Exec("DELETE FROM sessions WHERE expires_at < ?", now.Format(time.RFC3339))
+
+	a.DB.QueryRow("SELECT COALESCE(totp_enabled, 0) FROM users WHERE id = ?", userID).Scan(&pending)
+
+	token := generateToken()
+	expires := now.Add(sessionIdle)
+	if pending {
+		expires = now.Add(sessionPendingMFA)
+	}
+	_, err = a.DB.Exec(`INSERT INTO sessions (token_hash, user_id, created_at, last_seen, expires_at, user_agent, ip, mfa_pending)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		hashToken(token), userID, now.Format(time.RFC3339), now.Format(time.RFC3339), expires.Format(time.RFC3339),
+		r.UserAgent(), r.RemoteAddr, pending)
+	if err != nil {
+		return false, err
+	}
+	a.setCookie(w, r, token, expires)
+	return pending, nil
+}
+
+// lookupSession loads an unexpired session by its cookie value.
+func (a *AuthHandler) lookupSession(token string) (*session, bool) {
+	sess := &session{TokenHash: hashToken(token)}
+	var createdStr, lastSeenStr, expiresStr string
+	err := a.DB.QueryRow("SELECT user_id, created_at, last_seen, expires_at, COALESCE(mfa_pending, 0) FROM sessions WHERE token_hash = ?", sess.TokenHash).
+		Scan(&sess.UserID, &createdStr, &lastSeenStr, &expiresStr, &sess.Pending)
+	if err != nil {
+		return nil, false
+	}
+	sess.Created, _ = time.Parse(time.RFC3339, createdStr)
+	sess.LastSeen, _ = time.Parse(time.RFC3339, lastSeenStr)
+	sess.Expires, _ = time.Parse(time.RFC3339, expiresStr)
+
+	if time.Now().After(sess.Expires) {
+		a.DB.Exec("DELETE FROM sessions WHERE token_hash = ?", sess.TokenHash)
+		return nil, false
+	}
+	return sess, true
+}
+
+// checkSession resolves a session token, sliding the expiry forward on use.
+func (a *AuthHandler) checkSession(w http.ResponseWriter, r *http.Request, token string) (*session, bool) {
+	sess, ok := a.lookupSession(token)
+	if !ok || sess.Pending {
+		return sess, ok
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(sess.LastSeen) >= sessionRenewAfter {
+		expires := now.Add(sessionIdle)
+		if limit := sess.Created.Add(sessionMaxAge); expires.After(limit) {
+			expires = limit
+		}
+		a.DB.Exec("UPDATE sessions SET last_seen = ?, expires_at = ? WHERE token_hash = ?",
+			now.Format(time.RFC3339), expires.Format(time.RFC3339), sess.TokenHash)
+		a.setCookie(w, r, token, expires)
+	}
+	return sess, true
+}
+
+func (a *AuthHandler) setCookie(w http.ResponseWriter, r *http.Request, token string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   a.secure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *AuthHandler) clearCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   a.secure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (a *AuthHandler) secure(r *http.Request) bool {
+	return a.SecureCookies || r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+// migratePasswords replaces any plaintext passwords left from before hashing
+// was introduced with their bcrypt hash.
+func (a *AuthHandler) migratePasswords() {
+	rows, err := a.DB.Query("SELECT id, password FROM users")
+	if err != nil {
+		return
+	}
+	plain := make(map[string]string)
+	for rows.Next() {
+		var id, password string
+		rows.Scan(&id, &password)
+		// Empty passwords belong to SSO-only accounts
+		if password != "" && !isBcryptHash(password) {
+			plain[id] = password
+		}
+	}
+	rows.Close()
+
+	hashed := 0
+	for id, password := range plain {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+			// bcrypt only reads the first 72 bytes, so a hash of those
+			// still matches the full password at login
+			slog.Warn("Password longer than 72 bytes, hashing its first 72", "user", id)
+			hash, err = bcrypt.GenerateFromPassword([]byte(password)[:72], bcrypt.DefaultCost)
+		}
+		if err != nil {
+			slog.Error("Failed to hash password, leaving it in plaintext", "user", id, "err", err)
+			continue
+		}
+		if _, err := a.DB.Exec("UPDATE users SET password = ? WHERE id = ?", string(hash), id); err != nil {
+			slog.Error("Failed to store password hash", "user", id, "err", err)
+			continue
+		}
+		hashed++
+	}
+	if hashed > 0 {
+		slog.Info("Hashed plaintext passwords", "count", hashed)
+	}
+}
+
+// ensureAdmin promotes the oldest account on installations that predate
+// roles, so there is always someone who can reach the admin API.
+func (a *AuthHandler) ensureAdmin() {
+	var admins int
+	a.DB.QueryRow("SELECT COUNT(*) FROM users WHERE role = ?", RoleAdmin).Scan(&admins)
+	if admins > 0 {
+		return
+	}
+	res, err := a.DB.Exec("UPDATE users SET role = ? WHERE id = (SELECT id FROM users ORDER BY created_at LIMIT 1)", RoleAdmin)
+	if err == nil {
+		if n, _ := res.RowsAffected(); n > 0 {
+			slog.Info("Promoted the first user to admin")
+		}
+	}
+}
+
+// dummyHash is checked against when a login matches no password account.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
+func isBcryptHash(s string) bool {
+	return len(s) == 60 && (strings.HasPrefix(s, "$2a$") || strings.HasPrefix(s, "$2b$") || strings.HasPrefix(s, "$2y$"))
+}
+
+// hashToken is how bearer secrets are stored, so a leaked database does not
+// leak live sessions.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func generateToken() string {
-	b := make([]byte, 16)
+	b := make([]byte, 32)
 	rand.Read(b)
 	return hex.EncodeToString(b)
 }
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"math/big"
+	"time"
+
+	"p2p-drive/shared"
+
+	"github.com/google/uuid"
+)
+
+const (
+	challengesPerChunk = 4
+	challengeMaxLength = 64 * 1024
+)
+
+// primeChallenges precomputes proof-of-storage challenges while the server
+// has verified chunk data in hand. The server never keeps the data itself,
+// so each challenge is answered once and then discarded; the challenger
+// retrieves the chunk again once they run out.
+func (s *Server) primeChallenges(chunkID string, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	var have int
+	s.DB.QueryRow("SELECT COUNT(*) FROM chunk_challenges WHERE chunk_id = ?", chunkID).Scan(&have)
+
+	for i := have; i < challengesPerChunk; i++ {
+		nonce := make([]byte, 32)
+		rand.Read(nonce)
+
+		length := int64(len(data))
+		if length > challengeMaxLength {
+			length = challengeMaxLength
+		}
+		var offset int64
+		if span := int64(len(data)) - length; span > 0 {
+			n, _ := rand.Int(rand.Reader, big.NewInt(span+1))
+			offset = n.Int64()
+		}
+
+		mac := hmac.New(sha256.New, nonce)
+		mac.Write(data[offset : offset+length])
+
+		s.DB.Exec("INSERT INTO chunk_challenges (id, chunk_id, nonce, range_offset, range_length, expected, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			uuid.New().String(), chunkID, hex.EncodeToString(nonce), offset, length,
+			hex.EncodeToString(mac.Sum(nil)), time.Now().Format(time.RFC3339))
+	}
+}
+
+// StartChallenger periodically challenges a random sample of stored chunks.
+func (s *Server) StartChallenger(interval time.Duration, batch int) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			s.runChallenges(batch)
+		}
+	}()
+}
+
+func (s *Server) runChallenges(batch int) {
+	// Drive copies are verified by the server-side scrubber instead
+	rows, err := s.DB.Query(`
+		SELECT cl.chunk_id, cl.device_id FROM chunk_locations cl
+		JOIN devices d ON d.id = cl.device_id
+		WHERE d.online = 1 AND COALESCE(d.type, 'agent') != 'gdrive'
+		ORDER BY RANDOM() LIMIT ?`, batch)
+	if err != nil {
+		slog.Error("Challenger: DB error", "err", err)
+		return
+	}
+	type target struct{ chunkID, deviceID string }
+	var targets []target
+	for rows.Next() {
+		var t target
+		if err := rows.Scan(&t.chunkID, &t.deviceID); err == nil {
+			targets = append(targets, t)
+		}
+	}
+	rows.Close()
+
+	for _, t := range targets {
+		s.ChallengeDevice(t.deviceID, t.chunkID)
+	}
+}
+
+// ChallengeDevice issues one stored challenge for a chunk to a device and
+// records the outcome. A wrong or empty answer invalidates the location.
+func (s *Server) ChallengeDevice(deviceID, chunkID string) {
+	ctx := backgroundContext()
+	var ch shared.StorageChallenge
+	var nonceHex, expected string
+	query := "SELECT id, nonce, range_offset, range_length, expected FROM chunk_challenges WHERE chunk_id = ? LIMIT 1"
+	err := s.DB.QueryRow(query, chunkID).Scan(&ch.ID, &nonceHex, &ch.Offset, &ch.Length, &expected)
+	if err == sql.ErrNoRows {
+		// Chunks nobody reads would otherwise run out of challenges
+		s.refillChallenges(ctx, deviceID, chunkID)
+		err = s.DB.QueryRow(query, chunkID).Scan(&ch.ID, &nonceHex, &ch.Offset, &ch.Length, &expected)
+	}
+	if err != nil {
+		return
+	}
+
+	ch.ChunkID = chunkID
+	ch.Nonce, _ = hex.DecodeString(nonceHex)
+	payload, _ := json.Marshal(ch)
+	session := shared.ServerSession(shared.RelaySessionProof, deviceID, ch.ID)
+	msgBytes, _ := json.Marshal(shared.RelayMessage{Type: shared.RelayTypeChallenge, Payload: payload, Session: session, RequestID: shared.RequestID(ctx), Trace: shared.InjectTrace(ctx)})
+	if !s.injectRelayMessage(ctx, deviceID, "inbox", msgBytes) {
+		return
+	}
+	// Consume it now the nonce is out: the answer could be cached
+	s.DB.Exec("DELETE FROM chunk_challenges WHERE id = ?", ch.ID)
+
+	proof, err := s.waitForRelayData(ctx, "server", session, 15*time.Second)
+	if err != nil {
+		slog.WarnContext(ctx, "Challenge not answered", "challenge", ch.ID, "device", deviceID, "chunk", chunkID)
+		s.DB.Exec("UPDATE devices SET challenges_failed = challenges_failed + 1 WHERE id = ?", deviceID)
+		return
+	}
+
+	want, _ := hex.DecodeString(expected)
+	if !hmac.Equal(proof, want) {
+		slog.WarnContext(ctx, "Challenge proof failed", "challenge", ch.ID, "device", deviceID, "chunk", chunkID)
+		s.DB.Exec("UPDATE devices SET challenges_failed = challenges_failed + 1 WHERE id = ?", deviceID)
+		s.dropReplica(chunkID, deviceID)
+		return
+	}
+	s.DB.Exec("UPDATE devices SET challenges_passed = challenges_passed + 1 WHERE id = ?", deviceID)
+}
+
+// refillChallenges retrieves a chunk to prime new challenges for it,
+// preferring another online holder so the challenged device still has to
+// answer one it hasn't seen. fetchChunk verifies the data and primes them.
+func (s *Server) refillChallenges(ctx context.Context, deviceID, chunkID string) {
+	rows, err := s.DB.Query(`
+		SELECT cl.device_id FROM chunk_locations cl
+		JOIN devices d ON d.id = cl.device_id
+		WHERE cl.chunk_id = ? AND (d.online = 1 OR d.type = 'gdrive')
+		ORDER BY cl.device_id = ?, RANDOM()`, chunkID, deviceID)
+	if err != nil {
+		return
+	}
+	var holders []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			holders = append(holders, id)
+		}
+	}
+	rows.Close()
+
+	for _, holder := range holders {
+		if _, err := s.fetchChunk(ctx, holder, chunkID); err == nil {
+			return
+		}
+	}
+	slog.WarnContext(ctx, "Could not refill challenges", "chunk", chunkID, "holders", len(holders))
+}
+
+// reliabilityScore is the Laplace-smoothed challenge pass rate, so new
+// devices start at 0.5 and move towards their observed behaviour.
+func reliabilityScore(passed, failed int) float64 {
+	return float64(passed+1) / float64(passed+failed+2)
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"p2p-drive/shared"
+
+	"github.com/google/uuid"
+)
+
+// verifyChunkData checks retrieved bytes against chunks.hash. Chunks without a
+// recorded hash are content-addressed, so the ID itself is the expected hash.
+func (s *Server) verifyChunkData(chunkID string, data []byte) bool {
+	var expected string
+	s.DB.QueryRow("SELECT hash FROM chunks WHERE id = ? AND hash IS NOT NULL LIMIT 1", chunkID).Scan(&expected)
+	if expected == "" {
+		expected = chunkID
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]) == expected
+}
+
+// fetchChunk retrieves a chunk from one device and verifies it. A copy that
+// fails verification is removed from the device and queued for repair.
+func (s *Server) fetchChunk(ctx context.Context, deviceID, chunkID string) (_ []byte, err error) {
+	ctx, span := startSpan(ctx, "fetchChunk", attribute.String("chunk", chunkID), attribute.String("device", deviceID))
+	defer func() { endSpan(span, err) }()
+
+	var dType, ownerID string
+	s.DB.QueryRow("SELECT COALESCE(type, 'agent'), COALESCE(user_id, '') FROM devices WHERE id = ?", deviceID).Scan(&dType, &ownerID)
+
+	var data []byte
+	if dType == "gdrive" {
+		d, err := s.GDrive.DownloadChunk(ownerID, chunkID)
+		if errors.Is(err, os.ErrNotExist) {
+			slog.WarnContext(ctx, "Chunk missing from device", "chunk", chunkID, "device", deviceID)
+			s.dropReplica(chunkID, deviceID)
+		}
+		if err != nil {
+			s.recordRetrieval(deviceID, false)
+			return nil, err
+		}
+		data = d
+	} else {
+		session := shared.ServerSession(shared.RelaySessionChunk, deviceID, uuid.New().String())
+		reqBytes, _ := json.Marshal(shared.RelayMessage{Type: shared.RelayTypeRetrieve, Payload: []byte(chunkID), Session: session, RequestID: shared.RequestID(ctx), Trace: shared.InjectTrace(ctx)})
+		if !s.injectRelayMessage(ctx, deviceID, "inbox", reqBytes) {
+			return nil, fmt.Errorf("device %s inbox full", deviceID)
+		}
+		d, err := s.waitForRelayData(ctx, "server", session, 15*time.Second)
+		if err != nil {
+			s.recordRetrieval(deviceID, false)
+			return nil, err
+		}
+		data = d
+	}
+
+	if !s.verifyChunkData(chunkID, data) {
+		slog.WarnContext(ctx, "Chunk failed hash verification", "chunk", chunkID, "device", deviceID)
+		s.recordRetrieval(deviceID, false)
+		s.discardChunk(ctx, deviceID, dType, ownerID, chunkID)
+		s.dropReplica(chunkID, deviceID)
+		return nil, fmt.Errorf("chunk %s corrupt on %s", chunkID, deviceID)
+	}
+	s.recordRetrieval(deviceID, true)
+	s.primeChallenges(chunkID, data)
+	return data, nil
+}
+
+// storeChunk places a chunk on a device and records the location once the
+// device has confirmed the write.
+func (s *Server) storeChunk(ctx context.Context, device shared.Device, chunkID string, data []byte) (err error) {
+	ctx, span := startSpan(ctx, "storeChunk", attribute.String("chunk", chunkID), attribute.String("device", device.ID), attribute.Int("bytes", len(data)))
+	defer func() { endSpan(span, err) }()
+
+	if device.Type == "gdrive" {
+		var ownerID string
+		s.DB.QueryRow("SELECT user_id FROM devices WHERE id = ?", device.ID).Scan(&ownerID)
+		if err := s.GDrive.UploadChunk(ownerID, chunkID, data); err != nil {
+			return err
+		}
+	} else {
+		session := shared.ServerSession(shared.RelaySessionAck, device.ID, uuid.New().String())
+		msgBytes, _ := json.Marshal(shared.RelayMessage{Type: shared.RelayTypeStore, Payload: data, Session: session, RequestID: shared.RequestID(ctx), Trace: shared.InjectTrace(ctx)})
+		sent := time.Now()
+		if !s.injectRelayMessage(ctx, device.ID, "inbox", msgBytes) {
+			chunkAckFailures.WithLabelValues("inbox_full").Inc()
+			return fmt.Errorf("device %s inbox full", device.ID)
+		}
+		ack, err := s.waitForRelayData(ctx, "server", session, 30*time.Second)
+		if err != nil {
+			chunkAckFailures.WithLabelValues("timeout").Inc()
+			s.recordAckLatency(device.ID, 30*time.Second)
+			return fmt.Errorf("device %s failed to ACK %s", device.ID, chunkID)
+		}
+		s.recordAckLatency(device.ID, time.Since(sent))
+		if string(ack) != "OK" {
+			chunkAckFailures.WithLabelValues("refused").Inc()
+			return fmt.Errorf("device %s refused %s: %s", device.ID, chunkID, ack)
+		}
+	}
+
+	s.addChunkLocation(chunkID, device.ID)
+	s.primeChallenges(chunkID, data)
+	return nil
+}
+
+// discardChunk tells a device to delete its copy of a chunk (best effort).
+func (s *Server) discardChunk(ctx context.Context, deviceID, dType, ownerID, chunkID string) {
+	if dType == "gdrive" {
+		s.GDrive.DeleteChunk(ownerID, chunkID)
+		return
+	}
+	bytes, _ := json.Marshal(shared.RelayMessage{Type: shared.RelayTypeDelete, Payload: []byte(chunkID), RequestID: shared.RequestID(ctx), Trace: shared.InjectTrace(ctx)})
+	s.injectRelayMessage(ctx, deviceID, "inbox", bytes)
+}
+
+// addChunkLocation records a replica and charges it to the file's account.
+func (s *Server) addChunkLocation(chunkID, deviceID string) error {
+	res, err := s.DB.Exec("INSERT OR IGNORE INTO chunk_locations (chunk_id, device_id) VALUES (?, ?)", chunkID, deviceID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.chargeReplica(chunkID, deviceID, 1)
+	}
+	return nil
+}
+
+// removeChunkLocation forgets a replica and refunds it.
+func (s *Server) removeChunkLocation(chunkID, deviceID string) {
+	res, err := s.DB.Exec("DELETE FROM chunk_locations WHERE chunk_id = ? AND device_id = ?", chunkID, deviceID)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.chargeReplica(chunkID, deviceID, -1)
+	}
+}
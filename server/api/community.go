@@ -0,0 +1,197 @@
+package api
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"p2p-drive/shared"
+)
+
+// Community placement lets a user's personal files use other users' devices
+// whose owners opted in. Those chunks are encrypted with a per-user key held
+// by the server, so hosts only ever see ciphertext. The chunk ID is the hash
+// of the ciphertext, so storage, verification and challenges are unchanged.
+
+// communityEnabled reports whether a user places new files on community
+// devices.
+func (s *Server) communityEnabled(userID string) bool {
+	var on bool
+	s.DB.QueryRow("SELECT COALESCE(community, 0) FROM users WHERE id = ?", userID).Scan(&on)
+	return on
+}
+
+// userChunkKey returns a user's chunk encryption key, creating it on first
+// use.
+func (s *Server) userChunkKey(userID string) ([]byte, error) {
+	var keyHex string
+	s.DB.QueryRow("SELECT COALESCE(chunk_key, '') FROM users WHERE id = ?", userID).Scan(&keyHex)
+	if keyHex == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		// Concurrent uploads may race here; re-read whichever key won
+		s.DB.Exec("UPDATE users SET chunk_key = ? WHERE id = ? AND chunk_key IS NULL", hex.EncodeToString(key), userID)
+		s.DB.QueryRow("SELECT COALESCE(chunk_key, '') FROM users WHERE id = ?", userID).Scan(&keyHex)
+	}
+	key, err := hex.DecodeString(keyHex)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("invalid chunk key")
+	}
+	return key, nil
+}
+
+// encryptChunk seals a chunk with AES-256-GCM as nonce || ciphertext.
+func encryptChunk(key, plain []byte) ([]byte, error) {
+	gcm, err := chunkCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+// decryptChunk opens a chunk sealed by encryptChunk.
+func decryptChunk(key, sealed []byte) ([]byte, error) {
+	gcm, err := chunkCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("chunk too short")
+	}
+	nonce, ct := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ct, nil)
+}
+
+func chunkCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// communityDevices returns the devices an encrypted file's chunks may go on:
+// the owner's own and other users' community devices, online and active.
+func (s *Server) communityDevices(userID string) ([]shared.Device, error) {
+	return s.queryDevices(`WHERE (user_id = ? OR (COALESCE(community, 0) = 1 AND user_id IS NOT NULL))
+		AND online = 1 AND COALESCE(state, 'active') = 'active'`, userID)
+}
+
+// HandleCommunity reports (GET) or sets (POST {"enabled": bool}) whether the
+// caller's new personal files may be placed, encrypted, on community devices.
+// Files already stored keep their placement.
+func (s *Server) HandleCommunity(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	switch r.Method {
+	case http.MethodGet:
+		var hosts int
+		s.DB.QueryRow("SELECT COUNT(*) FROM devices WHERE COALESCE(community, 0) = 1 AND user_id IS NOT NULL AND user_id != ?", userID).Scan(&hosts)
+		json.NewEncoder(w).Encode(struct {
+			Enabled bool `json:"enabled"`
+			Hosts   int  `json:"community_devices"` // Other users' devices open to the community
+			Balance
+		}{s.communityEnabled(userID), hosts, s.balance(userID)})
+
+	case http.MethodPost:
+		var req struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Enabled {
+			// Create the key up front so the first upload doesn't fail on it
+			if _, err := s.userChunkKey(userID); err != nil {
+				http.Error(w, "Failed to create encryption key", http.StatusInternalServerError)
+				return
+			}
+		}
+		if _, err := s.DB.Exec("UPDATE users SET community = ? WHERE id = ?", req.Enabled, userID); err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Community placement changed", "user", userID, "enabled", req.Enabled)
+		w.Write([]byte(`{"status":"ok"}`))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// SetDeviceCommunity lets an owner open one of their agent devices to other
+// users' encrypted chunks ({"device_id", "enabled"}). Closing it moves the
+// chunks it holds for others elsewhere in the background.
+func (s *Server) SetDeviceCommunity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Header.Get("X-User-ID")
+
+	var req struct {
+		DeviceID string `json:"device_id"`
+		Enabled  bool   `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var dType string
+	if err := s.DB.QueryRow("SELECT COALESCE(type, 'agent') FROM devices WHERE id = ? AND user_id = ?", req.DeviceID, userID).Scan(&dType); err != nil {
+		http.Error(w, "Device not found or unauthorized", http.StatusNotFound)
+		return
+	}
+	if dType == "gdrive" {
+		http.Error(w, "Only agent devices can host community chunks", http.StatusBadRequest)
+		return
+	}
+	if _, err := s.DB.Exec("UPDATE devices SET community = ? WHERE id = ?", req.Enabled, req.DeviceID); err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	if !req.Enabled {
+		go s.evacuateForeignChunks(detachedContext(r.Context()), req.DeviceID, userID)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// evacuateForeignChunks moves other users' personal chunks off a device that
+// left the community.
+func (s *Server) evacuateForeignChunks(ctx context.Context, deviceID, ownerID string) {
+	rows, err := s.DB.Query(`
+		SELECT DISTINCT cl.chunk_id FROM chunk_locations cl
+		JOIN chunks c ON c.id = cl.chunk_id
+		JOIN files f ON f.id = c.file_id
+		WHERE cl.device_id = ? AND f.user_id != ? AND COALESCE(f.team_id, '') = ''`, deviceID, ownerID)
+	if err != nil {
+		return
+	}
+	var chunkIDs []string
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		chunkIDs = append(chunkIDs, id)
+	}
+	rows.Close()
+
+	for _, chunkID := range chunkIDs {
+		if err := s.evacuateChunk(ctx, chunkID, deviceID); err != nil {
+			slog.WarnContext(ctx, "Community: chunk left on device", "chunk", chunkID, "device", deviceID, "err", err)
+		}
+	}
+}
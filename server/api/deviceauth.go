@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"p2p-drive/shared"
+)
+
+// Request headers set by DeviceAuth once a signature checks out.
+const (
+	headerDeviceOwner = "X-Device-Owner" // Owning user, "" while unclaimed
+)
+
+// deviceClockSkew is how far a request timestamp may drift from ours.
+const deviceClockSkew = 5 * time.Minute
+
+// maxDeviceBody bounds the signed body read into memory. Relay messages
+// carry one chunk, inventories 32 bytes per chunk held.
+const maxDeviceBody = 64 << 20
+
+// DeviceAuth verifies the request signature against the device's registered
+// public key and records the device and its owner in the request headers.
+// Unclaimed devices are pending: they may only reach handlers wrapped with
+// DeviceAuthPending.
+func (s *Server) DeviceAuth(next http.HandlerFunc) http.HandlerFunc {
+	return s.deviceAuth(next, false)
+}
+
+// DeviceAuthPending is DeviceAuth for endpoints unclaimed devices may use.
+func (s *Server) DeviceAuthPending(next http.HandlerFunc) http.HandlerFunc {
+	return s.deviceAuth(next, true)
+}
+
+func (s *Server) deviceAuth(next http.HandlerFunc, allowPending bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(headerDeviceOwner)
+
+		deviceID := r.Header.Get(shared.HeaderDeviceID)
+		if err := s.verifyDeviceSignature(r, deviceID); err != nil {
+			r.Header.Del(shared.HeaderDeviceID)
+			http.Error(w, "Unauthorized device: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var ownerID string
+		var suspended bool
+		s.DB.QueryRow(`SELECT COALESCE(d.user_id, ''), COALESCE(u.suspended, 0) FROM devices d
+			LEFT JOIN users u ON u.id = d.user_id WHERE d.id = ?`, deviceID).Scan(&ownerID, &suspended)
+		if ownerID == "" && !allowPending {
+			http.Error(w, "Device pending: claim it from the dashboard first", http.StatusForbidden)
+			return
+		}
+		if suspended {
+			http.Error(w, "Account suspended", http.StatusForbidden)
+			return
+		}
+
+		r.Header.Set(headerDeviceOwner, ownerID)
+		next(w, r)
+	}
+}
+
+// verifyDeviceSignature checks the signature over the request and its body,
+// then burns the nonce. The body is read and put back for the handler.
+func (s *Server) verifyDeviceSignature(r *http.Request, deviceID string) error {
+	tsStr := r.Header.Get(shared.HeaderDeviceTimestamp)
+	nonce := r.Header.Get(shared.HeaderDeviceNonce)
+	sigStr := r.Header.Get(shared.HeaderDeviceSignature)
+	if deviceID == "" || tsStr == "" || nonce == "" || sigStr == "" {
+		return fmt.Errorf("missing signature")
+	}
+	if len(nonce) > 64 {
+		return fmt.Errorf("bad nonce")
+	}
+
+	ts, err := strconv.ParseInt(tsStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad timestamp")
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > deviceClockSkew || skew < -deviceClockSkew {
+		return fmt.Errorf("timestamp out of range")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(sigStr)
+	if err != nil {
+		return fmt.Errorf("bad signature encoding")
+	}
+
+	var pubPEM string
+	if err := s.DB.QueryRow("SELECT public_key FROM devices WHERE id = ?", deviceID).Scan(&pubPEM); err != nil {
+		return fmt.Errorf("unknown device")
+	}
+	pub, err := parseDevicePublicKey(pubPEM)
+	if err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxDeviceBody+1))
+	r.Body.Close()
+	if err != nil {
+		return fmt.Errorf("unreadable body")
+	}
+	if len(body) > maxDeviceBody {
+		return fmt.Errorf("body too large")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	digest := sha256.Sum256(shared.DeviceSigningString(deviceID, r.Method, r.URL.RequestURI(), tsStr, nonce, body))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	// Only a valid signature burns a nonce, so nobody can spend a device's
+	// nonces for it. Nonces outlive the timestamp window, after which the
+	// request is rejected anyway.
+	expires := time.Unix(ts, 0).Add(deviceClockSkew).Format(time.RFC3339)
+	res, err := s.DB.Exec("INSERT OR IGNORE INTO device_nonces (device_id, nonce, expires_at) VALUES (?, ?, ?)", deviceID, nonce, expires)
+	if err != nil {
+		return fmt.Errorf("nonce check failed")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("replayed request")
+	}
+	return nil
+}
+
+// StartNoncePruner periodically forgets nonces whose requests would now fail
+// the timestamp check.
+func (s *Server) StartNoncePruner(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			if _, err := s.DB.Exec("DELETE FROM device_nonces WHERE expires_at < ?", time.Now().Format(time.RFC3339)); err != nil {
+				slog.Error("Pruning device nonces failed", "err", err)
+			}
+		}
+	}()
+}
+
+// parseDevicePublicKey reads the PEM key an agent registered with.
+func parseDevicePublicKey(pubPEM string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pubPEM))
+	if block == nil {
+		return nil, fmt.Errorf("invalid device key")
+	}
+	if pub, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return pub, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid device key")
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("device key is not RSA")
+	}
+	return pub, nil
+}
+
+// sameOwner reports whether a device belongs to the given user.
+func (s *Server) sameOwner(deviceID, ownerID string) bool {
+	var exists int
+	s.DB.QueryRow("SELECT 1 FROM devices WHERE id = ? AND user_id = ?", deviceID, ownerID).Scan(&exists)
+	return ownerID != "" && exists == 1
+}
@@ -2,8 +2,10 @@ package api
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"p2p-drive/shared"
+	"strings"
 	"time"
 )
 
@@ -26,8 +28,8 @@ func (s *Server) ClaimDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify Token & Device
-	res, err := s.DB.Exec("UPDATE devices SET user_id = ? WHERE id = ? AND claim_token = ?",
+	// Verify Token & Device. A claimed device keeps its owner.
+	res, err := s.DB.Exec("UPDATE devices SET user_id = ? WHERE id = ? AND claim_token = ? AND user_id IS NULL",
 		userID, req.DeviceID, req.ClaimToken)
 
 	if err != nil {
@@ -37,6 +39,12 @@ func (s *Server) ClaimDevice(w http.ResponseWriter, r *http.Request) {
 
 	rows, _ := res.RowsAffected()
 	if rows == 0 {
+		var owned int
+		s.DB.QueryRow("SELECT 1 FROM devices WHERE id = ? AND user_id IS NOT NULL", req.DeviceID).Scan(&owned)
+		if owned == 1 {
+			http.Error(w, "Device already claimed", http.StatusConflict)
+			return
+		}
 		http.Error(w, "Invalid Device ID or Claim Token", http.StatusForbidden)
 		return
 	}
@@ -44,24 +52,159 @@ func (s *Server) ClaimDevice(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// SetDeviceCapRequest
+type SetDeviceCapRequest struct {
+	DeviceID string `json:"device_id"`
+	CapBytes int64  `json:"cap_bytes"` // 0 removes the cap
+}
+
+// SetDeviceCap limits how many bytes GenDrive may store on one of the user's
+// devices. Agents learn the cap from their next heartbeat.
+func (s *Server) SetDeviceCap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Header.Get("X-User-ID")
+
+	var req SetDeviceCapRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.CapBytes < 0 {
+		http.Error(w, "cap_bytes must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	res, err := s.DB.Exec("UPDATE devices SET storage_cap = ? WHERE id = ? AND user_id = ?", req.CapBytes, req.DeviceID, userID)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		http.Error(w, "Device not found or unauthorized", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 func (s *Server) GetMyDevices(w http.ResponseWriter, r *http.Request) {
 	userID := r.Header.Get("X-User-ID")
-	rows, err := s.DB.Query("SELECT id, name, last_seen, online, ip FROM devices WHERE user_id = ?", userID)
+	devices, err := s.queryDevices("WHERE user_id = ?", userID)
 	if err != nil {
 		http.Error(w, "DB Error", http.StatusInternalServerError)
 		return
 	}
+	json.NewEncoder(w).Encode(devices)
+}
+
+// SetDeviceLabelsRequest
+type SetDeviceLabelsRequest struct {
+	DeviceID string   `json:"device_id"`
+	Zone     string   `json:"zone"`
+	Class    string   `json:"class"`
+	Tags     []string `json:"tags"`
+}
+
+// SetDeviceLabels records the failure domain labels placement policies use.
+func (s *Server) SetDeviceLabels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Header.Get("X-User-ID")
+
+	var req SetDeviceLabelsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var tags []string
+	for _, t := range req.Tags {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		if strings.Contains(t, ",") {
+			http.Error(w, "Tags may not contain commas", http.StatusBadRequest)
+			return
+		}
+		tags = append(tags, t)
+	}
+
+	res, err := s.DB.Exec("UPDATE devices SET zone = ?, class = ?, tags = ? WHERE id = ? AND user_id = ?",
+		strings.TrimSpace(req.Zone), strings.TrimSpace(req.Class), strings.Join(tags, ","), req.DeviceID, userID)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	if rows, _ := res.RowsAffected(); rows == 0 {
+		http.Error(w, "Device not found or unauthorized", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// deviceColumns is the column list read by queryDevices.
+const deviceColumns = `id, COALESCE(name, ''), COALESCE(last_seen, ''), COALESCE(online, 0), COALESCE(ip, ''),
+	COALESCE(type, 'agent'), COALESCE(zone, ''), COALESCE(class, ''), COALESCE(tags, ''),
+	COALESCE(total_bytes, 0), COALESCE(free_bytes, 0), COALESCE(used_bytes, 0), COALESCE(storage_cap, 0),
+	COALESCE(challenges_passed, 0), COALESCE(challenges_failed, 0),
+	COALESCE(state, 'active'), COALESCE(drain_total, 0), COALESCE(team_id, ''), COALESCE(user_id, ''),
+	COALESCE(community, 0), COALESCE(ack_latency_ms, 0),
+	COALESCE(retrievals_ok, 0), COALESCE(retrievals_failed, 0), COALESCE(telemetry, ''),
+	(SELECT COUNT(*) FROM chunk_locations cl WHERE cl.device_id = devices.id)`
+
+// queryDevices loads full device rows matching a WHERE clause.
+func (s *Server) queryDevices(where string, args ...interface{}) ([]shared.Device, error) {
+	rows, err := s.DB.Query("SELECT "+deviceColumns+" FROM devices "+where, args...)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	var devices []shared.Device
 	for rows.Next() {
 		var d shared.Device
-		var lastSeenStr string
-		rows.Scan(&d.ID, &d.Name, &lastSeenStr, &d.Online, &d.IP)
+		var lastSeenStr, tags, telemetry string
+		if err := rows.Scan(&d.ID, &d.Name, &lastSeenStr, &d.Online, &d.IP,
+			&d.Type, &d.Zone, &d.Class, &tags,
+			&d.TotalBytes, &d.FreeBytes, &d.UsedBytes, &d.StorageCap,
+			&d.ChallengesPassed, &d.ChallengesFailed,
+			&d.State, &d.DrainTotal, &d.TeamID, &d.Owner,
+			&d.Community, &d.AckLatencyMs,
+			&d.RetrievalsOK, &d.RetrievalsFailed, &telemetry, &d.ChunkCount); err != nil {
+			continue
+		}
 		d.LastSeen, _ = time.Parse(time.RFC3339, lastSeenStr)
+		if tags != "" {
+			d.Tags = strings.Split(tags, ",")
+		}
+		d.Reliability = reliabilityScore(d.ChallengesPassed, d.ChallengesFailed)
+		if telemetry != "" {
+			var t shared.DeviceTelemetry
+			if json.Unmarshal([]byte(telemetry), &t) == nil {
+				d.Telemetry = &t
+			}
+		}
 		devices = append(devices, d)
 	}
-	json.NewEncoder(w).Encode(devices)
+	rows.Close()
+
+	ids := make([]string, len(devices))
+	for i, d := range devices {
+		ids[i] = d.ID
+	}
+	uptime := s.recentUptime(ids)
+	for i := range devices {
+		d := &devices[i]
+		if u := uptime[d.ID]; u != nil {
+			d.Availability, d.ObservedSeconds, d.Flaps = u.Availability, u.ObservedSeconds, u.Flaps
+		}
+		d.Reputation = reputationScore(*d)
+	}
+	return devices, nil
 }
 
 func (s *Server) DeleteDevice(w http.ResponseWriter, r *http.Request) {
@@ -81,9 +224,39 @@ func (s *Server) DeleteDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Refuse while the device holds the only copy of anything
+	var sole int
+	s.DB.QueryRow(`
+		SELECT COUNT(*) FROM chunk_locations cl
+		WHERE cl.device_id = ? AND NOT EXISTS (
+			SELECT 1 FROM chunk_locations o WHERE o.chunk_id = cl.chunk_id AND o.device_id != cl.device_id)`, deviceID).Scan(&sole)
+	if sole > 0 {
+		http.Error(w, fmt.Sprintf("Device holds the only copy of %d chunk(s). Drain it before deleting.", sole), http.StatusConflict)
+		return
+	}
+
+	// Chunks with copies elsewhere lose a replica; let repair restore it
+	var lost []string
+	rows, err := s.DB.Query("SELECT chunk_id FROM chunk_locations WHERE device_id = ?", deviceID)
+	if err == nil {
+		for rows.Next() {
+			var id string
+			rows.Scan(&id)
+			lost = append(lost, id)
+		}
+		rows.Close()
+	}
+
 	// Clean up related data
-	s.DB.Exec("DELETE FROM chunk_locations WHERE device_id = ?", deviceID)
-	
+	for _, chunkID := range lost {
+		s.removeChunkLocation(chunkID, deviceID)
+	}
+	s.DB.Exec("DELETE FROM inventory_diffs WHERE device_id = ?", deviceID)
+	s.DB.Exec("DELETE FROM device_sessions WHERE device_id = ?", deviceID)
+	for _, chunkID := range lost {
+		s.QueueRepair(repairRequest{ChunkID: chunkID, LostFrom: deviceID})
+	}
+
 	// Delete device
 	_, err = s.DB.Exec("DELETE FROM devices WHERE id = ?", deviceID)
 	if err != nil {
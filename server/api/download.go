@@ -1,18 +1,33 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"p2p-drive/shared"
 	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 func (s *Server) GetFiles(w http.ResponseWriter, r *http.Request) {
 	userID := r.Header.Get("X-User-ID")
-	rows, err := s.DB.Query("SELECT id, path, size, updated_at FROM files WHERE user_id = ? ORDER BY updated_at DESC", userID)
+
+	// ?team_id= lists a team's shared folder instead of personal files
+	if teamID := r.URL.Query().Get("team_id"); teamID != "" {
+		if s.teamRole(teamID, userID) == "" {
+			http.Error(w, "Team not found", http.StatusNotFound)
+			return
+		}
+		s.listTeamFiles(w, teamID)
+		return
+	}
+
+	rows, err := s.DB.Query("SELECT id, path, size, updated_at FROM files WHERE user_id = ? AND COALESCE(team_id, '') = '' ORDER BY updated_at DESC", userID)
 	if err != nil {
 		http.Error(w, "DB Error", http.StatusInternalServerError)
 		return
@@ -33,19 +48,42 @@ func (s *Server) GetFiles(w http.ResponseWriter, r *http.Request) {
 func (s *Server) DownloadFile(w http.ResponseWriter, r *http.Request) {
 	fileID := r.URL.Query().Get("id")
 	userID := r.Header.Get("X-User-ID")
+	ctx, span := startSpan(r.Context(), "DownloadFile", attribute.String("user", userID), attribute.String("file", fileID))
+	defer span.End()
 
-	// Verify ownership & Get Metadata
-	var path string
-	var size int64
-	err := s.DB.QueryRow("SELECT path, size FROM files WHERE id = ? AND user_id = ?", fileID, userID).Scan(&path, &size)
+	// Verify access & Get Metadata
+	path, size, _, err := s.fileAccess(fileID, userID)
 	if err != nil {
+		span.SetStatus(codes.Error, "file not found")
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
+	s.streamFile(ctx, w, fileID, path, size)
+}
+
+// streamFile writes a file to the response, fetching its chunks in order
+// from whichever holders are online. Callers check access first.
+func (s *Server) streamFile(ctx context.Context, w http.ResponseWriter, fileID, path string, size int64) {
+	start, ok := time.Now(), false
+	defer func() { observeTransfer(downloadDuration, start, ok) }()
+
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", path))
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", size))
 
+	// Encrypted files are decrypted with their owner's key on the way out
+	var key []byte
+	var encrypted bool
+	var ownerID string
+	s.DB.QueryRow("SELECT COALESCE(encrypted, 0), COALESCE(user_id, '') FROM files WHERE id = ?", fileID).Scan(&encrypted, &ownerID)
+	if encrypted {
+		var err error
+		if key, err = s.userChunkKey(ownerID); err != nil {
+			http.Error(w, "Encryption key unavailable", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Get Chunks
 	rows, err := s.DB.Query("SELECT id, sequence, size FROM chunks WHERE file_id = ? ORDER BY sequence ASC", fileID)
 	if err != nil {
@@ -86,56 +124,44 @@ func (s *Server) DownloadFile(w http.ResponseWriter, r *http.Request) {
 		success := false
 
 		for _, deviceID := range devices {
-            // Get Device Type (Optimization: fetch type in previous query or query here)
-            // Let's query type here for safety or refactor previous query. 
-            // Previous query just returned 'id'. Let's refactor previous query.
-            var dType string
-            s.DB.QueryRow("SELECT type FROM devices WHERE id = ?", deviceID).Scan(&dType)
-
-            if dType == "gdrive" {
-                data, err := s.GDrive.DownloadChunk(userID, chunkID)
-                if err == nil {
-                    chunkData = data
-                    success = true
-                    break
-                } else {
-                    fmt.Printf("GDrive Download Failed for chunk %s: %v\n", chunkID, err)
-                }
-            } else {
-                // Request Chunk
-                reqMsg := shared.RelayMessage{
-                    Type:    shared.RelayTypeRetrieve,
-                    Payload: []byte(chunkID),
-                }
-                reqBytes, _ := json.Marshal(reqMsg)
-                
-                // Try to inject (skip if buffer full)
-                if !s.injectRelayMessage(deviceID, "inbox", reqBytes) {
-                    continue
-                }
-
-                // Wait for Data
-                data, err := s.waitForRelayData("server", "chunk-"+chunkID, 15*time.Second)
-                if err == nil {
-                    chunkData = data
-                    success = true
-                    break
-                }
-            }
+			// fetchChunk verifies against chunks.hash and queues repair on mismatch
+			data, err := s.fetchChunk(ctx, deviceID, chunkID)
+			if err == nil {
+				chunkData = data
+				success = true
+				break
+			}
+			slog.WarnContext(ctx, "Chunk retrieval failed", "chunk", chunkID, "device", deviceID, "err", err)
 		}
 
 		if !success {
-            fmt.Printf("Failed to retrieve chunk %d (%s) from any peer\n", seq, chunkID)
+			slog.ErrorContext(ctx, "Chunk unavailable from any peer", "file", fileID, "seq", seq, "chunk", chunkID)
 			http.Error(w, fmt.Sprintf("Failed to retrieve chunk %d from any peer", seq), http.StatusGatewayTimeout)
 			return
 		}
+		if key != nil {
+			plain, err := decryptChunk(key, chunkData)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to decrypt chunk", "file", fileID, "seq", seq, "chunk", chunkID, "err", err)
+				return
+			}
+			chunkData = plain
+		}
 
-		w.Write(chunkData)
+		n, _ := w.Write(chunkData)
+		downloadBytes.Add(float64(n))
 	}
+	ok = rows.Err() == nil
 }
 
 // Helper to wait for data on internal relay channel
-func (s *Server) waitForRelayData(to, session string, timeout time.Duration) ([]byte, error) {
+func (s *Server) waitForRelayData(ctx context.Context, to, session string, timeout time.Duration) (data []byte, err error) {
+	_, span := startSpan(ctx, "waitForRelayData", attribute.String("session", session))
+	defer func() {
+		span.SetAttributes(attribute.Int("bytes", len(data)))
+		endSpan(span, err)
+	}()
+
 	key := to + "-" + session
 
 	// Ensure channel exists
@@ -158,6 +184,7 @@ func (s *Server) waitForRelayData(to, session string, timeout time.Duration) ([]
 	case data := <-ch:
 		return data, nil
 	case <-time.After(timeout):
+		relayTimeouts.WithLabelValues("wait").Inc()
 		return nil, fmt.Errorf("timeout")
 	}
 }
@@ -172,16 +199,62 @@ func (s *Server) DeleteFile(w http.ResponseWriter, r *http.Request) {
 	userID := r.Header.Get("X-User-ID")
 
 	// 1. Verify Ownership & Get Info
-	var path string
-	err := s.DB.QueryRow("SELECT path FROM files WHERE id = ? AND user_id = ?", fileID, userID).Scan(&path)
-	if err != nil {
+	_, _, canWrite, err := s.fileAccess(fileID, userID)
+	if err != nil || !canWrite {
 		http.Error(w, "File not found or unauthorized", http.StatusNotFound)
 		return
 	}
 
+	if err := s.deleteFile(r.Context(), userID, fileID); err != nil {
+		http.Error(w, "DB Error during delete", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{"status":"deleted"}`))
+}
+
+// DeleteAllFiles deletes every personal file the user owns. Team files
+// belong to the team and are left alone.
+func (s *Server) DeleteAllFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Header.Get("X-User-ID")
+
+	rows, err := s.DB.Query("SELECT id FROM files WHERE user_id = ? AND COALESCE(team_id, '') = ''", userID)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	var fileIDs []string
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		fileIDs = append(fileIDs, id)
+	}
+	rows.Close()
+
+	deleted := 0
+	for _, fileID := range fileIDs {
+		if err := s.deleteFile(r.Context(), userID, fileID); err != nil {
+			slog.ErrorContext(r.Context(), "Failed to delete file", "file", fileID, "err", err)
+			continue
+		}
+		deleted++
+	}
+	w.Write([]byte(fmt.Sprintf(`{"status":"deleted","files":%d}`, deleted)))
+}
+
+// deleteFile removes a file's metadata and tells its devices to drop the
+// chunks. Offline agents catch up through the deleted_files log.
+func (s *Server) deleteFile(ctx context.Context, userID, fileID string) error {
 	// 2. Identify Chunks and Locations to notify Agents
 	// We want to tell agents to delete these chunks.
+	// Team files can sit on other members' devices; each owner gets a record.
 	var chunkIDs []string
+	owners := map[string]bool{userID: true}
 	rows, err := s.DB.Query(`
 		SELECT cl.device_id, c.id 
 		FROM chunks c 
@@ -193,27 +266,28 @@ func (s *Server) DeleteFile(w http.ResponseWriter, r *http.Request) {
 		for rows.Next() {
 			var deviceID, chunkID string
 			if err := rows.Scan(&deviceID, &chunkID); err == nil {
-                // Check if GDrive (could query DB or check ID prefix, ID prefix is faster/cheaper if consistent)
-                // We set ID as "GDrive-"+UserID in gdrive.go
-                // Let's rely on DB type check for correctness or just try/catch?
-                // DB Type check is cleaner.
-                var dType string
-                s.DB.QueryRow("SELECT type FROM devices WHERE id = ?", deviceID).Scan(&dType)
-
-                if dType == "gdrive" {
-                    // Delete from GDrive
-                    // We need the folderID? GDriveManager handles lookup.
-                    // We need userID for the client.
-                    s.GDrive.DeleteChunk(userID, chunkID)
-                } else {
-				    // Send Delete Command (Async/Best Effort) to Agent
-				    msg := shared.RelayMessage{
-					    Type:    shared.RelayTypeDelete,
-					    Payload: []byte(chunkID),
-				    }
-				    bytes, _ := json.Marshal(msg)
-				    s.injectRelayMessage(deviceID, "inbox", bytes)
-                }
+				// DB Type check is cleaner than relying on the "GDrive-" ID prefix
+				var dType, deviceOwner string
+				s.DB.QueryRow("SELECT type, COALESCE(user_id, '') FROM devices WHERE id = ?", deviceID).Scan(&dType, &deviceOwner)
+				if deviceOwner != "" {
+					owners[deviceOwner] = true
+				}
+
+				if dType == "gdrive" {
+					// Delete from GDrive
+					// GDriveManager handles the folder lookup; it needs the device owner's client.
+					s.GDrive.DeleteChunk(deviceOwner, chunkID)
+				} else {
+					// Send Delete Command (Async/Best Effort) to Agent
+					msg := shared.RelayMessage{
+						Type:      shared.RelayTypeDelete,
+						Payload:   []byte(chunkID),
+						RequestID: shared.RequestID(ctx),
+						Trace:     shared.InjectTrace(ctx),
+					}
+					bytes, _ := json.Marshal(msg)
+					s.injectRelayMessage(ctx, deviceID, "inbox", bytes)
+				}
 			}
 		}
 	}
@@ -232,26 +306,53 @@ func (s *Server) DeleteFile(w http.ResponseWriter, r *http.Request) {
 
 	// 2.2 Record in deleted_files table
 	chunkJSON, _ := json.Marshal(chunkIDs)
-	s.DB.Exec("INSERT INTO deleted_files (id, file_id, chunk_ids, deleted_at) VALUES (?, ?, ?, ?)",
-		uuid.New().String(), fileID, string(chunkJSON), time.Now().Format(time.RFC3339))
-
+	for owner := range owners {
+		s.DB.Exec("INSERT INTO deleted_files (id, user_id, file_id, chunk_ids, deleted_at) VALUES (?, ?, ?, ?, ?)",
+			uuid.New().String(), owner, fileID, string(chunkJSON), time.Now().Format(time.RFC3339))
+	}
 
 	// 3. Clean Database (Cascade should handle chunks/locations if set up,
 	// but manual cleanup is safer if schema is unsure)
-	// Assuming foreign keys or manual cleanup. Let's do manual for safety.
+
+	// Refund the file's account before its rows go
+	var ownerID, teamID, path string
+	var size, physical int64
+	s.DB.QueryRow("SELECT COALESCE(user_id, ''), COALESCE(team_id, ''), COALESCE(size, 0), path FROM files WHERE id = ?", fileID).
+		Scan(&ownerID, &teamID, &size, &path)
+	s.DB.QueryRow(`SELECT COALESCE(SUM(c.size), 0) FROM chunk_locations cl
+		JOIN chunks c ON c.id = cl.chunk_id WHERE c.file_id = ?`, fileID).Scan(&physical)
+	kind, accountID := usageAccount(ownerID, teamID)
+	s.addUsage(kind, accountID, -1, -size, -physical)
+	// Team files were never charged to the ledger
+	if teamID == "" {
+		if hosts, err := s.DB.Query(`SELECT COALESCE(d.user_id, ''), COALESCE(SUM(c.size), 0) FROM chunk_locations cl
+			JOIN chunks c ON c.id = cl.chunk_id
+			JOIN devices d ON d.id = cl.device_id
+			WHERE c.file_id = ? GROUP BY d.user_id`, fileID); err == nil {
+			refunds := make(map[string]int64)
+			for hosts.Next() {
+				var hostID string
+				var bytes int64
+				hosts.Scan(&hostID, &bytes)
+				refunds[hostID] = bytes
+			}
+			hosts.Close()
+			for hostID, bytes := range refunds {
+				s.addLedger(hostID, ownerID, -bytes)
+			}
+		}
+	}
 
 	// Delete Locations (via chunk subquery)
 	s.DB.Exec("DELETE FROM chunk_locations WHERE chunk_id IN (SELECT id FROM chunks WHERE file_id = ?)", fileID)
+	s.DB.Exec("DELETE FROM chunk_challenges WHERE chunk_id IN (SELECT id FROM chunks WHERE file_id = ?)", fileID)
 	// Delete Chunks
 	s.DB.Exec("DELETE FROM chunks WHERE file_id = ?", fileID)
+	s.DB.Exec("DELETE FROM share_links WHERE file_id = ?", fileID)
 	// Delete File
-	_, err = s.DB.Exec("DELETE FROM files WHERE id = ?", fileID)
-
-	if err != nil {
-		http.Error(w, "DB Error during delete", http.StatusInternalServerError)
-		return
+	if _, err = s.DB.Exec("DELETE FROM files WHERE id = ?", fileID); err != nil {
+		return err
 	}
-
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status":"deleted"}`))
+	s.Events.Publish(Event{Type: EventFileDeleted, UserID: ownerID, TeamID: teamID, Data: FileEvent{FileID: fileID, Path: path, Size: size}})
+	return nil
 }
@@ -0,0 +1,226 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"p2p-drive/shared"
+)
+
+// Device states. Draining devices receive no new chunks and are emptied by
+// the drain worker; once drained they hold nothing and can be deleted.
+const (
+	DeviceStateActive   = "active"
+	DeviceStateDraining = "draining"
+	DeviceStateDrained  = "drained"
+)
+
+// DrainDeviceRequest
+type DrainDeviceRequest struct {
+	DeviceID string `json:"device_id"`
+	Cancel   bool   `json:"cancel"` // Return the device to service
+}
+
+// DrainDevice starts (or cancels) migrating every chunk off a device.
+func (s *Server) DrainDevice(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Header.Get("X-User-ID")
+
+	var req DrainDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var exists int
+	s.DB.QueryRow("SELECT 1 FROM devices WHERE id = ? AND user_id = ?", req.DeviceID, userID).Scan(&exists)
+	if exists == 0 {
+		http.Error(w, "Device not found or unauthorized", http.StatusNotFound)
+		return
+	}
+
+	if req.Cancel {
+		s.DB.Exec("UPDATE devices SET state = ?, drain_total = 0 WHERE id = ?", DeviceStateActive, req.DeviceID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var total int
+	s.DB.QueryRow("SELECT COUNT(*) FROM chunk_locations WHERE device_id = ?", req.DeviceID).Scan(&total)
+	s.DB.Exec("UPDATE devices SET state = ?, drain_total = ? WHERE id = ?", DeviceStateDraining, total, req.DeviceID)
+	slog.InfoContext(r.Context(), "Draining device", "device", req.DeviceID, "chunks", total)
+
+	go s.drainDevice(detachedContext(r.Context()), req.DeviceID)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte(fmt.Sprintf(`{"status":"draining","chunks":%d}`, total)))
+}
+
+// StartDrainWorker resumes any drains left unfinished, e.g. by a restart or
+// by the device being offline with no other copy available.
+func (s *Server) StartDrainWorker(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			rows, err := s.DB.Query("SELECT id FROM devices WHERE state = ?", DeviceStateDraining)
+			if err != nil {
+				continue
+			}
+			var ids []string
+			for rows.Next() {
+				var id string
+				rows.Scan(&id)
+				ids = append(ids, id)
+			}
+			rows.Close()
+			for _, id := range ids {
+				s.drainDevice(backgroundContext(), id)
+			}
+		}
+	}()
+}
+
+// drainDevice moves every chunk off a draining device. Chunks that already
+// meet their placement policy elsewhere are simply released.
+func (s *Server) drainDevice(ctx context.Context, deviceID string) {
+	s.drainMu.Lock()
+	if s.draining[deviceID] {
+		s.drainMu.Unlock()
+		return
+	}
+	s.draining[deviceID] = true
+	s.drainMu.Unlock()
+	defer func() {
+		s.drainMu.Lock()
+		delete(s.draining, deviceID)
+		s.drainMu.Unlock()
+	}()
+
+	var state string
+	s.DB.QueryRow("SELECT COALESCE(state, '') FROM devices WHERE id = ?", deviceID).Scan(&state)
+	if state != DeviceStateDraining {
+		return
+	}
+
+	rows, err := s.DB.Query("SELECT chunk_id FROM chunk_locations WHERE device_id = ?", deviceID)
+	if err != nil {
+		return
+	}
+	var chunkIDs []string
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		chunkIDs = append(chunkIDs, id)
+	}
+	rows.Close()
+
+	failed := 0
+	for _, chunkID := range chunkIDs {
+		// Stop if the owner cancelled the drain meanwhile
+		s.DB.QueryRow("SELECT COALESCE(state, '') FROM devices WHERE id = ?", deviceID).Scan(&state)
+		if state != DeviceStateDraining {
+			return
+		}
+		if err := s.evacuateChunk(ctx, chunkID, deviceID); err != nil {
+			slog.WarnContext(ctx, "Drain: chunk not moved", "device", deviceID, "chunk", chunkID, "err", err)
+			failed++
+		}
+	}
+
+	if failed == 0 {
+		s.DB.Exec("UPDATE devices SET state = ? WHERE id = ? AND state = ?", DeviceStateDrained, deviceID, DeviceStateDraining)
+		slog.InfoContext(ctx, "Device drained", "device", deviceID)
+	} else {
+		slog.WarnContext(ctx, "Drain incomplete, will retry", "device", deviceID, "chunks_left", failed)
+	}
+}
+
+// evacuateChunk makes sure a chunk still meets its placement policy without
+// the given device, then releases the device's copy. If it can't, the copy
+// stays and an error is returned.
+func (s *Server) evacuateChunk(ctx context.Context, chunkID, deviceID string) error {
+	var remaining []shared.Device
+	var source *shared.Device
+	for _, d := range s.chunkHolders(chunkID) {
+		if d.ID == deviceID {
+			dev := d
+			source = &dev
+			continue
+		}
+		remaining = append(remaining, d)
+	}
+
+	file, err := s.chunkOwner(chunkID)
+	if err != nil {
+		// Unreferenced chunk: nothing depends on it
+		s.releaseChunk(ctx, chunkID, deviceID)
+		return nil
+	}
+	policy := s.policyForFile(file.UserID, file.Path)
+
+	if !policy.Satisfied(remaining) {
+		devices, err := s.placementDevices(file)
+		if err != nil {
+			return err
+		}
+
+		// Read from the draining device first, other replicas otherwise
+		var data []byte
+		sources := remaining
+		if source != nil {
+			sources = append([]shared.Device{*source}, remaining...)
+		}
+		for _, d := range sources {
+			if !d.Online {
+				continue
+			}
+			if data, err = s.fetchChunk(ctx, d.ID, chunkID); err == nil {
+				break
+			}
+		}
+		if data == nil {
+			return fmt.Errorf("no reachable copy")
+		}
+
+		held := make(map[string]bool)
+		for _, d := range remaining {
+			held[d.ID] = true
+		}
+		for _, d := range rankByCapacity(devices, int64(len(data)), nil) {
+			if policy.Satisfied(remaining) {
+				break
+			}
+			if held[d.ID] || d.ID == deviceID || !policy.Allows(remaining, d) ||
+				!s.mayPlace(file.UserID, file.TeamID, d, int64(len(data))) {
+				continue
+			}
+			if err := s.storeChunk(ctx, d, chunkID, data); err != nil {
+				continue
+			}
+			remaining = append(remaining, d)
+		}
+
+		// Keep the copy until the others meet the policy on their own, so
+		// redundancy never drops; the caller retries later
+		if !policy.Satisfied(remaining) {
+			return fmt.Errorf("placement policy unsatisfied without this copy (%d replicas)", len(remaining))
+		}
+	}
+
+	s.releaseChunk(ctx, chunkID, deviceID)
+	return nil
+}
+
+// releaseChunk forgets a device's copy of a chunk and asks it to delete it.
+func (s *Server) releaseChunk(ctx context.Context, chunkID, deviceID string) {
+	var dType, ownerID string
+	s.DB.QueryRow("SELECT COALESCE(type, 'agent'), COALESCE(user_id, '') FROM devices WHERE id = ?", deviceID).Scan(&dType, &ownerID)
+	s.removeChunkLocation(chunkID, deviceID)
+	s.discardChunk(ctx, deviceID, dType, ownerID, chunkID)
+}
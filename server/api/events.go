@@ -0,0 +1,106 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published on the server's event bus.
+const (
+	EventDeviceOnline      = "device.online"
+	EventDeviceOffline     = "device.offline"
+	EventUploadProgress    = "upload.progress"
+	EventFileCreated       = "file.created"
+	EventFileDeleted       = "file.deleted"
+	EventRebalanceProgress = "rebalance.progress"
+	EventRepairProgress    = "repair.progress"
+	EventQuotaWarning      = "quota.warning"
+)
+
+// Event is something that happened which other subsystems may react to.
+type Event struct {
+	Type     string      `json:"type"`
+	UserID   string      `json:"user_id,omitempty"` // User the event concerns, e.g. the device owner
+	TeamID   string      `json:"team_id,omitempty"` // Team whose members also see it, for team files
+	DeviceID string      `json:"device_id,omitempty"`
+	Time     time.Time   `json:"time"`
+	Data     interface{} `json:"data,omitempty"`
+}
+
+// FileEvent is the data of file.created and file.deleted.
+type FileEvent struct {
+	FileID string `json:"file_id"`
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+}
+
+// UploadProgress is published as each chunk of an upload is placed.
+type UploadProgress struct {
+	FileID     string `json:"file_id"`
+	Path       string `json:"path"`
+	Chunk      int    `json:"chunk"`  // Chunks placed so far
+	Chunks     int    `json:"chunks"` // Expected from the upload's size
+	Bytes      int64  `json:"bytes"`
+	TotalBytes int64  `json:"total_bytes"`
+	Replicas   int    `json:"replicas"` // Copies of the latest chunk
+}
+
+// EventBus fans events out to in-process subscribers. Publishing never
+// blocks: a subscriber whose buffer is full misses the event, so the bus is
+// for notifications only; nothing that must happen may depend on it.
+type EventBus struct {
+	mu   sync.RWMutex
+	next int
+	subs map[int]subscription
+}
+
+type subscription struct {
+	ch    chan Event
+	match func(Event) bool // nil = every event
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[int]subscription)}
+}
+
+// Subscribe returns a channel receiving the events published from now on
+// that match (all of them if match is nil), and a function that ends the
+// subscription and closes the channel. Filtering at the bus keeps other
+// events out of the subscriber's buffer; match runs on the publisher's
+// goroutine and must be cheap.
+func (b *EventBus) Subscribe(buffer int, match func(Event) bool) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	id := b.next
+	b.next++
+	b.subs[id] = subscription{ch: ch, match: match}
+	b.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			delete(b.subs, id)
+			b.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Publish delivers an event to all subscribers.
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, sub := range b.subs {
+		if sub.match != nil && !sub.match(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+		}
+	}
+}
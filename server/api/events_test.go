@@ -0,0 +1,137 @@
+package api
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// drain returns the events buffered on a channel without blocking.
+func drain(ch <-chan Event) []Event {
+	var events []Event
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return events
+			}
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventBusFiltering(t *testing.T) {
+	published := []Event{
+		{Type: EventDeviceOnline, UserID: "alice", DeviceID: "d1"},
+		{Type: EventFileCreated, UserID: "bob", TeamID: "team1"},
+		{Type: EventDeviceOffline, UserID: "bob", DeviceID: "d2"},
+		{Type: EventQuotaWarning, UserID: "alice"},
+	}
+	tests := []struct {
+		name  string
+		match func(Event) bool
+		want  []string // Types received, in order
+	}{
+		{"everything", nil, []string{EventDeviceOnline, EventFileCreated, EventDeviceOffline, EventQuotaWarning}},
+		{"one user", func(e Event) bool { return e.UserID == "alice" }, []string{EventDeviceOnline, EventQuotaWarning}},
+		{"a user or their team", func(e Event) bool { return e.UserID == "alice" || e.TeamID == "team1" },
+			[]string{EventDeviceOnline, EventFileCreated, EventQuotaWarning}},
+		{"nothing", func(Event) bool { return false }, nil},
+	}
+
+	bus := NewEventBus()
+	subs := make([]<-chan Event, len(tests))
+	for i, tt := range tests {
+		ch, cancel := bus.Subscribe(len(published), tt.match)
+		defer cancel()
+		subs[i] = ch
+	}
+	for _, e := range published {
+		bus.Publish(e)
+	}
+
+	for i, tt := range tests {
+		got := drain(subs[i])
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: received %d events, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for j, e := range got {
+			if e.Type != tt.want[j] {
+				t.Errorf("%s: event %d is %s, want %s", tt.name, j, e.Type, tt.want[j])
+			}
+			if e.Time.IsZero() {
+				t.Errorf("%s: event %d has no time", tt.name, j)
+			}
+		}
+	}
+}
+
+func TestEventBusDelivery(t *testing.T) {
+	tests := []struct {
+		name    string
+		buffer  int
+		publish int
+		cancel  bool // Cancel before publishing
+		want    int
+	}{
+		{"within the buffer", 4, 3, false, 3},
+		{"full buffer drops the rest", 2, 5, false, 2},
+		{"cancelled subscription", 4, 3, true, 0},
+	}
+	for _, tt := range tests {
+		bus := NewEventBus()
+		ch, cancel := bus.Subscribe(tt.buffer, nil)
+		if tt.cancel {
+			cancel()
+		}
+
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < tt.publish; i++ {
+				bus.Publish(Event{Type: EventFileCreated})
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: Publish blocked", tt.name)
+		}
+
+		if got := len(drain(ch)); got != tt.want {
+			t.Errorf("%s: received %d events, want %d", tt.name, got, tt.want)
+		}
+		cancel() // Repeats the earlier cancel in one case, which must be safe
+		if _, open := <-ch; open {
+			t.Errorf("%s: channel still open after cancel", tt.name)
+		}
+	}
+}
+
+func TestEventBusConcurrentCancel(t *testing.T) {
+	bus := NewEventBus()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		ch, cancel := bus.Subscribe(1, nil)
+		go func() {
+			defer wg.Done()
+			for range ch {
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				bus.Publish(Event{Type: EventFileCreated})
+			}
+			cancel()
+		}()
+	}
+	wg.Wait()
+	if n := len(bus.subs); n != 0 {
+		t.Errorf("%d subscriptions left after cancelling all", n)
+	}
+}
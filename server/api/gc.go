@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"p2p-drive/shared"
+)
+
+// Inventory discrepancy kinds recorded in inventory_diffs.
+const (
+	diffOrphan  = "orphan"  // On the device, referenced by nothing
+	diffMissing = "missing" // Recorded for the device, not on it
+)
+
+// ReceiveInventory reconciles an agent's chunk inventory with
+// chunk_locations.
+//
+// Chunks the device holds that belong to one of its owner's files but were
+// never recorded (a lost ACK) are adopted. Anything else the
+// device holds is an orphan; orphans still unreferenced after the grace
+// period are returned for deletion. Chunks recorded for the device but
+// absent from two consecutive inventories are dropped and queued for repair;
+// a single miss may just be an upload racing the inventory.
+func (s *Server) ReceiveInventory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var inv shared.ChunkInventory
+	if err := json.NewDecoder(r.Body).Decode(&inv); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	inv.DeviceID = r.Header.Get(shared.HeaderDeviceID)
+	held, err := inv.ChunkIDs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ownerID string
+	if err := s.DB.QueryRow("SELECT COALESCE(user_id, '') FROM devices WHERE id = ?", inv.DeviceID).Scan(&ownerID); err != nil {
+		http.Error(w, "Unknown device", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now()
+	holds := make(map[string]bool, len(held))
+	for _, id := range held {
+		holds[id] = true
+	}
+
+	// 1. What the server thinks the device holds
+	recorded := make(map[string]bool)
+	rows, err := s.DB.Query("SELECT chunk_id FROM chunk_locations WHERE device_id = ?", inv.DeviceID)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		recorded[id] = true
+	}
+	rows.Close()
+
+	// 2. Discrepancies carried over from earlier inventories
+	previous := make(map[string]string)
+	firstSeen := make(map[string]time.Time)
+	rows, err = s.DB.Query("SELECT chunk_id, kind, first_seen FROM inventory_diffs WHERE device_id = ?", inv.DeviceID)
+	if err == nil {
+		for rows.Next() {
+			var id, kind string
+			var seen time.Time
+			rows.Scan(&id, &kind, &seen)
+			previous[id] = kind
+			firstSeen[id] = seen
+		}
+		rows.Close()
+	}
+
+	current := make(map[string]string)
+	var deletions []string
+	adopted, repaired := 0, 0
+
+	// 3. Held but not recorded
+	for _, chunkID := range held {
+		if recorded[chunkID] {
+			continue
+		}
+		var ref int
+		s.DB.QueryRow(`
+			SELECT 1 FROM chunks c JOIN files f ON f.id = c.file_id
+			WHERE c.id = ? AND (f.user_id = ? OR f.team_id = (SELECT team_id FROM devices WHERE id = ?)) LIMIT 1`,
+			chunkID, ownerID, inv.DeviceID).Scan(&ref)
+		if ref == 1 && ownerID != "" {
+			s.addChunkLocation(chunkID, inv.DeviceID)
+			adopted++
+			continue
+		}
+		if previous[chunkID] == diffOrphan && now.Sub(firstSeen[chunkID]) >= s.OrphanGrace {
+			deletions = append(deletions, chunkID)
+			continue
+		}
+		current[chunkID] = diffOrphan
+	}
+
+	// 4. Recorded but not held
+	for chunkID := range recorded {
+		if holds[chunkID] {
+			continue
+		}
+		if previous[chunkID] == diffMissing {
+			s.dropReplica(chunkID, inv.DeviceID)
+			repaired++
+			continue
+		}
+		current[chunkID] = diffMissing
+	}
+
+	// 5. Persist the open discrepancies, keeping their original first_seen
+	s.DB.Exec("DELETE FROM inventory_diffs WHERE device_id = ?", inv.DeviceID)
+	for chunkID, kind := range current {
+		seen := now
+		if previous[chunkID] == kind {
+			seen = firstSeen[chunkID]
+		}
+		s.DB.Exec("INSERT INTO inventory_diffs (device_id, chunk_id, kind, first_seen) VALUES (?, ?, ?, ?)",
+			inv.DeviceID, chunkID, kind, seen)
+	}
+
+	if adopted+repaired+len(deletions) > 0 || len(current) > 0 {
+		slog.InfoContext(r.Context(), "Inventory reconciled", "device", inv.DeviceID, "held", len(held), "adopted", adopted,
+			"orphans_pending", countKind(current, diffOrphan), "deleted", len(deletions), "missing", repaired)
+	}
+
+	json.NewEncoder(w).Encode(shared.InventoryResponse{Delete: deletions})
+}
+
+func countKind(diffs map[string]string, kind string) int {
+	n := 0
+	for _, k := range diffs {
+		if k == kind {
+			n++
+		}
+	}
+	return n
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"time"
@@ -31,10 +31,10 @@ func NewGDriveManager(db *sql.DB) *GDriveManager {
 	if err == nil {
 		config, err = google.ConfigFromJSON(b, drive.DriveFileScope)
 		if err != nil {
-			log.Printf("GDrive: Failed to parse credentials.json: %v", err)
+			slog.Error("GDrive: Failed to parse credentials.json", "err", err)
 		}
 	} else {
-		log.Println("GDrive: No credentials.json found. GDrive integration disabled.")
+		slog.Info("GDrive: No credentials.json found. GDrive integration disabled.")
 	}
 
 	return &GDriveManager{DB: db, Config: config}
@@ -115,6 +115,7 @@ func (m *GDriveManager) HandleCallback(w http.ResponseWriter, r *http.Request) {
         if err == nil {
             m.getOrCreateFolder(srv, "GenDrive Data")
         }
+        m.UpdateQuota(userID)
     }()
 
 	http.Redirect(w, r, "/#devices", http.StatusTemporaryRedirect)
@@ -132,7 +133,7 @@ func (m *GDriveManager) saveToken(userID string, t *oauth2.Token) {
 		expiry=excluded.expiry`,
 		userID, t.AccessToken, t.RefreshToken, t.TokenType, t.Expiry)
 	if err != nil {
-		log.Printf("Failed to save gdrive token: %v", err)
+		slog.Error("Failed to save gdrive token", "user", userID, "err", err)
 	}
 }
 
@@ -222,6 +223,46 @@ func (m *GDriveManager) DownloadChunk(userID, chunkID string) ([]byte, error) {
     return io.ReadAll(resp.Body)
 }
 
+// UpdateQuota records the Drive quota on the user's virtual device so
+// placement can weight it like any other device.
+func (m *GDriveManager) UpdateQuota(userID string) {
+	if m.Config == nil {
+		return
+	}
+	deviceID := "GDrive-" + userID
+	var exists int
+	m.DB.QueryRow("SELECT 1 FROM devices WHERE id = ?", deviceID).Scan(&exists)
+	if exists == 0 {
+		return
+	}
+
+	client, err := m.getClient(userID)
+	if err != nil {
+		return
+	}
+	srv, err := drive.NewService(context.Background(), option.WithHTTPClient(client))
+	if err != nil {
+		return
+	}
+	about, err := srv.About.Get().Fields("storageQuota").Do()
+	if err != nil {
+		slog.Warn("GDrive: quota lookup failed", "user", userID, "err", err)
+		return
+	}
+
+	// Unlimited accounts have no Limit; leave capacity unknown
+	var total, free int64
+	if about.StorageQuota.Limit > 0 {
+		total = about.StorageQuota.Limit
+		free = about.StorageQuota.Limit - about.StorageQuota.Usage
+	}
+	var used int64
+	m.DB.QueryRow(`SELECT COALESCE(SUM(c.size), 0) FROM chunk_locations cl
+		JOIN chunks c ON c.id = cl.chunk_id WHERE cl.device_id = ?`, deviceID).Scan(&used)
+
+	m.DB.Exec("UPDATE devices SET total_bytes = ?, free_bytes = ?, used_bytes = ? WHERE id = ?", total, free, used, deviceID)
+}
+
 // Helpers
 
 func (m *GDriveManager) DeleteChunk(userID, chunkID string) error {
@@ -1,10 +1,14 @@
 package api
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/json"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"p2p-drive/shared"
@@ -15,34 +19,118 @@ import (
 type Server struct {
 	DB     *sql.DB
     GDrive *GDriveManager
+
+	repairs chan repairRequest
+
+	drainMu  sync.Mutex
+	draining map[string]bool // Devices with a drain pass in progress
+
+	// How long an unreferenced chunk may sit on a device before the
+	// inventory reconciler deletes it
+	OrphanGrace time.Duration
+
+	Rebalance   RebalanceLimits
+	rebalanceMu sync.Mutex
+	rebalancing map[string]bool // Users with a rebalance in progress
+
+	// Per-user quota for users without their own (0 = unlimited)
+	DefaultQuota Quota
+
+	// Bytes a user may place on others' devices per byte of capacity they
+	// contribute (0 = unlimited)
+	FairShareRatio float64
+
+	// Target share of time devices should be online, reported per device
+	AvailabilitySLO float64
+
+	// Devices observed long enough and scoring below this reputation don't
+	// count as replicas; their chunks are re-replicated (0 = off)
+	MinReputation float64
+
+	uptimeMu    sync.Mutex
+	uptimeCache map[string]cachedUptime // Recent 30-day summaries, by device
+
+	Liveness LivenessConfig
+	Events   *EventBus
 }
 
 func NewServer(db *sql.DB, gdrive *GDriveManager) *Server {
-	return &Server{DB: db, GDrive: gdrive}
+	return &Server{
+		DB:       db,
+		GDrive:   gdrive,
+		repairs:  make(chan repairRequest, 1024),
+		draining: make(map[string]bool),
+
+		OrphanGrace: 24 * time.Hour,
+		Rebalance:   RebalanceLimits{Concurrency: 3},
+		rebalancing: make(map[string]bool),
+
+		FairShareRatio: 1,
+
+		uptimeCache: make(map[string]cachedUptime),
+
+		Liveness: LivenessConfig{Interval: 10 * time.Second, OfflineAfter: 30 * time.Second, RepairAfter: 30 * time.Minute},
+		Events:   NewEventBus(),
+	}
 }
 
 func (s *Server) RegisterDevice(w http.ResponseWriter, r *http.Request) {
+	// Kept for the signature check when the device already exists
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	var req shared.RegisterRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := json.Unmarshal(body, &req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	deviceID := req.DeviceID
 	if deviceID == "" {
-		deviceID = uuid.New().String()
+		deviceID = newDeviceID()
+	}
+
+	// The key is what agents sign requests with
+	if _, err := parseDevicePublicKey(req.PublicKey); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// Check if exists
 	// Check if exists
 	var exists int
-	s.DB.QueryRow("SELECT 1 FROM devices WHERE id = ?", deviceID).Scan(&exists)
+	var currentKey string
+	s.DB.QueryRow("SELECT 1, public_key FROM devices WHERE id = ?", deviceID).Scan(&exists, &currentKey)
+	if exists == 1 && currentKey != req.PublicKey {
+		// Otherwise anyone knowing a device ID could take it over
+		http.Error(w, "Device ID already registered with a different key", http.StatusForbidden)
+		return
+	}
+	if exists == 0 && strings.Contains(deviceID, "-") {
+		// Relay sessions end in the device ID; see shared.ServerSession
+		http.Error(w, "Device ID must not contain '-'", http.StatusBadRequest)
+		return
+	}
 	if exists == 1 {
+		// Re-registering sets a new claim token, so only the device itself
+		// may do it: a signed request, as DeviceAuth checks
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if r.Header.Get(shared.HeaderDeviceID) != deviceID {
+			http.Error(w, "Unauthorized device: re-registering needs a signed request", http.StatusUnauthorized)
+			return
+		}
+		if err := s.verifyDeviceSignature(r, deviceID); err != nil {
+			http.Error(w, "Unauthorized device: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+
 		// Already registered, just update details
+		s.markOnline(deviceID)
 		_, err := s.DB.Exec("UPDATE devices SET public_key=?, name=?, last_seen=?, online=?, ip=?, claim_token=? WHERE id=?",
 			req.PublicKey, req.Name, time.Now().Format(time.RFC3339), true, r.RemoteAddr, req.ClaimToken, deviceID)
 		if err != nil {
-			log.Printf("Error updating device: %v", err)
+			slog.ErrorContext(r.Context(), "Error updating device", "device", deviceID, "err", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
@@ -50,7 +138,7 @@ func (s *Server) RegisterDevice(w http.ResponseWriter, r *http.Request) {
 		_, err := s.DB.Exec("INSERT INTO devices (id, public_key, name, last_seen, online, ip, claim_token) VALUES (?, ?, ?, ?, ?, ?, ?)",
 			deviceID, req.PublicKey, req.Name, time.Now().Format(time.RFC3339), true, r.RemoteAddr, req.ClaimToken)
 		if err != nil {
-			log.Printf("Error registering device: %v", err)
+			slog.ErrorContext(r.Context(), "Error registering device", "device", deviceID, "err", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
@@ -67,16 +155,27 @@ func (s *Server) RegisterDevice(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// newDeviceID returns a random device ID without dashes.
+func newDeviceID() string {
+	return strings.ReplaceAll(uuid.New().String(), "-", "")
+}
+
 func (s *Server) Heartbeat(w http.ResponseWriter, r *http.Request) {
 	var req shared.HeartbeatRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	res, err := s.DB.Exec("UPDATE devices SET last_seen = ?, online = ? WHERE id = ?", time.Now().Format(time.RFC3339), true, req.DeviceID)
+	req.DeviceID = r.Header.Get(shared.HeaderDeviceID)
+
+	now := time.Now()
+	req.ReportedAt = now
+	telemetry, _ := json.Marshal(req.DeviceTelemetry)
+	s.markOnline(req.DeviceID)
+	res, err := s.DB.Exec("UPDATE devices SET last_seen = ?, online = ?, total_bytes = ?, free_bytes = ?, used_bytes = ?, telemetry = ? WHERE id = ?",
+		now.Format(time.RFC3339), true, req.TotalBytes, req.FreeBytes, req.UsedBytes, string(telemetry), req.DeviceID)
 	if err != nil {
-		log.Printf("Error updating heartbeat: %v", err)
+		slog.ErrorContext(r.Context(), "Error updating heartbeat", "device", req.DeviceID, "err", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
@@ -86,14 +185,18 @@ func (s *Server) Heartbeat(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Device not found", http.StatusNotFound)
 		return
 	}
+	s.recordSession(req.DeviceID, now)
 
-	w.WriteHeader(http.StatusOK)
+	var resp shared.HeartbeatResponse
+	s.DB.QueryRow("SELECT COALESCE(storage_cap, 0) FROM devices WHERE id = ?", req.DeviceID).Scan(&resp.StorageCap)
+	resp.Pending = r.Header.Get(headerDeviceOwner) == ""
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (s *Server) GetPeers(w http.ResponseWriter, r *http.Request) {
-	// Return list of online peers (excluding self if requester ID provided? For now simply all online)
-	// In a real app we'd filter by user, but this is single-user.
-	rows, err := s.DB.Query("SELECT id, public_key, name, last_seen, ip, online FROM devices WHERE online = 1")
+	// Return the online devices of the requesting device's owner
+	ownerID := r.Header.Get(headerDeviceOwner)
+	rows, err := s.DB.Query("SELECT id, public_key, name, last_seen, ip, online FROM devices WHERE online = 1 AND user_id = ?", ownerID)
 	if err != nil {
 		http.Error(w, "Database error", http.StatusInternalServerError)
 		return
@@ -112,7 +215,7 @@ func (s *Server) GetPeers(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Dynamic Online Check
-		if time.Since(d.LastSeen) > 30*time.Second {
+		if time.Since(d.LastSeen) > s.Liveness.OfflineAfter {
 			d.Online = false
 		}
 
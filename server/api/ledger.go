@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"p2p-drive/shared"
+)
+
+// Balance is a user's standing in the mesh: what their devices store for
+// others against what they store on others' devices.
+type Balance struct {
+	UserID      string  `json:"user_id"`
+	Email       string  `json:"email,omitempty"`
+	Hosted      int64   `json:"hosted_bytes"`      // Others' data on this user's devices
+	Placed      int64   `json:"placed_bytes"`      // This user's data on others' devices
+	Contributed int64   `json:"contributed_bytes"` // Capacity of devices open to others
+	Allowance   int64   `json:"allowance_bytes"`   // Placed may grow up to this (-1 = unlimited)
+	Ratio       float64 `json:"ratio"`             // Hosted / Placed (0 when nothing placed)
+}
+
+// LedgerEntry is the traffic between a user and one peer.
+type LedgerEntry struct {
+	UserID    string `json:"user_id"`
+	Email     string `json:"email"`
+	HostedFor int64  `json:"hosted_for"` // Bytes of the peer's data on our devices
+	StoredOn  int64  `json:"stored_on"`  // Bytes of our data on the peer's devices
+}
+
+// addLedger records bytes of owner's data stored on a device of host.
+func (s *Server) addLedger(hostID, ownerID string, bytes int64) {
+	if hostID == "" || ownerID == "" || hostID == ownerID || bytes == 0 {
+		return
+	}
+	_, err := s.DB.Exec(`INSERT INTO ledger (host_id, owner_id, bytes) VALUES (?, ?, ?)
+		ON CONFLICT(host_id, owner_id) DO UPDATE SET bytes = bytes + excluded.bytes`,
+		hostID, ownerID, bytes)
+	if err != nil {
+		slog.Error("Ledger update failed", "owner", ownerID, "host", hostID, "err", err)
+	}
+}
+
+// contributedBytes is the capacity a user offers others: the cap, or the
+// disk size, of each of their devices in the community. Team pools don't
+// count: they only hold the team's own files, which are outside the ledger.
+func (s *Server) contributedBytes(userID string) int64 {
+	devices, err := s.queryDevices("WHERE user_id = ? AND COALESCE(community, 0) = 1", userID)
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, d := range devices {
+		if d.StorageCap > 0 {
+			total += d.StorageCap
+		} else {
+			total += d.TotalBytes
+		}
+	}
+	return total
+}
+
+// balance computes a user's ledger totals and placement allowance.
+func (s *Server) balance(userID string) Balance {
+	b := Balance{UserID: userID}
+	s.DB.QueryRow("SELECT COALESCE(SUM(bytes), 0) FROM ledger WHERE host_id = ?", userID).Scan(&b.Hosted)
+	s.DB.QueryRow("SELECT COALESCE(SUM(bytes), 0) FROM ledger WHERE owner_id = ?", userID).Scan(&b.Placed)
+	b.Contributed = s.contributedBytes(userID)
+	b.Allowance = -1
+	if s.FairShareRatio > 0 {
+		b.Allowance = int64(float64(b.Contributed) * s.FairShareRatio)
+	}
+	if b.Placed > 0 {
+		b.Ratio = float64(b.Hosted) / float64(b.Placed)
+	}
+	return b
+}
+
+// mayPlace reports whether a chunk of need bytes from userID's file may go
+// on a device. Users may place data on others' devices only in proportion to
+// the capacity they contribute; team pools are shared by agreement and exempt.
+func (s *Server) mayPlace(userID, teamID string, d shared.Device, need int64) bool {
+	if teamID != "" || s.FairShareRatio <= 0 || d.Owner == "" || d.Owner == userID {
+		return true
+	}
+	b := s.balance(userID)
+	return b.Placed+need <= b.Allowance
+}
+
+// GetLedger reports the caller's balance and the traffic with each peer.
+func (s *Server) GetLedger(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	rows, err := s.DB.Query(`
+		SELECT CASE WHEN l.host_id = ? THEN l.owner_id ELSE l.host_id END, COALESCE(u.email, ''),
+			CASE WHEN l.host_id = ? THEN l.bytes ELSE 0 END,
+			CASE WHEN l.owner_id = ? THEN l.bytes ELSE 0 END
+		FROM ledger l
+		LEFT JOIN users u ON u.id = CASE WHEN l.host_id = ? THEN l.owner_id ELSE l.host_id END
+		WHERE (l.host_id = ? OR l.owner_id = ?) AND l.bytes != 0`, userID, userID, userID, userID, userID, userID)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	// Each peer can appear twice, once per direction
+	byPeer := make(map[string]*LedgerEntry)
+	peers := []*LedgerEntry{}
+	for rows.Next() {
+		var e LedgerEntry
+		if err := rows.Scan(&e.UserID, &e.Email, &e.HostedFor, &e.StoredOn); err != nil {
+			continue
+		}
+		if p, ok := byPeer[e.UserID]; ok {
+			p.HostedFor += e.HostedFor
+			p.StoredOn += e.StoredOn
+			continue
+		}
+		byPeer[e.UserID] = &e
+		peers = append(peers, &e)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Balance
+		Peers []*LedgerEntry `json:"peers"`
+	}{s.balance(userID), peers})
+}
+
+// AdminLedger lists every user's balance.
+func (s *Server) AdminLedger(w http.ResponseWriter, r *http.Request) {
+	rows, err := s.DB.Query("SELECT id, email FROM users ORDER BY email")
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	type user struct{ id, email string }
+	var users []user
+	for rows.Next() {
+		var u user
+		rows.Scan(&u.id, &u.email)
+		users = append(users, u)
+	}
+	rows.Close()
+
+	balances := []Balance{}
+	for _, u := range users {
+		b := s.balance(u.id)
+		b.Email = u.email
+		balances = append(balances, b)
+	}
+	json.NewEncoder(w).Encode(balances)
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"log/slog"
+	"time"
+)
+
+// LivenessConfig controls when devices are considered gone.
+type LivenessConfig struct {
+	Interval     time.Duration // How often the sweeper runs
+	OfflineAfter time.Duration // Heartbeat silence before a device is marked offline
+	RepairAfter  time.Duration // Offline time before its chunks are re-replicated (0 = never)
+}
+
+// StartLivenessSweeper periodically marks devices that stopped sending
+// heartbeats offline, and re-replicates the chunks of devices that stay
+// offline past RepairAfter.
+func (s *Server) StartLivenessSweeper() {
+	s.scheduleOfflineRepairs()
+	go func() {
+		ticker := time.NewTicker(s.Liveness.Interval)
+		for range ticker.C {
+			s.sweepLiveness()
+		}
+	}()
+}
+
+// sweepLiveness marks devices offline whose last heartbeat is older than
+// OfflineAfter, ends their sessions, schedules their repair and publishes
+// device.offline events. Repair is scheduled here rather than from the
+// event, since the bus may drop events. Drive devices have no heartbeat and
+// are left alone.
+func (s *Server) sweepLiveness() {
+	cutoff := time.Now().Add(-s.Liveness.OfflineAfter).Format(time.RFC3339)
+	rows, err := s.DB.Query(`
+		SELECT id, COALESCE(user_id, ''), COALESCE(last_seen, '') FROM devices
+		WHERE online = 1 AND COALESCE(type, 'agent') != 'gdrive' AND COALESCE(last_seen, '') < ?`, cutoff)
+	if err != nil {
+		slog.Error("Liveness sweep failed", "err", err)
+		return
+	}
+	type stale struct{ id, ownerID, lastSeen string }
+	var devices []stale
+	for rows.Next() {
+		var d stale
+		if err := rows.Scan(&d.id, &d.ownerID, &d.lastSeen); err == nil {
+			devices = append(devices, d)
+		}
+	}
+	rows.Close()
+
+	for _, d := range devices {
+		// A heartbeat may have arrived since the query
+		res, err := s.DB.Exec("UPDATE devices SET online = 0 WHERE id = ? AND online = 1 AND COALESCE(last_seen, '') = ?", d.id, d.lastSeen)
+		if err != nil {
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		s.DB.Exec("UPDATE device_sessions SET ended_at = last_seen WHERE device_id = ? AND ended_at IS NULL", d.id)
+		slog.Info("Device went offline", "device", d.id, "last_seen", d.lastSeen)
+		if s.Liveness.RepairAfter > 0 {
+			deviceID := d.id
+			time.AfterFunc(s.Liveness.RepairAfter, func() { s.repairOfflineDevice(deviceID) })
+		}
+		s.Events.Publish(Event{Type: EventDeviceOffline, UserID: d.ownerID, DeviceID: d.id})
+	}
+}
+
+// markOnline flips an offline device back online ahead of a heartbeat or
+// registration, publishing device.online.
+func (s *Server) markOnline(deviceID string) {
+	res, err := s.DB.Exec("UPDATE devices SET online = 1 WHERE id = ? AND COALESCE(online, 0) = 0", deviceID)
+	if err != nil {
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+	var ownerID string
+	s.DB.QueryRow("SELECT COALESCE(user_id, '') FROM devices WHERE id = ?", deviceID).Scan(&ownerID)
+	slog.Info("Device is back online", "device", deviceID)
+	s.Events.Publish(Event{Type: EventDeviceOnline, UserID: ownerID, DeviceID: deviceID})
+}
+
+// scheduleOfflineRepairs covers devices that were already offline when the
+// server started, so a restart doesn't forget them.
+func (s *Server) scheduleOfflineRepairs() {
+	if s.Liveness.RepairAfter <= 0 {
+		return
+	}
+	devices, err := s.queryDevices("WHERE COALESCE(online, 0) = 0 AND COALESCE(type, 'agent') != 'gdrive' AND user_id IS NOT NULL")
+	if err != nil {
+		return
+	}
+	for _, d := range devices {
+		if d.ChunkCount == 0 {
+			continue
+		}
+		deviceID := d.ID
+		wait := s.Liveness.RepairAfter - time.Since(d.LastSeen)
+		if wait < 0 {
+			wait = 0
+		}
+		time.AfterFunc(wait, func() { s.repairOfflineDevice(deviceID) })
+	}
+}
+
+// repairOfflineDevice queues repair for the chunks of a device that is still
+// offline. Holders offline past RepairAfter no longer count as replicas, so
+// repair copies the chunks elsewhere.
+func (s *Server) repairOfflineDevice(deviceID string) {
+	var online bool
+	if err := s.DB.QueryRow("SELECT COALESCE(online, 0) FROM devices WHERE id = ?", deviceID).Scan(&online); err != nil || online {
+		return
+	}
+	rows, err := s.DB.Query("SELECT chunk_id FROM chunk_locations WHERE device_id = ?", deviceID)
+	if err != nil {
+		return
+	}
+	var chunkIDs []string
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		chunkIDs = append(chunkIDs, id)
+	}
+	rows.Close()
+
+	queued := 0
+	for _, chunkID := range chunkIDs {
+		if s.needsRepair(chunkID) {
+			s.QueueRepair(repairRequest{ChunkID: chunkID, LostFrom: deviceID})
+			queued++
+		}
+	}
+	if queued > 0 {
+		slog.Warn("Device offline too long, re-replicating its chunks", "device", deviceID, "offline_for", s.Liveness.RepairAfter, "chunks", queued)
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"p2p-drive/shared"
+)
+
+// maxRequestIDLen bounds request IDs supplied by clients.
+const maxRequestIDLen = 64
+
+// RequestIDs gives every HTTP request an ID, taken from X-Request-ID when the
+// client sent a usable one, echoes it in the response and puts it in the
+// request context so log lines and relay messages carry it.
+func RequestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(shared.HeaderRequestID)
+		if !validRequestID(id) {
+			id = shared.NewRequestID()
+		}
+		w.Header().Set(shared.HeaderRequestID, id)
+		ctx := shared.WithRequestID(r.Context(), id)
+
+		start := time.Now()
+		next.ServeHTTP(w, r.WithContext(ctx))
+		slog.DebugContext(ctx, "HTTP request", "method", r.Method, "path", r.URL.Path, "duration", time.Since(start))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// backgroundContext starts a context with a fresh request ID for work that
+// isn't triggered by a request, such as a repair or a rebalance run.
+func backgroundContext() context.Context {
+	return shared.WithRequestID(context.Background(), shared.NewRequestID())
+}
+
+// detachedContext keeps a request's ID for background work that outlives the
+// request.
+func detachedContext(ctx context.Context) context.Context {
+	return shared.WithRequestID(context.Background(), shared.RequestID(ctx))
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"p2p-drive/shared"
+)
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"", false},
+		{"abc", true},
+		{"0f8e2c1d-4b7a-4c2e-9d3f-aa01bb02cc03", true},
+		{"Upload_42", true},
+		{strings.Repeat("a", maxRequestIDLen), true},
+		{strings.Repeat("a", maxRequestIDLen+1), false},
+		{"has space", false},
+		{"line\nbreak", false},
+		{"quote\"", false},
+		{"semi;colon", false},
+		{"dotted.id", false},
+		{"ünïcode", false},
+	}
+	for _, tt := range tests {
+		if got := validRequestID(tt.id); got != tt.want {
+			t.Errorf("validRequestID(%q) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		keep   bool // The client's ID is used
+	}{
+		{"no header", "", false},
+		{"usable header", "client-id-1", true},
+		{"unusable header", "bad id\r\nX-Injected: 1", false},
+	}
+	for _, tt := range tests {
+		var seen string
+		h := RequestIDs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = shared.RequestID(r.Context())
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.header != "" {
+			req.Header.Set(shared.HeaderRequestID, tt.header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		echoed := rec.Header().Get(shared.HeaderRequestID)
+		if seen == "" || echoed != seen {
+			t.Errorf("%s: handler saw %q, response echoed %q", tt.name, seen, echoed)
+		}
+		if got := seen == tt.header; got != tt.keep {
+			t.Errorf("%s: request ID %q, client sent %q", tt.name, seen, tt.header)
+		}
+		if !validRequestID(seen) {
+			t.Errorf("%s: generated ID %q is not itself valid", tt.name, seen)
+		}
+	}
+}
@@ -20,9 +20,23 @@ func (s *Server) CreateFileMetadata(w http.ResponseWriter, r *http.Request) {
 	if meta.ID == "" {
 		meta.ID = uuid.New().String()
 	}
+	ownerID := r.Header.Get(headerDeviceOwner)
 	meta.CreatedAt = time.Now()
 	meta.UpdatedAt = time.Now()
 
+	if err := s.reserveQuota(ownerID, "", meta.Size, 0); err != nil {
+		s.warnQuota(ownerID, "", true)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	committed := false
+	defer func() {
+		if !committed {
+			s.addUsage(usageUser, ownerID, -1, -meta.Size, 0)
+		}
+	}()
+
 	tx, err := s.DB.Begin()
 	if err != nil {
 		http.Error(w, "DB Error", http.StatusInternalServerError)
@@ -30,8 +44,8 @@ func (s *Server) CreateFileMetadata(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Insert File
-	_, err = tx.Exec("INSERT INTO files (id, path, size, hash, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
-		meta.ID, meta.Path, meta.Size, meta.Hash, meta.CreatedAt.Format(time.RFC3339), meta.UpdatedAt.Format(time.RFC3339))
+	_, err = tx.Exec("INSERT INTO files (id, user_id, path, size, hash, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		meta.ID, ownerID, meta.Path, meta.Size, meta.Hash, meta.CreatedAt.Format(time.RFC3339), meta.UpdatedAt.Format(time.RFC3339))
 	if err != nil {
 		tx.Rollback()
 		http.Error(w, "Failed to insert file", http.StatusInternalServerError)
@@ -56,15 +70,19 @@ func (s *Server) CreateFileMetadata(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Commit failed", http.StatusInternalServerError)
 		return
 	}
+	committed = true
+	s.Events.Publish(Event{Type: EventFileCreated, UserID: ownerID, Data: FileEvent{FileID: meta.ID, Path: meta.Path, Size: meta.Size}})
+	s.warnQuota(ownerID, "", false)
 
 	json.NewEncoder(w).Encode(meta)
 }
 
 func (s *Server) GetFileMetadata(w http.ResponseWriter, r *http.Request) {
+	ownerID := r.Header.Get(headerDeviceOwner)
 	fileID := r.URL.Query().Get("id")
 	if fileID == "" {
-		// List all files
-		rows, err := s.DB.Query("SELECT id, path, size, hash, created_at FROM files")
+		// List the owner's files
+		rows, err := s.DB.Query("SELECT id, path, size, hash, created_at FROM files WHERE user_id = ?", ownerID)
 		if err != nil {
 			http.Error(w, "DB Error", http.StatusInternalServerError)
 			return
@@ -87,7 +105,7 @@ func (s *Server) GetFileMetadata(w http.ResponseWriter, r *http.Request) {
 	// Get specific file with chunks
 	var f shared.FileMetadata
 	var createdStr, updatedStr string
-	err := s.DB.QueryRow("SELECT id, path, size, hash, created_at, updated_at FROM files WHERE id = ?", fileID).
+	err := s.DB.QueryRow("SELECT id, path, size, hash, created_at, updated_at FROM files WHERE id = ? AND user_id = ?", fileID, ownerID).
 		Scan(&f.ID, &f.Path, &f.Size, &f.Hash, &createdStr, &updatedStr)
 	if err != nil {
 		http.Error(w, "File not found", http.StatusNotFound)
@@ -129,19 +147,3 @@ func (s *Server) GetFileMetadata(w http.ResponseWriter, r *http.Request) {
 
 	json.NewEncoder(w).Encode(f)
 }
-
-func (s *Server) RegisterChunkLocation(w http.ResponseWriter, r *http.Request) {
-	var req shared.ChunkLocationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	// Upsert equivalent (IGNORE on conflict)
-	_, err := s.DB.Exec("INSERT OR IGNORE INTO chunk_locations (chunk_id, device_id) VALUES (?, ?)", req.ChunkID, req.DeviceID)
-	if err != nil {
-		http.Error(w, "DB Error", http.StatusInternalServerError)
-		return
-	}
-	w.WriteHeader(http.StatusOK)
-}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// transferBuckets span small files over a LAN up to large files relayed to
+// slow devices.
+var transferBuckets = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+var (
+	uploadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gendrive_upload_bytes_total",
+		Help: "File bytes stored through /api/upload.",
+	})
+	uploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gendrive_upload_duration_seconds",
+		Help:    "Time to receive and place an uploaded file, by result.",
+		Buckets: transferBuckets,
+	}, []string{"result"})
+	downloadBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gendrive_download_bytes_total",
+		Help: "File bytes streamed to clients.",
+	})
+	downloadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gendrive_download_duration_seconds",
+		Help:    "Time to stream a file to a client, by result.",
+		Buckets: transferBuckets,
+	}, []string{"result"})
+	relayTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gendrive_relay_timeouts_total",
+		Help: "Relay operations that timed out, by kind (send, recv, inject, wait).",
+	}, []string{"kind"})
+	chunkAckFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gendrive_chunk_ack_failures_total",
+		Help: "Chunk stores a device did not confirm, by reason (inbox_full, timeout, refused).",
+	}, []string{"reason"})
+	rebalanceMoves = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gendrive_rebalance_moves_total",
+		Help: "Chunk moves made by rebalancing, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gendrive_relay_channels",
+		Help: "Relay channels currently open.",
+	}, func() float64 {
+		relayLock.Lock()
+		defer relayLock.Unlock()
+		return float64(len(relayChannels))
+	})
+}
+
+// deviceCollector reports each claimed device's online state when scraped.
+// Devices are labelled by ID only; names are chosen by their owners.
+type deviceCollector struct {
+	s    *Server
+	desc *prometheus.Desc
+}
+
+func (c *deviceCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	rows, err := c.s.DB.Query("SELECT id, COALESCE(type, 'agent'), COALESCE(online, 0) FROM devices WHERE user_id IS NOT NULL")
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, dType string
+		var online float64
+		if err := rows.Scan(&id, &dType, &online); err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, online, id, dType)
+	}
+}
+
+// MetricsHandler registers the per-device collector and returns the handler
+// serving all metrics. Call it once.
+func (s *Server) MetricsHandler() http.Handler {
+	prometheus.MustRegister(&deviceCollector{
+		s: s,
+		desc: prometheus.NewDesc("gendrive_device_online",
+			"Whether a device is online (1) or offline (0).",
+			[]string{"device_id", "type"}, nil),
+	})
+	return promhttp.Handler()
+}
+
+// observeTransfer records a transfer's duration under the given result.
+func observeTransfer(h *prometheus.HistogramVec, start time.Time, ok bool) {
+	result := "ok"
+	if !ok {
+		result = "error"
+	}
+	h.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,314 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/uuid"
+	"golang.org/x/oauth2"
+)
+
+// OIDCConfig configures single sign-on against an OpenID Connect provider.
+// SSO is disabled while Issuer is empty.
+type OIDCConfig struct {
+	Issuer         string
+	ClientID       string
+	ClientSecret   string
+	RedirectURL    string   // e.g. https://drive.example.com/api/oidc/callback
+	AllowedDomains []string // Email domains allowed to log in (empty = any)
+	GroupsClaim    string   // Claim listing the user's groups, default "groups"
+	AllowedGroups  []string // Groups allowed to log in (empty = any)
+}
+
+// oidcLoginTTL is how long a user has to complete login at the provider.
+const oidcLoginTTL = 10 * time.Minute
+
+const oidcStateCookie = "oidc_state"
+
+// OIDCHandler runs the authorization code + PKCE flow and turns a verified
+// ID token into a regular session.
+type OIDCHandler struct {
+	Auth   *AuthHandler
+	Config OIDCConfig
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+	pending  map[string]oidcLogin // state -> login in progress
+}
+
+type oidcLogin struct {
+	Verifier string
+	Nonce    string
+	Expires  time.Time
+}
+
+func NewOIDCHandler(auth *AuthHandler, cfg OIDCConfig) *OIDCHandler {
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	return &OIDCHandler{Auth: auth, Config: cfg, pending: make(map[string]oidcLogin)}
+}
+
+func (o *OIDCHandler) Enabled() bool {
+	return o.Config.Issuer != ""
+}
+
+// setup discovers the provider on first use, so the server starts even
+// while the IdP is unreachable.
+func (o *OIDCHandler) setup(ctx context.Context) (*oidc.Provider, *oauth2.Config, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider == nil {
+		p, err := oidc.NewProvider(ctx, o.Config.Issuer)
+		if err != nil {
+			return nil, nil, err
+		}
+		o.provider = p
+	}
+	return o.provider, &oauth2.Config{
+		ClientID:     o.Config.ClientID,
+		ClientSecret: o.Config.ClientSecret,
+		RedirectURL:  o.Config.RedirectURL,
+		Endpoint:     o.provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+	}, nil
+}
+
+// HandleConfig tells the login page whether to offer SSO.
+func (o *OIDCHandler) HandleConfig(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]bool{"enabled": o.Enabled()})
+}
+
+// HandleLogin redirects the browser to the provider.
+func (o *OIDCHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if !o.Enabled() {
+		http.Error(w, "SSO is not configured", http.StatusNotFound)
+		return
+	}
+	_, conf, err := o.setup(r.Context())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "OIDC discovery failed", "err", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state := generateToken()
+	login := oidcLogin{
+		Verifier: oauth2.GenerateVerifier(),
+		Nonce:    generateToken(),
+		Expires:  time.Now().Add(oidcLoginTTL),
+	}
+
+	o.mu.Lock()
+	for s, l := range o.pending {
+		if time.Now().After(l.Expires) {
+			delete(o.pending, s)
+		}
+	}
+	o.pending[state] = login
+	o.mu.Unlock()
+
+	// Binds the callback to this browser
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc/",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   o.Auth.secure(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, conf.AuthCodeURL(state,
+		oauth2.S256ChallengeOption(login.Verifier),
+		oidc.Nonce(login.Nonce)), http.StatusFound)
+}
+
+// HandleCallback completes the flow: exchanges the code, verifies the ID
+// token and starts a session for the matching (or newly created) user.
+func (o *OIDCHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	if !o.Enabled() {
+		http.Error(w, "SSO is not configured", http.StatusNotFound)
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "Login failed: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	// 1. Match the state to a login we started in this browser
+	state := r.URL.Query().Get("state")
+	c, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" || c.Value != state {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	o.mu.Lock()
+	login, ok := o.pending[state]
+	delete(o.pending, state)
+	o.mu.Unlock()
+	if !ok || time.Now().After(login.Expires) {
+		http.Error(w, "Login expired, try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/oidc/", MaxAge: -1})
+
+	provider, conf, err := o.setup(r.Context())
+	if err != nil {
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	// 2. Exchange the code, proving we hold the PKCE verifier
+	token, err := conf.Exchange(r.Context(), r.URL.Query().Get("code"), oauth2.VerifierOption(login.Verifier))
+	if err != nil {
+		slog.WarnContext(r.Context(), "OIDC code exchange failed", "err", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	rawID, _ := token.Extra("id_token").(string)
+	if rawID == "" {
+		http.Error(w, "Provider returned no ID token", http.StatusUnauthorized)
+		return
+	}
+
+	// 3. Verify the ID token
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: o.Config.ClientID}).Verify(r.Context(), rawID)
+	if err != nil {
+		slog.WarnContext(r.Context(), "OIDC ID token rejected", "err", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	if idToken.Nonce != login.Nonce {
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	email, _ := claims["email"].(string)
+	verified, _ := claims["email_verified"].(bool)
+
+	// 4. Optional restrictions
+	if err := o.checkAllowed(email, verified, claims[o.Config.GroupsClaim]); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	// 5. Just-in-time user, then the same session as a password login
+	userID, err := o.resolveUser(idToken.Subject, email, verified)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "OIDC user lookup failed", "err", err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+	var suspended bool
+	db := o.Auth.DB
+	db.QueryRow("SELECT COALESCE(suspended, 0) FROM users WHERE id = ?", userID).Scan(&suspended)
+	if suspended {
+		http.Error(w, "Account suspended", http.StatusForbidden)
+		return
+	}
+
+	pending, err := o.Auth.startSession(w, r, userID)
+	if err != nil {
+		http.Error(w, "Failed to create session", http.StatusInternalServerError)
+		return
+	}
+	if pending {
+		http.Redirect(w, r, "/login.html?mfa=1", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/index.html", http.StatusFound)
+}
+
+func (o *OIDCHandler) checkAllowed(email string, verified bool, groupsClaim interface{}) error {
+	if len(o.Config.AllowedDomains) > 0 {
+		at := strings.LastIndex(email, "@")
+		if at < 0 || !verified || !containsFold(o.Config.AllowedDomains, email[at+1:]) {
+			return fmt.Errorf("Your email domain is not allowed")
+		}
+	}
+	if len(o.Config.AllowedGroups) > 0 {
+		var groups []string
+		switch g := groupsClaim.(type) {
+		case []interface{}:
+			for _, v := range g {
+				if s, ok := v.(string); ok {
+					groups = append(groups, s)
+				}
+			}
+		case string:
+			groups = []string{g}
+		}
+		allowed := false
+		for _, g := range groups {
+			if containsString(o.Config.AllowedGroups, g) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("You are not in an allowed group")
+		}
+	}
+	return nil
+}
+
+// resolveUser finds the user linked to this provider subject. Unknown
+// subjects are linked to the account with the same verified email, or get
+// a new account.
+func (o *OIDCHandler) resolveUser(subject, email string, verified bool) (string, error) {
+	db := o.Auth.DB
+	var id string
+	err := db.QueryRow("SELECT id FROM users WHERE oidc_issuer = ? AND oidc_subject = ?", o.Config.Issuer, subject).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+
+	if email != "" && verified {
+		if db.QueryRow("SELECT id FROM users WHERE email = ? AND COALESCE(oidc_subject, '') = ''", email).Scan(&id) == nil {
+			_, err := db.Exec("UPDATE users SET oidc_issuer = ?, oidc_subject = ? WHERE id = ?", o.Config.Issuer, subject, id)
+			return id, err
+		}
+	}
+
+	// users.email is unique and required; fall back to a per-subject address
+	if email == "" || !verified {
+		host := o.Config.Issuer
+		if u, err := url.Parse(o.Config.Issuer); err == nil && u.Host != "" {
+			host = u.Host
+		}
+		email = subject + "@" + host
+	}
+
+	id = uuid.New().String()
+	// No password: the account can only log in through SSO
+	_, err = db.Exec("INSERT INTO users (id, email, password, created_at, role, oidc_issuer, oidc_subject) SELECT ?, ?, '', ?, "+newUserRole+", ?, ?",
+		id, email, time.Now().Format(time.RFC3339), o.Config.Issuer, subject)
+	if err != nil {
+		return "", err
+	}
+	slog.Info("Created user for OIDC subject", "user", id, "subject", subject)
+	return id, nil
+}
+
+func containsFold(list []string, v string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
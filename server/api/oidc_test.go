@@ -0,0 +1,280 @@
+package api
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"p2p-drive/server/db"
+)
+
+// mockIdP is a minimal OpenID Connect provider: discovery, JWKS and a token
+// endpoint that checks the PKCE verifier of each code it issued.
+type mockIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string // S256 PKCE challenge sent to the authorization endpoint
+	claims    map[string]interface{}
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, codes: make(map[string]mockGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA", "alg": "RS256", "use": "sig", "kid": "test",
+				"n": b64(key.N.Bytes()),
+				"e": b64(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		grant, ok := idp.codes[r.FormValue("code")]
+		delete(idp.codes, r.FormValue("code"))
+		idp.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || b64(sum[:]) != grant.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "at",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idp.sign(t, grant.claims),
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// authorize stands in for the user logging in at the provider: it issues a
+// code bound to the challenge and returns it.
+func (idp *mockIdP) authorize(challenge string, claims map[string]interface{}) string {
+	code := generateToken()
+	idp.mu.Lock()
+	idp.codes[code] = mockGrant{challenge: challenge, claims: claims}
+	idp.mu.Unlock()
+	return code
+}
+
+func (idp *mockIdP) sign(t *testing.T, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestOIDCCallback(t *testing.T) {
+	tests := []struct {
+		name          string
+		groups        []string // AllowedGroups
+		domains       []string // AllowedDomains
+		claims        map[string]interface{}
+		wrongVerifier bool // The IdP saw a different PKCE challenge
+		wrongState    bool // The callback's state doesn't match the cookie
+		wrongNonce    bool
+		wantStatus    int
+		wantLocation  string
+	}{
+		{
+			name:         "new user",
+			claims:       map[string]interface{}{"email": "alice@example.com", "email_verified": true},
+			wantStatus:   http.StatusFound,
+			wantLocation: "/index.html",
+		},
+		{
+			name:         "allowed group",
+			groups:       []string{"drive-users"},
+			claims:       map[string]interface{}{"email": "bob@example.com", "email_verified": true, "groups": []string{"staff", "drive-users"}},
+			wantStatus:   http.StatusFound,
+			wantLocation: "/index.html",
+		},
+		{
+			name:         "single group as string",
+			groups:       []string{"drive-users"},
+			claims:       map[string]interface{}{"email": "carol@example.com", "email_verified": true, "groups": "drive-users"},
+			wantStatus:   http.StatusFound,
+			wantLocation: "/index.html",
+		},
+		{
+			name:       "group not allowed",
+			groups:     []string{"drive-users"},
+			claims:     map[string]interface{}{"email": "dave@example.com", "email_verified": true, "groups": []string{"staff"}},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "no groups claim",
+			groups:     []string{"drive-users"},
+			claims:     map[string]interface{}{"email": "erin@example.com", "email_verified": true},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:         "allowed domain",
+			domains:      []string{"Example.com"},
+			claims:       map[string]interface{}{"email": "frank@example.com", "email_verified": true},
+			wantStatus:   http.StatusFound,
+			wantLocation: "/index.html",
+		},
+		{
+			name:       "unverified email in allowed domain",
+			domains:    []string{"example.com"},
+			claims:     map[string]interface{}{"email": "grace@example.com", "email_verified": false},
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:          "PKCE verifier mismatch",
+			claims:        map[string]interface{}{"email": "heidi@example.com", "email_verified": true},
+			wrongVerifier: true,
+			wantStatus:    http.StatusUnauthorized,
+		},
+		{
+			name:       "state mismatch",
+			claims:     map[string]interface{}{"email": "ivan@example.com", "email_verified": true},
+			wrongState: true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "nonce mismatch",
+			claims:     map[string]interface{}{"email": "judy@example.com", "email_verified": true},
+			wrongNonce: true,
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	idp := newMockIdP(t)
+	database := db.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	defer database.Close()
+	auth := &AuthHandler{DB: database}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := NewOIDCHandler(auth, OIDCConfig{
+				Issuer:         idp.URL,
+				ClientID:       "gendrive",
+				RedirectURL:    "http://drive.test/api/oidc/callback",
+				AllowedDomains: tt.domains,
+				AllowedGroups:  tt.groups,
+			})
+
+			// Start the login and read what the browser would carry to the IdP
+			rec := httptest.NewRecorder()
+			o.HandleLogin(rec, httptest.NewRequest(http.MethodGet, "/api/oidc/login", nil))
+			if rec.Code != http.StatusFound {
+				t.Fatalf("login: status %d: %s", rec.Code, rec.Body)
+			}
+			loc, err := url.Parse(rec.Header().Get("Location"))
+			if err != nil || !strings.HasPrefix(loc.String(), idp.URL+"/authorize") {
+				t.Fatalf("login redirected to %q", rec.Header().Get("Location"))
+			}
+			q := loc.Query()
+			if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+				t.Fatalf("login did not send a PKCE challenge: %v", q)
+			}
+			var stateCookie *http.Cookie
+			for _, c := range rec.Result().Cookies() {
+				if c.Name == oidcStateCookie {
+					stateCookie = c
+				}
+			}
+			if stateCookie == nil || stateCookie.Value != q.Get("state") {
+				t.Fatalf("state cookie %v does not match state %q", stateCookie, q.Get("state"))
+			}
+
+			claims := map[string]interface{}{
+				"iss":   idp.URL,
+				"aud":   "gendrive",
+				"sub":   "sub-" + tt.name,
+				"iat":   time.Now().Unix(),
+				"exp":   time.Now().Add(time.Hour).Unix(),
+				"nonce": q.Get("nonce"),
+			}
+			if tt.wrongNonce {
+				claims["nonce"] = "replayed"
+			}
+			for k, v := range tt.claims {
+				claims[k] = v
+			}
+			challenge := q.Get("code_challenge")
+			if tt.wrongVerifier {
+				sum := sha256.Sum256([]byte("attacker's verifier"))
+				challenge = b64(sum[:])
+			}
+			code := idp.authorize(challenge, claims)
+
+			state := q.Get("state")
+			if tt.wrongState {
+				state = "forged"
+			}
+			req := httptest.NewRequest(http.MethodGet, "/api/oidc/callback?code="+url.QueryEscape(code)+"&state="+url.QueryEscape(state), nil)
+			req.AddCookie(stateCookie)
+			rec = httptest.NewRecorder()
+			o.HandleCallback(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("callback: status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantLocation == "" {
+				return
+			}
+			if got := rec.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("callback redirected to %q, want %q", got, tt.wantLocation)
+			}
+			var userID string
+			if err := database.QueryRow("SELECT id FROM users WHERE oidc_issuer = ? AND oidc_subject = ?", idp.URL, claims["sub"]).Scan(&userID); err != nil {
+				t.Fatalf("no user linked to the subject: %v", err)
+			}
+			var sessions int
+			database.QueryRow("SELECT COUNT(*) FROM sessions WHERE user_id = ?", userID).Scan(&sessions)
+			if sessions != 1 {
+				t.Errorf("user has %d sessions, want 1", sessions)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+
+	"p2p-drive/shared"
+)
+
+// availableBytes is how much more GenDrive may store on a device: the
+// smaller of its reported free space and the room left under its cap.
+// Returns -1 when the device hasn't reported capacity and has no cap.
+func availableBytes(d shared.Device) int64 {
+	avail := int64(-1)
+	if d.TotalBytes > 0 {
+		avail = d.FreeBytes
+	}
+	if d.StorageCap > 0 {
+		room := d.StorageCap - d.UsedBytes
+		if room < 0 {
+			room = 0
+		}
+		if avail < 0 || room < avail {
+			avail = room
+		}
+	}
+	return avail
+}
+
+// rankByCapacity orders devices for placing a chunk of size need. Devices are
+// drawn at random weighted by free capacity (minus bytes already assigned in
+// pending), so a 4TB server takes a proportionally larger share than a nearly
+// full Pi. Devices known not to have room are left out. Devices that haven't
+// reported capacity get the average weight of those that have. Each weight is
+// then scaled by the device's reputation, favouring dependable devices.
+func rankByCapacity(devices []shared.Device, need int64, pending map[string]int64) []shared.Device {
+	type weighted struct {
+		dev shared.Device
+		w   float64
+	}
+	var known, unknown []weighted
+	var sum float64
+	for _, d := range devices {
+		avail := availableBytes(d)
+		if avail < 0 {
+			unknown = append(unknown, weighted{dev: d})
+			continue
+		}
+		avail -= pending[d.ID]
+		if avail < need {
+			continue
+		}
+		known = append(known, weighted{dev: d, w: float64(avail)})
+		sum += float64(avail)
+	}
+
+	fallback := 1.0
+	if len(known) > 0 {
+		fallback = sum / float64(len(known))
+	}
+	for i := range unknown {
+		unknown[i].w = fallback
+	}
+	all := append(known, unknown...)
+	for i := range all {
+		if r := all[i].dev.Reputation; r > 0 {
+			all[i].w *= r
+		}
+	}
+
+	// Weighted shuffle (Efraimidis-Spirakis): sort by u^(1/w) descending,
+	// compared as ln(u)/w to keep precision with byte-sized weights
+	keys := make([]float64, len(all))
+	for i, c := range all {
+		keys[i] = math.Log(rand.Float64()) / c.w
+	}
+	idx := make([]int, len(all))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(a, b int) bool { return keys[idx[a]] > keys[idx[b]] })
+
+	ranked := make([]shared.Device, 0, len(all))
+	for _, i := range idx {
+		ranked = append(ranked, all[i].dev)
+	}
+	return ranked
+}
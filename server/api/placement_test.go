@@ -0,0 +1,114 @@
+package api
+
+import (
+	"math"
+	"sort"
+	"testing"
+
+	"p2p-drive/shared"
+)
+
+func TestAvailableBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		dev  shared.Device
+		want int64
+	}{
+		{"unknown", shared.Device{}, -1},
+		{"free space", shared.Device{TotalBytes: 100, FreeBytes: 40}, 40},
+		{"cap below free space", shared.Device{TotalBytes: 100, FreeBytes: 40, StorageCap: 30, UsedBytes: 10}, 20},
+		{"cap above free space", shared.Device{TotalBytes: 100, FreeBytes: 40, StorageCap: 90, UsedBytes: 10}, 40},
+		{"cap only", shared.Device{StorageCap: 50, UsedBytes: 20}, 30},
+		{"over cap", shared.Device{TotalBytes: 100, FreeBytes: 40, StorageCap: 10, UsedBytes: 20}, 0},
+	}
+	for _, tt := range tests {
+		if got := availableBytes(tt.dev); got != tt.want {
+			t.Errorf("%s: availableBytes = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRankByCapacityCandidates(t *testing.T) {
+	big := shared.Device{ID: "big", TotalBytes: 1000, FreeBytes: 800}
+	small := shared.Device{ID: "small", TotalBytes: 1000, FreeBytes: 50}
+	capped := shared.Device{ID: "capped", TotalBytes: 1000, FreeBytes: 800, StorageCap: 100, UsedBytes: 90}
+	unknown := shared.Device{ID: "unknown"}
+	all := []shared.Device{big, small, capped, unknown}
+
+	tests := []struct {
+		name    string
+		need    int64
+		pending map[string]int64
+		want    []string
+	}{
+		{"everything fits", 10, nil, []string{"big", "capped", "small", "unknown"}},
+		{"too big for the small and capped", 60, nil, []string{"big", "unknown"}},
+		{"pending bytes count against room", 10, map[string]int64{"small": 45, "big": 700}, []string{"big", "capped", "unknown"}},
+		{"pending fills a device", 10, map[string]int64{"big": 795}, []string{"capped", "small", "unknown"}},
+		{"unknown devices are always tried", 5000, nil, []string{"unknown"}},
+	}
+	for _, tt := range tests {
+		got := ids(rankByCapacity(all, tt.need, tt.pending))
+		sort.Strings(got)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: ranked %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: ranked %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestRankByCapacityWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		devices []shared.Device
+		want    map[string]float64 // Expected share of first places
+	}{
+		{
+			name: "proportional to free space",
+			devices: []shared.Device{
+				{ID: "a", TotalBytes: 1000, FreeBytes: 300},
+				{ID: "b", TotalBytes: 1000, FreeBytes: 100},
+			},
+			want: map[string]float64{"a": 0.75, "b": 0.25},
+		},
+		{
+			name: "unknown capacity gets the average weight",
+			devices: []shared.Device{
+				{ID: "a", TotalBytes: 1000, FreeBytes: 300},
+				{ID: "b", TotalBytes: 1000, FreeBytes: 100},
+				{ID: "c"},
+			},
+			want: map[string]float64{"a": 0.5, "b": 1.0 / 6, "c": 1.0 / 3},
+		},
+		{
+			name: "scaled by reputation",
+			devices: []shared.Device{
+				{ID: "a", TotalBytes: 1000, FreeBytes: 100, Reputation: 0.9},
+				{ID: "b", TotalBytes: 1000, FreeBytes: 100, Reputation: 0.3},
+			},
+			want: map[string]float64{"a": 0.75, "b": 0.25},
+		},
+	}
+	const trials = 20000
+	for _, tt := range tests {
+		first := make(map[string]int)
+		for i := 0; i < trials; i++ {
+			ranked := rankByCapacity(tt.devices, 1, nil)
+			if len(ranked) != len(tt.devices) {
+				t.Fatalf("%s: ranked %d of %d devices", tt.name, len(ranked), len(tt.devices))
+			}
+			first[ranked[0].ID]++
+		}
+		for id, share := range tt.want {
+			if got := float64(first[id]) / trials; math.Abs(got-share) > 0.02 {
+				t.Errorf("%s: %s ranked first %.3f of the time, want %.3f", tt.name, id, got, share)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// PolicyEntry is a placement policy applied to files under PathPrefix.
+// An empty prefix is the user's default.
+type PolicyEntry struct {
+	PathPrefix string `json:"path_prefix"`
+	Policy     string `json:"policy"`
+
+	parsed *PlacementPolicy
+}
+
+// normalizeFolder turns user input like "/photos/2024/" into "photos/2024".
+func normalizeFolder(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// HandlePolicies lists (GET), sets (POST) or removes (DELETE ?path_prefix=)
+// the user's placement policies.
+func (s *Server) HandlePolicies(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(s.loadPolicies(userID))
+
+	case http.MethodPost:
+		var req PolicyEntry
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := ParsePolicy(req.Policy); err != nil {
+			http.Error(w, "Invalid policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err := s.DB.Exec(`INSERT INTO placement_policies (user_id, path_prefix, policy, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(user_id, path_prefix) DO UPDATE SET policy = excluded.policy, updated_at = excluded.updated_at`,
+			userID, normalizeFolder(req.PathPrefix), req.Policy, time.Now().Format(time.RFC3339))
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodDelete:
+		prefix := normalizeFolder(r.URL.Query().Get("path_prefix"))
+		s.DB.Exec("DELETE FROM placement_policies WHERE user_id = ? AND path_prefix = ?", userID, prefix)
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) loadPolicies(userID string) []PolicyEntry {
+	entries := []PolicyEntry{}
+	rows, err := s.DB.Query("SELECT path_prefix, policy FROM placement_policies WHERE user_id = ?", userID)
+	if err != nil {
+		return entries
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e PolicyEntry
+		if err := rows.Scan(&e.PathPrefix, &e.Policy); err != nil {
+			continue
+		}
+		if p, err := ParsePolicy(e.Policy); err == nil {
+			e.parsed = p
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// matchPolicy picks the entry with the longest prefix containing filePath.
+func matchPolicy(entries []PolicyEntry, filePath string) *PlacementPolicy {
+	var best *PolicyEntry
+	for i, e := range entries {
+		if e.PathPrefix != "" && filePath != e.PathPrefix && !strings.HasPrefix(filePath, e.PathPrefix+"/") {
+			continue
+		}
+		if best == nil || len(e.PathPrefix) > len(best.PathPrefix) {
+			best = &entries[i]
+		}
+	}
+	if best == nil {
+		p, _ := ParsePolicy(DefaultPolicy)
+		return p
+	}
+	return best.parsed
+}
+
+// policyForFile resolves the placement policy governing a user's file path.
+func (s *Server) policyForFile(userID, filePath string) *PlacementPolicy {
+	return matchPolicy(s.loadPolicies(userID), filePath)
+}
+
+// chunkFile describes the file a chunk belongs to.
+type chunkFile struct {
+	ID        string
+	UserID    string
+	TeamID    string // Empty for personal files
+	Path      string
+	Encrypted bool // Chunks are encrypted and may live on community devices
+}
+
+// chunkOwner returns the file a chunk belongs to.
+func (s *Server) chunkOwner(chunkID string) (f chunkFile, err error) {
+	err = s.DB.QueryRow(`
+		SELECT f.id, f.user_id, COALESCE(f.team_id, ''), f.path, COALESCE(f.encrypted, 0) FROM files f
+		JOIN chunks c ON c.file_id = f.id
+		WHERE c.id = ? LIMIT 1`, chunkID).Scan(&f.ID, &f.UserID, &f.TeamID, &f.Path, &f.Encrypted)
+	return
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"p2p-drive/shared"
+)
+
+// DefaultPolicy keeps a single copy of each chunk, matching the behaviour
+// before placement policies existed.
+const DefaultPolicy = "replicas 1"
+
+// PlacementPolicy constrains where the replicas of a chunk may live.
+//
+// Policies are written as clauses separated by ';' or ',':
+//
+//	replicas N          keep N copies of every chunk
+//	spread LABEL        replicas must differ in LABEL (zone, class or type)
+//	min N SELECTOR      at least N replicas on devices matching SELECTOR
+//	avoid SELECTOR      never place on devices matching SELECTOR
+//
+// A SELECTOR is LABEL=VALUE or LABEL!=VALUE, where LABEL is zone, class,
+// type or tag. For example "2 replicas, different zones, at least one
+// non-gdrive" is written as:
+//
+//	replicas 2; spread zone; min 1 type!=gdrive
+type PlacementPolicy struct {
+	Replicas int
+	Spread   []string
+	Mins     []policyMin
+	Avoid    []deviceSelector
+}
+
+type policyMin struct {
+	Count int
+	Sel   deviceSelector
+}
+
+type deviceSelector struct {
+	Label  string
+	Value  string
+	Negate bool
+}
+
+func (sel deviceSelector) matches(d shared.Device) bool {
+	var hit bool
+	if sel.Label == "tag" {
+		hit = containsString(d.Tags, sel.Value)
+	} else {
+		hit = deviceLabel(d, sel.Label) == sel.Value
+	}
+	return hit != sel.Negate
+}
+
+// deviceLabel returns the value of a spreadable label on a device.
+func deviceLabel(d shared.Device, label string) string {
+	switch label {
+	case "zone":
+		return d.Zone
+	case "class":
+		return d.Class
+	case "type":
+		if d.Type == "" {
+			return "agent"
+		}
+		return d.Type
+	}
+	return ""
+}
+
+func validLabel(label string, allowTag bool) bool {
+	switch label {
+	case "zone", "class", "type":
+		return true
+	case "tag":
+		return allowTag
+	}
+	return false
+}
+
+func parseSelector(s string) (deviceSelector, error) {
+	sel := deviceSelector{}
+	parts := strings.SplitN(s, "!=", 2)
+	if len(parts) == 2 {
+		sel.Negate = true
+	} else {
+		parts = strings.SplitN(s, "=", 2)
+	}
+	if len(parts) != 2 || parts[1] == "" {
+		return sel, fmt.Errorf("invalid selector %q, want LABEL=VALUE or LABEL!=VALUE", s)
+	}
+	sel.Label, sel.Value = strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if !validLabel(sel.Label, true) {
+		return sel, fmt.Errorf("unknown label %q", sel.Label)
+	}
+	return sel, nil
+}
+
+// ParsePolicy parses the policy language described on PlacementPolicy.
+func ParsePolicy(text string) (*PlacementPolicy, error) {
+	p := &PlacementPolicy{Replicas: 1}
+	clauses := strings.FieldsFunc(text, func(r rune) bool { return r == ';' || r == ',' })
+	for _, clause := range clauses {
+		f := strings.Fields(clause)
+		if len(f) == 0 {
+			continue
+		}
+		switch f[0] {
+		case "replicas":
+			if len(f) != 2 {
+				return nil, fmt.Errorf("usage: replicas N")
+			}
+			n, err := strconv.Atoi(f[1])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("replicas must be a positive number")
+			}
+			p.Replicas = n
+		case "spread":
+			if len(f) != 2 || !validLabel(f[1], false) {
+				return nil, fmt.Errorf("usage: spread zone|class|type")
+			}
+			p.Spread = append(p.Spread, f[1])
+		case "min":
+			if len(f) != 3 {
+				return nil, fmt.Errorf("usage: min N LABEL=VALUE")
+			}
+			n, err := strconv.Atoi(f[1])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("min count must be a positive number")
+			}
+			sel, err := parseSelector(f[2])
+			if err != nil {
+				return nil, err
+			}
+			p.Mins = append(p.Mins, policyMin{Count: n, Sel: sel})
+		case "avoid":
+			if len(f) != 2 {
+				return nil, fmt.Errorf("usage: avoid LABEL=VALUE")
+			}
+			sel, err := parseSelector(f[1])
+			if err != nil {
+				return nil, err
+			}
+			p.Avoid = append(p.Avoid, sel)
+		default:
+			return nil, fmt.Errorf("unknown clause %q", f[0])
+		}
+	}
+
+	need := 0
+	for _, m := range p.Mins {
+		need += m.Count
+	}
+	if need > p.Replicas {
+		return nil, fmt.Errorf("min clauses need %d replicas but policy keeps %d", need, p.Replicas)
+	}
+	return p, nil
+}
+
+// Allows reports whether d may be added to the devices already holding a
+// chunk without breaking the policy, leaving enough slots for unmet mins.
+func (p *PlacementPolicy) Allows(holders []shared.Device, d shared.Device) bool {
+	for _, sel := range p.Avoid {
+		if sel.matches(d) {
+			return false
+		}
+	}
+	for _, label := range p.Spread {
+		v := deviceLabel(d, label)
+		for _, h := range holders {
+			if deviceLabel(h, label) == v {
+				return false
+			}
+		}
+	}
+
+	slots := p.Replicas - len(holders) - 1
+	unmet := 0
+	for _, m := range p.Mins {
+		have := 0
+		for _, h := range holders {
+			if m.Sel.matches(h) {
+				have++
+			}
+		}
+		if m.Sel.matches(d) {
+			have++
+		}
+		if have < m.Count {
+			unmet += m.Count - have
+		}
+	}
+	return unmet <= slots
+}
+
+// Satisfied reports whether a set of replica holders meets the policy.
+func (p *PlacementPolicy) Satisfied(holders []shared.Device) bool {
+	if len(holders) < p.Replicas {
+		return false
+	}
+	for _, m := range p.Mins {
+		have := 0
+		for _, h := range holders {
+			if m.Sel.matches(h) {
+				have++
+			}
+		}
+		if have < m.Count {
+			return false
+		}
+	}
+	for _, label := range p.Spread {
+		seen := make(map[string]bool)
+		for _, h := range holders {
+			v := deviceLabel(h, label)
+			if seen[v] {
+				return false
+			}
+			seen[v] = true
+		}
+	}
+	return true
+}
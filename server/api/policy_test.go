@@ -0,0 +1,131 @@
+package api
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"p2p-drive/shared"
+)
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    *PlacementPolicy
+		wantErr string
+	}{
+		{
+			text: "",
+			want: &PlacementPolicy{Replicas: 1},
+		},
+		{
+			text: DefaultPolicy,
+			want: &PlacementPolicy{Replicas: 1},
+		},
+		{
+			text: "replicas 2; spread zone; min 1 type!=gdrive",
+			want: &PlacementPolicy{
+				Replicas: 2,
+				Spread:   []string{"zone"},
+				Mins:     []policyMin{{Count: 1, Sel: deviceSelector{Label: "type", Value: "gdrive", Negate: true}}},
+			},
+		},
+		{
+			text: " replicas 3 , spread zone, spread class ;; avoid tag=flaky ",
+			want: &PlacementPolicy{
+				Replicas: 3,
+				Spread:   []string{"zone", "class"},
+				Avoid:    []deviceSelector{{Label: "tag", Value: "flaky"}},
+			},
+		},
+		{
+			text: "replicas 3; min 1 zone=home; min 2 class=server",
+			want: &PlacementPolicy{
+				Replicas: 3,
+				Mins: []policyMin{
+					{Count: 1, Sel: deviceSelector{Label: "zone", Value: "home"}},
+					{Count: 2, Sel: deviceSelector{Label: "class", Value: "server"}},
+				},
+			},
+		},
+		{text: "replicas", wantErr: "usage: replicas N"},
+		{text: "replicas 0", wantErr: "positive number"},
+		{text: "replicas two", wantErr: "positive number"},
+		{text: "spread tag", wantErr: "usage: spread"},
+		{text: "spread colour", wantErr: "usage: spread"},
+		{text: "min 1", wantErr: "usage: min"},
+		{text: "min -1 zone=home", wantErr: "positive number"},
+		{text: "min 1 zone", wantErr: "invalid selector"},
+		{text: "min 1 zone=", wantErr: "invalid selector"},
+		{text: "min 1 colour=red", wantErr: "unknown label"},
+		{text: "avoid", wantErr: "usage: avoid"},
+		{text: "avoid owner=bob", wantErr: "unknown label"},
+		{text: "replicate 2", wantErr: "unknown clause"},
+		{text: "replicas 1; min 2 zone=home", wantErr: "need 2 replicas"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := ParsePolicy(tt.text)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ParsePolicy(%q) error = %v, want one containing %q", tt.text, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePolicy(%q): %v", tt.text, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParsePolicy(%q) = %+v, want %+v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyPlacement(t *testing.T) {
+	home := shared.Device{ID: "home", Zone: "home", Class: "laptop"}
+	office := shared.Device{ID: "office", Zone: "office", Class: "server"}
+	drive := shared.Device{ID: "drive", Type: "gdrive"}
+	flaky := shared.Device{ID: "flaky", Zone: "garage", Tags: []string{"flaky"}}
+
+	tests := []struct {
+		policy    string
+		holders   []shared.Device
+		candidate shared.Device
+		allows    bool
+		satisfied bool // Of the holders alone
+	}{
+		{"replicas 1", nil, home, true, false},
+		{"replicas 1", []shared.Device{home}, office, false, true},
+		{"replicas 2; spread zone", []shared.Device{home}, home, false, false},
+		{"replicas 2; spread zone", []shared.Device{home}, office, true, false},
+		{"replicas 2; spread zone", []shared.Device{home, office}, drive, false, true},
+		{"replicas 2; min 1 type!=gdrive", nil, drive, true, false},
+		{"replicas 2; min 1 type!=gdrive", []shared.Device{drive}, drive, false, false},
+		{"replicas 2; min 1 type!=gdrive", []shared.Device{drive}, home, true, false},
+		{"replicas 2; min 1 type!=gdrive", []shared.Device{drive, home}, office, false, true},
+		{"replicas 2; min 2 class=server", []shared.Device{office}, home, false, false},
+		{"replicas 2; avoid tag=flaky", []shared.Device{home}, flaky, false, false},
+		{"replicas 2; avoid tag!=flaky", []shared.Device{flaky}, home, false, false},
+	}
+	for _, tt := range tests {
+		p, err := ParsePolicy(tt.policy)
+		if err != nil {
+			t.Fatalf("ParsePolicy(%q): %v", tt.policy, err)
+		}
+		if got := p.Allows(tt.holders, tt.candidate); got != tt.allows {
+			t.Errorf("%q: Allows(%v, %s) = %v, want %v", tt.policy, ids(tt.holders), tt.candidate.ID, got, tt.allows)
+		}
+		if got := p.Satisfied(tt.holders); got != tt.satisfied {
+			t.Errorf("%q: Satisfied(%v) = %v, want %v", tt.policy, ids(tt.holders), got, tt.satisfied)
+		}
+	}
+}
+
+func ids(devices []shared.Device) []string {
+	out := make([]string, len(devices))
+	for i, d := range devices {
+		out[i] = d.ID
+	}
+	return out
+}
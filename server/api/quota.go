@@ -0,0 +1,296 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Usage is charged to an account: personal files to their uploader, team
+// files to the team.
+const (
+	usageUser = "user"
+	usageTeam = "team"
+)
+
+// quotaWarnRatio is the share of a quota past which uploads publish a
+// quota.warning event.
+const quotaWarnRatio = 0.9
+
+// Quota limits an account's logical bytes (file sizes) and physical bytes
+// (every stored replica). 0 means unlimited.
+type Quota struct {
+	Logical  int64 `json:"logical_bytes"`
+	Physical int64 `json:"physical_bytes"`
+}
+
+// Usage is an account's stored data next to its quota.
+type Usage struct {
+	TeamID        string `json:"team_id,omitempty"`
+	Name          string `json:"name,omitempty"` // Team name
+	Files         int64  `json:"files"`
+	LogicalBytes  int64  `json:"logical_bytes"`
+	PhysicalBytes int64  `json:"physical_bytes"`
+	Quota         Quota  `json:"quota"`
+}
+
+// UsageReport is returned by GET /api/usage.
+type UsageReport struct {
+	Personal Usage   `json:"personal"`
+	Teams    []Usage `json:"teams"`
+}
+
+// usageAccount picks the account a file is charged to.
+func usageAccount(userID, teamID string) (kind, id string) {
+	if teamID != "" {
+		return usageTeam, teamID
+	}
+	return usageUser, userID
+}
+
+// addUsage adjusts an account's counters by the given deltas.
+func (s *Server) addUsage(kind, id string, files, logical, physical int64) {
+	if id == "" {
+		return
+	}
+	_, err := s.DB.Exec(`INSERT INTO usage_counters (kind, owner_id, files, logical_bytes, physical_bytes) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(kind, owner_id) DO UPDATE SET
+			files = files + excluded.files,
+			logical_bytes = logical_bytes + excluded.logical_bytes,
+			physical_bytes = physical_bytes + excluded.physical_bytes`,
+		kind, id, files, logical, physical)
+	if err != nil {
+		slog.Error("Usage update failed", "kind", kind, "id", id, "err", err)
+	}
+}
+
+// chargeReplica adds (sign 1) or removes (sign -1) one replica of a chunk
+// on a device, charging its file's account and recording it in the ledger
+// when the device belongs to someone else. Team files stay out of the
+// ledger: pool members store them by agreement, not against an allowance.
+func (s *Server) chargeReplica(chunkID, deviceID string, sign int64) {
+	var size int64
+	var userID, teamID, hostID string
+	err := s.DB.QueryRow(`
+		SELECT COALESCE(c.size, 0), f.user_id, COALESCE(f.team_id, ''),
+			COALESCE((SELECT user_id FROM devices WHERE id = ?), '') FROM chunks c
+		JOIN files f ON f.id = c.file_id
+		WHERE c.id = ? LIMIT 1`, deviceID, chunkID).Scan(&size, &userID, &teamID, &hostID)
+	if err != nil {
+		// Unreferenced chunks aren't charged to anyone
+		return
+	}
+	kind, id := usageAccount(userID, teamID)
+	s.addUsage(kind, id, 0, 0, sign*size)
+	if teamID == "" {
+		s.addLedger(hostID, userID, sign*size)
+	}
+}
+
+// loadUsage reads an account's counters and effective quota.
+func (s *Server) loadUsage(kind, id string) Usage {
+	var u Usage
+	s.DB.QueryRow("SELECT files, logical_bytes, physical_bytes FROM usage_counters WHERE kind = ? AND owner_id = ?", kind, id).
+		Scan(&u.Files, &u.LogicalBytes, &u.PhysicalBytes)
+	u.Quota = s.quotaFor(kind, id)
+	return u
+}
+
+// quotaFor returns an account's quota. Users without their own limits get
+// the server default; teams are unlimited unless an admin sets one.
+func (s *Server) quotaFor(kind, id string) Quota {
+	var logical, physical sql.NullInt64
+	if kind == usageTeam {
+		s.DB.QueryRow("SELECT quota_logical, quota_physical FROM teams WHERE id = ?", id).Scan(&logical, &physical)
+	} else {
+		s.DB.QueryRow("SELECT quota_logical, quota_physical FROM users WHERE id = ?", id).Scan(&logical, &physical)
+	}
+	q := Quota{Logical: logical.Int64, Physical: physical.Int64}
+	if kind == usageUser {
+		if !logical.Valid {
+			q.Logical = s.DefaultQuota.Logical
+		}
+		if !physical.Valid {
+			q.Physical = s.DefaultQuota.Physical
+		}
+	}
+	return q
+}
+
+// reserveQuota charges one new file of logical bytes, physical of them
+// including replicas, to the file's account, unless that would put it over
+// quota. Check and charge are one statement, so concurrent uploads can't all
+// pass on the same headroom. The caller returns what it doesn't use with
+// addUsage.
+func (s *Server) reserveQuota(userID, teamID string, logical, physical int64) error {
+	kind, id := usageAccount(userID, teamID)
+	q := s.quotaFor(kind, id)
+	s.DB.Exec("INSERT OR IGNORE INTO usage_counters (kind, owner_id, files, logical_bytes, physical_bytes) VALUES (?, ?, 0, 0, 0)", kind, id)
+	res, err := s.DB.Exec(`UPDATE usage_counters SET
+			files = files + 1,
+			logical_bytes = logical_bytes + ?,
+			physical_bytes = physical_bytes + ?
+		WHERE kind = ? AND owner_id = ?
+			AND (? <= 0 OR logical_bytes + ? <= ?)
+			AND (? <= 0 OR physical_bytes + ? <= ?)`,
+		logical, physical, kind, id,
+		q.Logical, logical, q.Logical,
+		q.Physical, physical, q.Physical)
+	if err != nil {
+		return fmt.Errorf("usage update failed: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return nil
+	}
+
+	u := s.loadUsage(kind, id)
+	if q.Logical > 0 && u.LogicalBytes+logical > q.Logical {
+		return fmt.Errorf("quota exceeded: %d of %d bytes used", u.LogicalBytes, q.Logical)
+	}
+	return fmt.Errorf("quota exceeded: %d of %d bytes stored including replicas", u.PhysicalBytes, q.Physical)
+}
+
+// QuotaWarning is the data of a quota.warning event: the account's usage,
+// the larger of its logical and physical fill ratios, and whether an upload
+// was just rejected for exceeding it.
+type QuotaWarning struct {
+	Usage
+	Ratio    float64 `json:"ratio"`
+	Rejected bool    `json:"rejected"`
+}
+
+// warnQuota publishes a quota.warning to the user when the account the
+// file was charged to is nearly full, or when an upload was rejected.
+func (s *Server) warnQuota(userID, teamID string, rejected bool) {
+	kind, id := usageAccount(userID, teamID)
+	u := s.loadUsage(kind, id)
+	var ratio float64
+	if u.Quota.Logical > 0 {
+		ratio = float64(u.LogicalBytes) / float64(u.Quota.Logical)
+	}
+	if u.Quota.Physical > 0 {
+		ratio = max(ratio, float64(u.PhysicalBytes)/float64(u.Quota.Physical))
+	}
+	if !rejected && ratio < quotaWarnRatio {
+		return
+	}
+	u.TeamID = teamID
+	s.Events.Publish(Event{Type: EventQuotaWarning, UserID: userID, TeamID: teamID, Data: QuotaWarning{Usage: u, Ratio: ratio, Rejected: rejected}})
+}
+
+// GetUsage reports the caller's personal usage and that of their teams.
+func (s *Server) GetUsage(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	report := UsageReport{Personal: s.loadUsage(usageUser, userID), Teams: []Usage{}}
+	rows, err := s.DB.Query(`
+		SELECT t.id, t.name FROM teams t JOIN team_members m ON m.team_id = t.id
+		WHERE m.user_id = ? ORDER BY t.name`, userID)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	type team struct{ id, name string }
+	var teams []team
+	for rows.Next() {
+		var t team
+		rows.Scan(&t.id, &t.name)
+		teams = append(teams, t)
+	}
+	rows.Close()
+
+	for _, t := range teams {
+		u := s.loadUsage(usageTeam, t.id)
+		u.TeamID, u.Name = t.id, t.name
+		report.Teams = append(report.Teams, u)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// AdminSetQuota sets a user's or team's quota:
+// {"user_id"|"team_id": "...", "logical_bytes": n, "physical_bytes": n}.
+// 0 means unlimited; "default": true returns a user to the server default.
+func (s *Server) AdminSetQuota(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		UserID   string `json:"user_id"`
+		TeamID   string `json:"team_id"`
+		Default  bool   `json:"default"`
+		Logical  int64  `json:"logical_bytes"`
+		Physical int64  `json:"physical_bytes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Logical < 0 || req.Physical < 0 {
+		http.Error(w, "Quotas can't be negative", http.StatusBadRequest)
+		return
+	}
+
+	var res sql.Result
+	var err error
+	switch {
+	case req.UserID != "" && req.Default:
+		res, err = s.DB.Exec("UPDATE users SET quota_logical = NULL, quota_physical = NULL WHERE id = ?", req.UserID)
+	case req.UserID != "":
+		res, err = s.DB.Exec("UPDATE users SET quota_logical = ?, quota_physical = ? WHERE id = ?", req.Logical, req.Physical, req.UserID)
+	case req.TeamID != "":
+		res, err = s.DB.Exec("UPDATE teams SET quota_logical = ?, quota_physical = ? WHERE id = ?", req.Logical, req.Physical, req.TeamID)
+	default:
+		http.Error(w, "user_id or team_id required", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	slog.InfoContext(r.Context(), "Admin set quota", "admin", r.Header.Get("X-User-ID"), "user", req.UserID, "team", req.TeamID)
+	w.Write([]byte(`{"status":"ok"}`))
+}
+
+// BackfillUsage seeds the usage counters from existing data. It only runs
+// when the counters are empty, e.g. on the first start after upgrading;
+// from then on they are maintained incrementally.
+func (s *Server) BackfillUsage() {
+	var n int
+	s.DB.QueryRow("SELECT COUNT(*) FROM usage_counters").Scan(&n)
+	if n > 0 {
+		return
+	}
+	s.DB.Exec(`
+		INSERT INTO usage_counters (kind, owner_id, files, logical_bytes, physical_bytes)
+		SELECT CASE WHEN COALESCE(f.team_id, '') = '' THEN 'user' ELSE 'team' END,
+			CASE WHEN COALESCE(f.team_id, '') = '' THEN f.user_id ELSE f.team_id END,
+			COUNT(*), COALESCE(SUM(f.size), 0),
+			COALESCE(SUM((SELECT SUM(c.size) FROM chunks c JOIN chunk_locations cl ON cl.chunk_id = c.id WHERE c.file_id = f.id)), 0)
+		FROM files f WHERE f.user_id IS NOT NULL
+		GROUP BY 1, 2`)
+}
+
+// BackfillLedger seeds the ledger from existing replicas, like BackfillUsage.
+func (s *Server) BackfillLedger() {
+	var n int
+	s.DB.QueryRow("SELECT COUNT(*) FROM ledger").Scan(&n)
+	if n > 0 {
+		return
+	}
+	s.DB.Exec(`
+		INSERT INTO ledger (host_id, owner_id, bytes)
+		SELECT d.user_id, f.user_id, SUM(COALESCE(c.size, 0)) FROM chunk_locations cl
+		JOIN chunks c ON c.id = cl.chunk_id
+		JOIN files f ON f.id = c.file_id
+		JOIN devices d ON d.id = cl.device_id
+		WHERE d.user_id IS NOT NULL AND f.user_id IS NOT NULL AND d.user_id != f.user_id
+		AND COALESCE(f.team_id, '') = ''
+		GROUP BY d.user_id, f.user_id`)
+}
@@ -1,176 +1,434 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+
 	"p2p-drive/shared"
 )
 
-// RebalanceHandler triggers the rebalancing process manually
+// PlannedMove relocates one replica of a chunk.
+type PlannedMove struct {
+	ChunkID string `json:"chunk_id"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Size    int64  `json:"size"`
+}
+
+// RebalancePlan is the outcome of planning: the moves, and the byte totals
+// per device before and after they are applied.
+type RebalancePlan struct {
+	Moves      []PlannedMove    `json:"moves"`
+	MoveBytes  int64            `json:"move_bytes"`
+	TotalBytes int64            `json:"total_bytes"`
+	Current    map[string]int64 `json:"current"`
+	Target     map[string]int64 `json:"target"`
+	Projected  map[string]int64 `json:"projected"`
+	UserID     string           `json:"-"` // Whose devices it balances
+}
+
+// RebalanceLimits bounds how hard an executing plan hits the mesh.
+type RebalanceLimits struct {
+	Concurrency int   `json:"concurrency"`   // Moves in flight at once
+	BytesPerSec int64 `json:"bytes_per_sec"` // 0 = unlimited
+}
+
+// RebalanceResult
+type RebalanceResult struct {
+	Moved  int   `json:"moved"`
+	Failed int   `json:"failed"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// RebalanceProgress is published as a rebalance starts, after each move and
+// when it is done.
+type RebalanceProgress struct {
+	RebalanceResult
+	Moves     int   `json:"moves"`
+	MoveBytes int64 `json:"move_bytes"`
+	Done      bool  `json:"done"`
+}
+
+// RebalanceHandler serves the rebalance plan.
+// GET returns a dry run; POST executes it in the background. Both accept
+// optional "concurrency" and "bandwidth" (bytes/sec) query parameters, which
+// can only tighten the server's limits.
 func (s *Server) RebalanceHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.Header.Get("X-User-ID")
 	if userID == "" {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
-	go s.TriggerRebalance(userID) 
-	w.Write([]byte("Rebalancing started in background"))
+
+	plan, err := s.PlanRebalance(userID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(plan)
+	case http.MethodPost:
+		limits := s.Rebalance
+		if v, err := strconv.Atoi(r.URL.Query().Get("concurrency")); err == nil && v > 0 && v < limits.Concurrency {
+			limits.Concurrency = v
+		}
+		if v, err := strconv.ParseInt(r.URL.Query().Get("bandwidth"), 10, 64); err == nil && v > 0 &&
+			(limits.BytesPerSec == 0 || v < limits.BytesPerSec) {
+			limits.BytesPerSec = v
+		}
+		if !s.beginRebalance(userID) {
+			http.Error(w, "Rebalance already running", http.StatusConflict)
+			return
+		}
+		ctx := detachedContext(r.Context())
+		go func() {
+			defer s.endRebalance(userID)
+			s.ExecuteRebalance(ctx, plan, limits)
+		}()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(plan)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
 }
 
+// TriggerRebalance plans and executes a rebalance with the server's limits.
 func (s *Server) TriggerRebalance(userID string) {
-	log.Printf("Starting Cluster Rebalance for user %s...", userID)
-	// 1. Get all online devices
-	devices, err := s.getUserOnlineDevices(userID)
-	if err != nil || len(devices) < 2 {
-		log.Println("Not enough devices to rebalance")
+	if !s.beginRebalance(userID) {
 		return
 	}
+	defer s.endRebalance(userID)
 
-	// 2. Get all chunk locations
-	// Map: ChunkID -> []DeviceID
-	rows, err := s.DB.Query("SELECT chunk_id, device_id FROM chunk_locations")
+	ctx := backgroundContext()
+	plan, err := s.PlanRebalance(userID)
 	if err != nil {
-		log.Println("DB Error:", err)
+		slog.ErrorContext(ctx, "Rebalance plan failed", "user", userID, "err", err)
 		return
 	}
-	defer rows.Close()
+	s.ExecuteRebalance(ctx, plan, s.Rebalance)
+}
 
-	chunkLocs := make(map[string][]string)
-	deviceLoad := make(map[string]int) // DeviceID -> ChunkCount
+func (s *Server) beginRebalance(userID string) bool {
+	s.rebalanceMu.Lock()
+	defer s.rebalanceMu.Unlock()
+	if s.rebalancing[userID] {
+		return false
+	}
+	s.rebalancing[userID] = true
+	return true
+}
+
+func (s *Server) endRebalance(userID string) {
+	s.rebalanceMu.Lock()
+	delete(s.rebalancing, userID)
+	s.rebalanceMu.Unlock()
+}
 
+// PlanRebalance computes the moves that bring each of the user's active
+// devices close to its byte target. Only the user's own files are considered;
+// team files live on the team pool.
+func (s *Server) PlanRebalance(userID string) (*RebalancePlan, error) {
+	plan := &RebalancePlan{
+		Moves:     []PlannedMove{},
+		Current:   make(map[string]int64),
+		Target:    make(map[string]int64),
+		Projected: make(map[string]int64),
+		UserID:    userID,
+	}
+
+	// 1. Devices that can take part: online and not draining
+	devices, err := s.getUserOnlineDevices(userID)
+	if err != nil {
+		return nil, err
+	}
+	active := make(map[string]shared.Device)
 	for _, d := range devices {
-		deviceLoad[d.ID] = 0 // Init
+		active[d.ID] = d
+		plan.Current[d.ID] = 0
 	}
 
+	// 2. The user's chunk replicas and their sizes
+	rows, err := s.DB.Query(`
+		SELECT cl.chunk_id, cl.device_id, COALESCE(c.size, 0), f.path FROM chunk_locations cl
+		JOIN chunks c ON c.id = cl.chunk_id
+		JOIN files f ON f.id = c.file_id
+		WHERE f.user_id = ? AND COALESCE(f.team_id, '') = ''`, userID)
+	if err != nil {
+		return nil, err
+	}
+	chunkLocs := make(map[string][]string)
+	chunkSize := make(map[string]int64)
+	chunkPath := make(map[string]string)
 	for rows.Next() {
-		var c, d string
-		rows.Scan(&c, &d)
+		var c, d, path string
+		var size int64
+		rows.Scan(&c, &d, &size, &path)
+		if containsString(chunkLocs[c], d) {
+			continue
+		}
 		chunkLocs[c] = append(chunkLocs[c], d)
-		if _, ok := deviceLoad[d]; ok {
-			deviceLoad[d]++
+		chunkSize[c] = size
+		chunkPath[c] = path
+		if _, ok := active[d]; ok {
+			plan.Current[d] += size
 		}
 	}
+	rows.Close()
 
-	// 3. Calculate Target Load
-	totalChunks := 0
-	for _, count := range deviceLoad {
-		totalChunks += count
-	}
-	targetLoad := totalChunks / len(devices)
-	fmt.Printf("Total Chunks: %d, Devices: %d, Target: %d\n", totalChunks, len(devices), targetLoad)
-
-	// 4. Move Chunks
-	// Simple greedy approach: Take from overloaded, give to underloaded
-	for devID, count := range deviceLoad {
-		if count > targetLoad {
-			toMove := count - targetLoad
-			// Find chunks on this device to move
-			moved := 0
-			// Iterate all chunks to find ones on this device (inefficient but works for now)
-			for chunkID, locs := range chunkLocs {
-				if moved >= toMove {
-					break
-				}
-				// Check if this chunk is ON this device
-				hasIt := false
-				for _, d := range locs {
-					if d == devID {
-						hasIt = true
-						break
-					}
+	for id, b := range plan.Current {
+		plan.Projected[id] = b
+		plan.TotalBytes += b
+	}
+	if len(devices) < 2 {
+		return plan, nil
+	}
+
+	// 3. Byte targets proportional to what each device can hold
+	// (what it stores now plus what it has free)
+	capacity := make(map[string]float64)
+	var knownSum float64
+	known := 0
+	for _, d := range devices {
+		if avail := availableBytes(d); avail >= 0 {
+			capacity[d.ID] = float64(plan.Current[d.ID] + avail)
+			knownSum += capacity[d.ID]
+			known++
+		}
+	}
+	fallback := 1.0
+	if known > 0 {
+		fallback = knownSum / float64(known)
+	}
+	var capSum float64
+	for _, d := range devices {
+		if _, ok := capacity[d.ID]; !ok {
+			capacity[d.ID] = fallback
+		}
+		capSum += capacity[d.ID]
+	}
+	if capSum <= 0 {
+		return plan, nil
+	}
+	for _, d := range devices {
+		plan.Target[d.ID] = int64(float64(plan.TotalBytes) * capacity[d.ID] / capSum)
+	}
+
+	// Moves must keep each chunk within its placement policy
+	policies := s.loadPolicies(userID)
+	owned, _ := s.queryDevices("WHERE user_id = ?", userID)
+	byID := make(map[string]shared.Device)
+	for _, d := range owned {
+		byID[d.ID] = d
+	}
+
+	// Largest chunks first so the plan converges in few moves
+	chunkIDs := make([]string, 0, len(chunkLocs))
+	for c := range chunkLocs {
+		chunkIDs = append(chunkIDs, c)
+	}
+	sort.Slice(chunkIDs, func(i, j int) bool {
+		if chunkSize[chunkIDs[i]] != chunkSize[chunkIDs[j]] {
+			return chunkSize[chunkIDs[i]] > chunkSize[chunkIDs[j]]
+		}
+		return chunkIDs[i] < chunkIDs[j]
+	})
+
+	// Most overloaded devices give first
+	sources := append([]shared.Device(nil), devices...)
+	sort.Slice(sources, func(i, j int) bool {
+		return plan.Current[sources[i].ID]-plan.Target[sources[i].ID] >
+			plan.Current[sources[j].ID]-plan.Target[sources[j].ID]
+	})
+
+	// 4. Greedy: take from devices above target, give to the device furthest
+	// below its target, and never overshoot the receiver (prevents ping-pong).
+	// Each chunk moves at most once per plan, since moves run concurrently.
+	moved := make(map[string]bool)
+	for _, src := range sources {
+		for _, chunkID := range chunkIDs {
+			if plan.Projected[src.ID] <= plan.Target[src.ID] {
+				break
+			}
+			if moved[chunkID] {
+				continue
+			}
+			locs := chunkLocs[chunkID]
+			if !containsString(locs, src.ID) {
+				continue
+			}
+			size := chunkSize[chunkID]
+			if size <= 0 {
+				continue
+			}
+			policy := matchPolicy(policies, chunkPath[chunkID])
+			var remaining []shared.Device
+			for _, id := range locs {
+				if d, ok := byID[id]; ok && id != src.ID {
+					remaining = append(remaining, d)
 				}
+			}
 
-				if hasIt {
-					// Find the best target device (lowest load)
-					var targetDev string
-					minLoad := 999999
-					
-					for d, c := range deviceLoad {
-						if c < minLoad {
-							minLoad = c
-							targetDev = d
-						}
-					}
-
-					// Only move if target has less than source (prevent ping-pong if equal)
-					// And only if target is significantly better or we are overloaded
-					if targetDev != "" && minLoad < count {
-						log.Printf("Moving chunk %s from %s (load %d) to %s (load %d)", chunkID, devID, count, targetDev, minLoad)
-						if s.MoveChunk(chunkID, devID, targetDev) {
-							// Update local state
-							deviceLoad[devID]--
-							deviceLoad[targetDev]++
-							moved++
-						}
-					}
+			to := ""
+			var bestDeficit int64
+			for _, d := range devices {
+				if d.ID == src.ID || containsString(locs, d.ID) || !policy.Allows(remaining, d) {
+					continue
+				}
+				if deficit := plan.Target[d.ID] - plan.Projected[d.ID]; deficit >= size && deficit > bestDeficit {
+					bestDeficit = deficit
+					to = d.ID
 				}
 			}
+			if to == "" {
+				continue
+			}
+
+			plan.Moves = append(plan.Moves, PlannedMove{ChunkID: chunkID, From: src.ID, To: to, Size: size})
+			plan.MoveBytes += size
+			plan.Projected[src.ID] -= size
+			plan.Projected[to] += size
+			moved[chunkID] = true
 		}
 	}
-	log.Println("Rebalance Complete")
-}
-
-func (s *Server) MoveChunk(chunkID, sourceDev, targetDev string) bool {
-	// 1. Request Retrieve from Source
-	reqMsg := shared.RelayMessage{
-		Type:    shared.RelayTypeRetrieve,
-		Payload: []byte(chunkID),
-	}
-	reqBytes, _ := json.Marshal(reqMsg)
-	s.injectRelayMessage(sourceDev, "inbox", reqBytes)
-
-	// 2. Wait for Source to send back to "server" on session "chunk-{id}"
-	key := "server-chunk-" + chunkID
-	
-	// Create channel in map to listen
-	relayLock.Lock()
-	ch := make(chan []byte, 1)
-	relayChannels[key] = ch
-	relayLock.Unlock()
-
-	defer func() {
-		relayLock.Lock()
-		delete(relayChannels, key)
-		relayLock.Unlock()
-	}()
-
-	var chunkData []byte
-	select {
-	case data := <-ch:
-		chunkData = data
-	case <-time.After(10 * time.Second):
-		log.Printf("Timeout receiving chunk %s from %s", chunkID, sourceDev)
-		return false
+	return plan, nil
+}
+
+// ExecuteRebalance applies a plan, keeping at most limits.Concurrency moves
+// in flight and pacing transfers to limits.BytesPerSec.
+func (s *Server) ExecuteRebalance(ctx context.Context, plan *RebalancePlan, limits RebalanceLimits) RebalanceResult {
+	var result RebalanceResult
+	if len(plan.Moves) == 0 {
+		return result
+	}
+	if limits.Concurrency < 1 {
+		limits.Concurrency = 1
 	}
+	slog.InfoContext(ctx, "Rebalance started", "moves", len(plan.Moves), "bytes", plan.MoveBytes,
+		"concurrency", limits.Concurrency, "bytes_per_sec", limits.BytesPerSec)
 
-	// 3. Send Store to Target
-	storeMsg := shared.RelayMessage{
-		Type:    shared.RelayTypeStore,
-		Payload: chunkData,
+	progress := func(done bool) {
+		s.Events.Publish(Event{Type: EventRebalanceProgress, UserID: plan.UserID, Data: RebalanceProgress{
+			RebalanceResult: result, Moves: len(plan.Moves), MoveBytes: plan.MoveBytes, Done: done,
+		}})
 	}
-	storeBytes, _ := json.Marshal(storeMsg)
-	s.injectRelayMessage(targetDev, "inbox", storeBytes)
+	progress(false)
+
+	limiter := newByteLimiter(limits.BytesPerSec)
+	sem := make(chan struct{}, limits.Concurrency)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
 
-	// 4. Update DB
-	// We assume success for now, or could wait for ack?
-	// Realistically, we should wait for "Location Reported" but that's async.
-	// We'll update DB optimistically or wait?
-	// Let's just update DB.
-	s.DB.Exec("INSERT OR IGNORE INTO chunk_locations (chunk_id, device_id) VALUES (?, ?)", chunkID, targetDev)
-	
-	// 5. Delete from Source
-	delMsg := shared.RelayMessage{
-		Type:    shared.RelayTypeDelete,
-		Payload: []byte(chunkID),
+	for _, move := range plan.Moves {
+		limiter.wait(move.Size)
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(m PlannedMove) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := s.MoveChunk(ctx, m.ChunkID, m.From, m.To)
+			mu.Lock()
+			defer mu.Unlock()
+			defer progress(false)
+			if err != nil {
+				slog.WarnContext(ctx, "Chunk move failed", "chunk", m.ChunkID, "from", m.From, "to", m.To, "err", err)
+				result.Failed++
+				rebalanceMoves.WithLabelValues("failed").Inc()
+				return
+			}
+			result.Moved++
+			rebalanceMoves.WithLabelValues("moved").Inc()
+			result.Bytes += m.Size
+		}(move)
 	}
-	delBytes, _ := json.Marshal(delMsg)
-	s.injectRelayMessage(sourceDev, "inbox", delBytes)
-	
-	s.DB.Exec("DELETE FROM chunk_locations WHERE chunk_id = ? AND device_id = ?", chunkID, sourceDev)
+	wg.Wait()
+	progress(true)
 
-	return true
+	slog.InfoContext(ctx, "Rebalance complete", "moved", result.Moved, "bytes", result.Bytes, "failed", result.Failed)
+	return result
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// MoveChunk copies a chunk from one device to another. The new location is
+// recorded only once the target has ACKed the write; only then is the
+// source copy deleted.
+func (s *Server) MoveChunk(ctx context.Context, chunkID, sourceDev, targetDev string) (err error) {
+	ctx, span := startSpan(ctx, "MoveChunk", attribute.String("chunk", chunkID), attribute.String("from", sourceDev), attribute.String("to", targetDev))
+	defer func() { endSpan(span, err) }()
+
+	// 1. Re-check the plan still applies
+	var held int
+	s.DB.QueryRow("SELECT COUNT(*) FROM chunk_locations WHERE chunk_id = ? AND device_id = ?", chunkID, sourceDev).Scan(&held)
+	if held == 0 {
+		return fmt.Errorf("source no longer holds chunk")
+	}
+	targets, err := s.queryDevices("WHERE id = ? AND online = 1 AND COALESCE(state, 'active') = 'active'", targetDev)
+	if err != nil || len(targets) == 0 {
+		return fmt.Errorf("target unavailable")
+	}
+
+	// 2. Retrieve and verify from source
+	data, err := s.fetchChunk(ctx, sourceDev, chunkID)
+	if err != nil {
+		return err
+	}
+
+	// 3. Store on target; storeChunk records the location after the ACK
+	if err := s.storeChunk(ctx, targets[0], chunkID, data); err != nil {
+		return err
+	}
+
+	// 4. Delete from source
+	s.releaseChunk(ctx, chunkID, sourceDev)
+	return nil
+}
+
+// byteLimiter paces transfers to a fixed byte rate.
+type byteLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time // When the next transfer may start
+}
+
+func newByteLimiter(rate int64) *byteLimiter {
+	return &byteLimiter{rate: rate}
+}
+
+// wait blocks until n more bytes fit within the rate.
+func (l *byteLimiter) wait(n int64) {
+	if l.rate <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	start := l.next
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	l.mu.Unlock()
+
+	time.Sleep(time.Until(start))
 }
@@ -3,8 +3,11 @@ package api
 import (
 	"io"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
+
+	"p2p-drive/shared"
 )
 
 // Simple in-memory relay map: Token -> Channel
@@ -22,30 +25,37 @@ var relayLock sync.Mutex
 func (s *Server) RelaySend(w http.ResponseWriter, r *http.Request) {
 	// Receiver Device ID
 	to := r.URL.Query().Get("to")
-	// Sender Device ID (authenticated? For now assume trusted or in header)
-	// In real app, we check Auth header.
 
 	if to == "" {
 		http.Error(w, "Missing 'to' param", http.StatusBadRequest)
 		return
 	}
 
-	// Read body
-	data, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read body", http.StatusInternalServerError)
+	// Devices may only reach the server or their owner's other devices
+	if to != "server" && !s.sameOwner(to, r.Header.Get(headerDeviceOwner)) {
+		http.Error(w, "Unknown relay target", http.StatusForbidden)
 		return
 	}
-	defer r.Body.Close()
 
-	// We need a unique session ID or just pipe by device pair?
-	// If multiple concurrent transfers, we need session ID.
-	// Let's expect a "session" param.
 	session := r.URL.Query().Get("session")
 	if session == "" {
 		http.Error(w, "Missing 'session' param", http.StatusBadRequest)
 		return
 	}
+	// Server sessions name the device they were issued to; nobody else may
+	// answer on them
+	if to == "server" && !sessionIssuedTo(session, r.Header.Get(shared.HeaderDeviceID)) {
+		http.Error(w, "Session not issued to this device", http.StatusForbidden)
+		return
+	}
+
+	// Read body
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read body", http.StatusInternalServerError)
+		return
+	}
+	defer r.Body.Close()
 
 	key := to + "-" + session
 
@@ -75,13 +85,30 @@ func (s *Server) RelaySend(w http.ResponseWriter, r *http.Request) {
 	case ch <- data:
 		w.WriteHeader(http.StatusOK)
 	case <-time.After(10 * time.Second):
+		relayTimeouts.WithLabelValues("send").Inc()
 		http.Error(w, "Timeout waiting for receiver", http.StatusGatewayTimeout)
 	}
 }
 
+// sessionIssuedTo reports whether a server session belongs to a device.
+func sessionIssuedTo(session, deviceID string) bool {
+	if deviceID == "" {
+		return false
+	}
+	// kind-operation-device: the device ID may itself contain dashes
+	parts := strings.SplitN(session, "-", 3)
+	if len(parts) != 3 || parts[1] == "" || parts[2] != deviceID {
+		return false
+	}
+	switch parts[0] {
+	case shared.RelaySessionAck, shared.RelaySessionChunk, shared.RelaySessionProof:
+		return true
+	}
+	return false
+}
+
 func (s *Server) RelayRecv(w http.ResponseWriter, r *http.Request) {
 	// Current Device ID (me)
-	// In real app, derived from Auth.
 	to := r.URL.Query().Get("me")
 	session := r.URL.Query().Get("session")
 
@@ -89,6 +116,10 @@ func (s *Server) RelayRecv(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Missing params", http.StatusBadRequest)
 		return
 	}
+	if to != r.Header.Get(shared.HeaderDeviceID) {
+		http.Error(w, "Can only receive for yourself", http.StatusForbidden)
+		return
+	}
 
 	key := to + "-" + session
 
@@ -117,6 +148,7 @@ func (s *Server) RelayRecv(w http.ResponseWriter, r *http.Request) {
 		relayLock.Unlock()
 
 	case <-time.After(30 * time.Second):
+		relayTimeouts.WithLabelValues("recv").Inc()
 		http.Error(w, "Timeout waiting for sender", http.StatusGatewayTimeout)
 	}
 }
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"testing"
+
+	"p2p-drive/shared"
+)
+
+func TestSessionIssuedTo(t *testing.T) {
+	tests := []struct {
+		name    string
+		session string
+		device  string
+		want    bool
+	}{
+		{"ack for the device", shared.ServerSession(shared.RelaySessionAck, "abc", "op1"), "abc", true},
+		{"chunk for the device", shared.ServerSession(shared.RelaySessionChunk, "abc", "op1"), "abc", true},
+		{"proof with a dashed challenge ID", shared.ServerSession(shared.RelaySessionProof, "abc", "0f8e2c1d-4b7a-4c2e"), "abc", true},
+		{"legacy dashed device ID", shared.ServerSession(shared.RelaySessionAck, "abc-x", "op1"), "abc-x", true},
+		{"dash-prefix of the device", shared.ServerSession(shared.RelaySessionAck, "abc-x", "op1"), "abc", false},
+		{"device is a dash-prefix of ours", shared.ServerSession(shared.RelaySessionAck, "abc", "op1"), "abc-x", false},
+		{"dash-suffix of the device", shared.ServerSession(shared.RelaySessionAck, "x-abc", "op1"), "abc", false},
+		{"another device", shared.ServerSession(shared.RelaySessionChunk, "def", "op1"), "abc", false},
+		{"unknown kind", "inbox-op1-abc", "abc", false},
+		{"no operation", "ack--abc", "abc", false},
+		{"too few parts", "ack-abc", "abc", false},
+		{"no device", shared.ServerSession(shared.RelaySessionAck, "abc", "op1"), "", false},
+	}
+	for _, tt := range tests {
+		if got := sessionIssuedTo(tt.session, tt.device); got != tt.want {
+			t.Errorf("%s: sessionIssuedTo(%q, %q) = %v, want %v", tt.name, tt.session, tt.device, got, tt.want)
+		}
+	}
+}
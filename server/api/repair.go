@@ -0,0 +1,156 @@
+package api
+
+import (
+	"log/slog"
+
+	"p2p-drive/shared"
+)
+
+// repairRequest asks the repair worker to bring a chunk back in line with
+// its placement policy. LostFrom is tried last when picking a new home.
+type repairRequest struct {
+	ChunkID  string
+	LostFrom string
+}
+
+// RepairProgress is published after the repair worker handles a chunk.
+type RepairProgress struct {
+	FileID    string `json:"file_id"`
+	Path      string `json:"path"`
+	ChunkID   string `json:"chunk_id"`
+	Replicas  int    `json:"replicas"`  // Trusted copies after the repair
+	Satisfied bool   `json:"satisfied"` // The placement policy is met
+	Pending   int    `json:"pending"`   // Repairs still queued
+	Error     string `json:"error,omitempty"`
+}
+
+// QueueRepair schedules a chunk for re-replication without blocking the caller.
+func (s *Server) QueueRepair(req repairRequest) {
+	select {
+	case s.repairs <- req:
+	default:
+		slog.Warn("Repair queue full, dropping repair", "chunk", req.ChunkID)
+	}
+}
+
+// StartRepairWorker drains the repair queue in the background.
+func (s *Server) StartRepairWorker() {
+	go func() {
+		for req := range s.repairs {
+			s.RepairChunk(req)
+		}
+	}()
+}
+
+// dropReplica forgets a copy of a chunk that is known to be bad or gone and
+// queues a repair to replace it.
+func (s *Server) dropReplica(chunkID, deviceID string) {
+	s.removeChunkLocation(chunkID, deviceID)
+	s.QueueRepair(repairRequest{ChunkID: chunkID, LostFrom: deviceID})
+}
+
+// needsRepair reports whether a referenced chunk's trusted replicas fall
+// short of its placement policy.
+func (s *Server) needsRepair(chunkID string) bool {
+	f, err := s.chunkOwner(chunkID)
+	if err != nil {
+		return false
+	}
+	return !s.policyForFile(f.UserID, f.Path).Satisfied(s.trustedHolders(s.chunkHolders(chunkID)))
+}
+
+// RepairChunk copies a healthy replica onto other devices the chunk may be
+// placed on, as allowed by its placement policy, until the policy is
+// satisfied. Copies on low-reputation devices don't count.
+func (s *Server) RepairChunk(req repairRequest) {
+	ctx := backgroundContext()
+	file, err := s.chunkOwner(req.ChunkID)
+	if err != nil {
+		// No file references this chunk anymore; nothing to repair
+		return
+	}
+	policy := s.policyForFile(file.UserID, file.Path)
+
+	holders := s.chunkHolders(req.ChunkID)
+	if policy.Satisfied(s.trustedHolders(holders)) {
+		return
+	}
+	var online []string
+	for _, d := range holders {
+		if d.Online {
+			online = append(online, d.ID)
+		}
+	}
+
+	// 1. Get a verified copy from any surviving replica
+	var data []byte
+	for _, deviceID := range online {
+		d, err := s.fetchChunk(ctx, deviceID, req.ChunkID)
+		if err == nil {
+			data = d
+			break
+		}
+	}
+	if data == nil {
+		slog.ErrorContext(ctx, "Repair: no healthy copy available", "chunk", req.ChunkID)
+		s.publishRepair(file, RepairProgress{ChunkID: req.ChunkID, Error: "no healthy copy available"})
+		return
+	}
+
+	// 2. Place it on devices that don't have it, the one that lost it last.
+	// Re-read holders since verification above may have dropped some.
+	holders = s.chunkHolders(req.ChunkID)
+	devices, err := s.placementDevices(file)
+	if err != nil {
+		return
+	}
+	devices = rankByCapacity(devices, int64(len(data)), nil)
+	held := make(map[string]bool)
+	for _, d := range holders {
+		held[d.ID] = true
+	}
+	holders = s.trustedHolders(holders)
+	var candidates []shared.Device
+	for _, d := range devices {
+		if !held[d.ID] && d.ID != req.LostFrom && !s.lowReputation(d) {
+			candidates = append(candidates, d)
+		}
+	}
+	for _, d := range devices {
+		if !held[d.ID] && d.ID == req.LostFrom && !s.lowReputation(d) {
+			candidates = append(candidates, d)
+		}
+	}
+
+	for _, d := range candidates {
+		if policy.Satisfied(holders) {
+			break
+		}
+		if !policy.Allows(holders, d) || !s.mayPlace(file.UserID, file.TeamID, d, int64(len(data))) {
+			continue
+		}
+		if err := s.storeChunk(ctx, d, req.ChunkID, data); err != nil {
+			slog.WarnContext(ctx, "Repair: store failed", "chunk", req.ChunkID, "device", d.ID, "err", err)
+			continue
+		}
+		slog.InfoContext(ctx, "Repaired chunk", "chunk", req.ChunkID, "device", d.ID)
+		holders = append(holders, d)
+	}
+
+	if !policy.Satisfied(holders) {
+		slog.WarnContext(ctx, "Repair: placement policy still unsatisfied", "chunk", req.ChunkID, "replicas", len(holders))
+	}
+	s.publishRepair(file, RepairProgress{ChunkID: req.ChunkID, Replicas: len(holders), Satisfied: policy.Satisfied(holders)})
+}
+
+// publishRepair sends repair.progress to the owner of the repaired file.
+func (s *Server) publishRepair(file chunkFile, p RepairProgress) {
+	p.FileID, p.Path, p.Pending = file.ID, file.Path, len(s.repairs)
+	s.Events.Publish(Event{Type: EventRepairProgress, UserID: file.UserID, TeamID: file.TeamID, Data: p})
+}
+
+// chunkHolders loads every device recorded as holding a chunk.
+func (s *Server) chunkHolders(chunkID string) []shared.Device {
+	holders, _ := s.queryDevices("WHERE id IN (SELECT device_id FROM chunk_locations WHERE chunk_id = ?)", chunkID)
+	return holders
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"log/slog"
+	"time"
+
+	"p2p-drive/shared"
+)
+
+// Reputation weights. Together they sum to 1, so scores range over 0..1.
+const (
+	weightUptime    = 0.35
+	weightChallenge = 0.25
+	weightRetrieval = 0.25
+	weightLatency   = 0.15
+)
+
+// reputationMinObserved is how long a device must be known before a low
+// score counts against it; newcomers aren't judged on a few readings. It is
+// also the weight of the neutral prior in the uptime score.
+const reputationMinObserved = time.Hour
+
+// smoothedRate is the Laplace-smoothed success rate, 0.5 with no history.
+func smoothedRate(ok, failed int) float64 {
+	return float64(ok+1) / float64(ok+failed+2)
+}
+
+// latencyScore maps an ACK latency to 0..1: 1s scores 0.5, 3s scores 0.25.
+// Devices that have never acknowledged a store are neutral.
+func latencyScore(ms float64) float64 {
+	if ms <= 0 {
+		return 0.5
+	}
+	return 1 / (1 + ms/1000)
+}
+
+// uptimeScore is the device's availability, pulled towards 0.5 while it has
+// been observed for less than about an hour, and reduced by each flap.
+func uptimeScore(d shared.Device) float64 {
+	observed := float64(d.ObservedSeconds)
+	prior := reputationMinObserved.Seconds()
+	score := (d.Availability*observed + 0.5*prior) / (observed + prior)
+	return score / (1 + 0.05*float64(d.Flaps))
+}
+
+// reputationScore combines a device's uptime history, storage challenge
+// results, retrieval success and ACK latency.
+func reputationScore(d shared.Device) float64 {
+	return weightUptime*uptimeScore(d) +
+		weightChallenge*d.Reliability +
+		weightRetrieval*smoothedRate(d.RetrievalsOK, d.RetrievalsFailed) +
+		weightLatency*latencyScore(d.AckLatencyMs)
+}
+
+// lowReputation reports whether a device has been observed long enough and
+// scores below the server's minimum. Its replicas don't count towards
+// placement policies, so repair places trusted copies elsewhere.
+func (s *Server) lowReputation(d shared.Device) bool {
+	return s.MinReputation > 0 && d.ObservedSeconds >= int64(reputationMinObserved/time.Second) && d.Reputation < s.MinReputation
+}
+
+// trustedHolders filters out low-reputation devices and devices offline for
+// longer than RepairAfter.
+func (s *Server) trustedHolders(holders []shared.Device) []shared.Device {
+	var trusted []shared.Device
+	for _, d := range holders {
+		gone := !d.Online && s.Liveness.RepairAfter > 0 && time.Since(d.LastSeen) > s.Liveness.RepairAfter
+		if !s.lowReputation(d) && !gone {
+			trusted = append(trusted, d)
+		}
+	}
+	return trusted
+}
+
+// recordAckLatency folds a store acknowledgement time into the device's
+// moving average.
+func (s *Server) recordAckLatency(deviceID string, latency time.Duration) {
+	ms := float64(latency) / float64(time.Millisecond)
+	s.DB.Exec(`UPDATE devices SET ack_latency_ms = CASE WHEN ack_latency_ms IS NULL THEN ?
+		ELSE ack_latency_ms * 0.8 + ? * 0.2 END WHERE id = ?`, ms, ms, deviceID)
+}
+
+// recordRetrieval counts a chunk retrieval from a device.
+func (s *Server) recordRetrieval(deviceID string, ok bool) {
+	if ok {
+		s.DB.Exec("UPDATE devices SET retrievals_ok = retrievals_ok + 1 WHERE id = ?", deviceID)
+	} else {
+		s.DB.Exec("UPDATE devices SET retrievals_failed = retrievals_failed + 1 WHERE id = ?", deviceID)
+	}
+}
+
+// StartReputationWorker periodically queues repair for chunks whose copies
+// on low-reputation devices leave them short of their placement policy.
+func (s *Server) StartReputationWorker(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			s.replicateFromLowReputation()
+		}
+	}()
+}
+
+func (s *Server) replicateFromLowReputation() {
+	if s.MinReputation <= 0 {
+		return
+	}
+	devices, err := s.queryDevices("WHERE user_id IS NOT NULL")
+	if err != nil {
+		return
+	}
+	for _, d := range devices {
+		if !s.lowReputation(d) || d.ChunkCount == 0 {
+			continue
+		}
+		rows, err := s.DB.Query("SELECT chunk_id FROM chunk_locations WHERE device_id = ?", d.ID)
+		if err != nil {
+			continue
+		}
+		var chunkIDs []string
+		for rows.Next() {
+			var id string
+			rows.Scan(&id)
+			chunkIDs = append(chunkIDs, id)
+		}
+		rows.Close()
+
+		queued := 0
+		for _, chunkID := range chunkIDs {
+			if s.needsRepair(chunkID) {
+				s.QueueRepair(repairRequest{ChunkID: chunkID, LostFrom: d.ID})
+				queued++
+			}
+		}
+		if queued > 0 {
+			slog.Warn("Low reputation device, re-replicating its chunks", "device", d.ID, "reputation", d.Reputation, "chunks", queued)
+		}
+	}
+}
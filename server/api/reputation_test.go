@@ -0,0 +1,91 @@
+package api
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"p2p-drive/shared"
+)
+
+func TestUptimeScore(t *testing.T) {
+	hour := int64(time.Hour / time.Second)
+	month := int64(uptimeWindow / time.Second)
+	tests := []struct {
+		name         string
+		availability float64
+		observed     int64
+		flaps        int
+		want         float64
+	}{
+		{"never seen", 0, 0, 0, 0.5},
+		{"new and always online", 1, 60, 0, (60 + 1800.0) / (60 + 3600)},
+		{"an hour, always online", 1, hour, 0, 0.75},
+		{"an hour, never online", 0, hour, 0, 0.25},
+		{"half the time", 0.5, month, 0, 0.5},
+		{"a month, always online", 1, month, 0, (float64(month) + 1800) / (float64(month) + 3600)},
+		{"a month, never online", 0, month, 0, 1800 / (float64(month) + 3600)},
+		{"two flaps", 1, hour, 2, 0.75 / 1.1},
+		{"twenty flaps", 1, hour, 20, 0.75 / 2},
+	}
+	for _, tt := range tests {
+		d := shared.Device{Availability: tt.availability, ObservedSeconds: tt.observed, Flaps: tt.flaps}
+		if got := uptimeScore(d); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: uptimeScore = %f, want %f", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReputationScore(t *testing.T) {
+	month := int64(uptimeWindow / time.Second)
+	tests := []struct {
+		name     string
+		dev      shared.Device
+		min, max float64
+	}{
+		{
+			name: "new device is neutral",
+			dev:  shared.Device{Reliability: reliabilityScore(0, 0)},
+			min:  0.5, max: 0.5,
+		},
+		{
+			name: "dependable device",
+			dev: shared.Device{Availability: 1, ObservedSeconds: month, Reliability: reliabilityScore(100, 0),
+				RetrievalsOK: 100, AckLatencyMs: 50},
+			min: 0.95, max: 1,
+		},
+		{
+			name: "unreliable device",
+			dev: shared.Device{Availability: 0.1, ObservedSeconds: month, Flaps: 30, Reliability: reliabilityScore(0, 20),
+				RetrievalsFailed: 20, AckLatencyMs: 10000},
+			min: 0, max: 0.1,
+		},
+	}
+	for _, tt := range tests {
+		if got := reputationScore(tt.dev); got < tt.min-1e-9 || got > tt.max+1e-9 {
+			t.Errorf("%s: reputationScore = %f, want between %.2f and %.2f", tt.name, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestLowReputation(t *testing.T) {
+	hour := int64(reputationMinObserved / time.Second)
+	s := &Server{MinReputation: 0.3}
+	tests := []struct {
+		name string
+		min  float64
+		dev  shared.Device
+		want bool
+	}{
+		{"scores low", 0.3, shared.Device{ObservedSeconds: hour, Reputation: 0.2}, true},
+		{"scores well", 0.3, shared.Device{ObservedSeconds: hour, Reputation: 0.4}, false},
+		{"not observed long enough", 0.3, shared.Device{ObservedSeconds: hour - 1, Reputation: 0.1}, false},
+		{"check turned off", 0, shared.Device{ObservedSeconds: hour, Reputation: 0.1}, false},
+	}
+	for _, tt := range tests {
+		s.MinReputation = tt.min
+		if got := s.lowReputation(tt.dev); got != tt.want {
+			t.Errorf("%s: lowReputation = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
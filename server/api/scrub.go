@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"p2p-drive/shared"
+)
+
+// ListDeviceChunks returns the chunk IDs recorded for a device so its
+// scrubber can detect chunks that have gone missing.
+func (s *Server) ListDeviceChunks(w http.ResponseWriter, r *http.Request) {
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" {
+		http.Error(w, "Missing 'device_id' param", http.StatusBadRequest)
+		return
+	}
+	if deviceID != r.Header.Get(shared.HeaderDeviceID) {
+		http.Error(w, "Can only list your own chunks", http.StatusForbidden)
+		return
+	}
+
+	rows, err := s.DB.Query("SELECT chunk_id FROM chunk_locations WHERE device_id = ?", deviceID)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	json.NewEncoder(w).Encode(ids)
+}
+
+// ReportChunkHealth receives scrub results from an agent. Every corrupt or
+// missing chunk loses its location on that device and is queued for repair.
+func (s *Server) ReportChunkHealth(w http.ResponseWriter, r *http.Request) {
+	var report shared.ChunkHealthReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	report.DeviceID = r.Header.Get(shared.HeaderDeviceID)
+
+	bad := append(report.Corrupt, report.Missing...)
+	if len(bad) > 0 {
+		slog.WarnContext(r.Context(), "Device reported bad chunks", "device", report.DeviceID, "corrupt", len(report.Corrupt), "missing", len(report.Missing))
+	}
+	for _, chunkID := range bad {
+		var exists int
+		s.DB.QueryRow("SELECT 1 FROM chunk_locations WHERE chunk_id = ? AND device_id = ?", chunkID, report.DeviceID).Scan(&exists)
+		if exists == 1 {
+			s.dropReplica(chunkID, report.DeviceID)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// StartScrubber periodically verifies chunks held in Google Drive. Agent
+// devices scrub themselves; Drive is only reachable through the server.
+func (s *Server) StartScrubber(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for range ticker.C {
+			s.scrubGDrive()
+		}
+	}()
+}
+
+func (s *Server) scrubGDrive() {
+	ctx := backgroundContext()
+	rows, err := s.DB.Query(`
+		SELECT cl.chunk_id, cl.device_id FROM chunk_locations cl
+		JOIN devices d ON d.id = cl.device_id
+		WHERE d.type = 'gdrive'`)
+	if err != nil {
+		slog.ErrorContext(ctx, "Scrub: DB error", "err", err)
+		return
+	}
+	type location struct{ chunkID, deviceID string }
+	var locs []location
+	for rows.Next() {
+		var l location
+		if err := rows.Scan(&l.chunkID, &l.deviceID); err == nil {
+			locs = append(locs, l)
+		}
+	}
+	rows.Close()
+
+	failed := 0
+	for _, l := range locs {
+		// fetchChunk drops and queues repair for copies that fail verification
+		if _, err := s.fetchChunk(ctx, l.deviceID, l.chunkID); err != nil {
+			failed++
+		}
+	}
+	slog.InfoContext(ctx, "GDrive scrub complete", "checked", len(locs), "failed", failed)
+}
@@ -0,0 +1,383 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"p2p-drive/shared"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const shareTokenPrefix = "gs_" // Distinguishes share links from API tokens
+
+// Wrong passwords for a link lock it for a while, so a leaked link can't be
+// brute-forced
+const (
+	sharePasswordAttempts = 10
+	sharePasswordLockout  = 15 * time.Minute
+)
+
+// ShareLink is a public link to a file or folder. The token is only
+// returned once, when the link is created.
+type ShareLink struct {
+	ID           string     `json:"id"`
+	FileID       string     `json:"file_id,omitempty"`
+	Folder       string     `json:"folder,omitempty"`
+	TeamID       string     `json:"team_id,omitempty"`
+	Name         string     `json:"name"` // File path or folder shown to recipients
+	HasPassword  bool       `json:"has_password"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxDownloads int        `json:"max_downloads,omitempty"` // 0 = unlimited
+	Downloads    int        `json:"downloads"`
+	CreatedAt    time.Time  `json:"created_at"`
+	Token        string     `json:"token,omitempty"`
+	URL          string     `json:"url,omitempty"`
+}
+
+// CreateShareRequest
+type CreateShareRequest struct {
+	FileID       string `json:"file_id"` // Either a file...
+	Folder       string `json:"folder"`  // ...or a folder
+	TeamID       string `json:"team_id"` // Folder of a team's shared space
+	Password     string `json:"password"`
+	ExpiresIn    int    `json:"expires_in_hours"` // 0 = never
+	MaxDownloads int    `json:"max_downloads"`    // 0 = unlimited
+}
+
+// shareColumns is the column list read by scanShare.
+const shareColumns = `id, user_id, COALESCE(file_id, ''), COALESCE(folder, ''), COALESCE(team_id, ''),
+	COALESCE(password_hash, ''), COALESCE(expires_at, ''), COALESCE(max_downloads, 0), COALESCE(downloads, 0), created_at`
+
+type shareRow struct {
+	ShareLink
+	userID       string
+	passwordHash string
+}
+
+func scanShare(row interface{ Scan(...interface{}) error }) (*shareRow, error) {
+	var sh shareRow
+	var expires, created string
+	err := row.Scan(&sh.ID, &sh.userID, &sh.FileID, &sh.Folder, &sh.TeamID,
+		&sh.passwordHash, &expires, &sh.MaxDownloads, &sh.Downloads, &created)
+	if err != nil {
+		return nil, err
+	}
+	sh.HasPassword = sh.passwordHash != ""
+	sh.ExpiresAt = parseOptionalTime(expires)
+	sh.CreatedAt, _ = time.Parse(time.RFC3339, created)
+	return &sh, nil
+}
+
+// expired reports whether the link can no longer be used.
+func (sh *shareRow) expired(now time.Time) bool {
+	if sh.ExpiresAt != nil && now.After(*sh.ExpiresAt) {
+		return true
+	}
+	return sh.MaxDownloads > 0 && sh.Downloads >= sh.MaxDownloads
+}
+
+// HandleShares lists the caller's active links (GET), creates a link (POST)
+// or revokes one (DELETE ?id=). Only those who may delete a file may share it.
+func (s *Server) HandleShares(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := s.DB.Query("SELECT "+shareColumns+" FROM share_links WHERE user_id = ? ORDER BY created_at DESC", userID)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		now := time.Now()
+		links := []ShareLink{}
+		for rows.Next() {
+			sh, err := scanShare(rows)
+			if err != nil || sh.expired(now) {
+				continue
+			}
+			sh.Name = s.shareName(sh)
+			links = append(links, sh.ShareLink)
+		}
+		json.NewEncoder(w).Encode(links)
+
+	case http.MethodPost:
+		var req CreateShareRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.ExpiresIn < 0 || req.MaxDownloads < 0 {
+			http.Error(w, "Invalid expiry or download limit", http.StatusBadRequest)
+			return
+		}
+
+		sh := &shareRow{userID: userID}
+		switch {
+		case req.FileID != "" && req.Folder == "":
+			if _, _, canWrite, err := s.fileAccess(req.FileID, userID); err != nil || !canWrite {
+				http.Error(w, "File not found or unauthorized", http.StatusNotFound)
+				return
+			}
+			sh.FileID = req.FileID
+		case req.FileID == "" && req.Folder != "":
+			if req.TeamID != "" && !teamRoleAtLeast(s.teamRole(req.TeamID, userID), TeamEditor) {
+				http.Error(w, "Team not found or not an editor", http.StatusNotFound)
+				return
+			}
+			sh.Folder = normalizeFolder(req.Folder)
+			sh.TeamID = req.TeamID
+		default:
+			http.Error(w, "Give either file_id or folder", http.StatusBadRequest)
+			return
+		}
+
+		if req.Password != "" {
+			hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+			if err != nil {
+				http.Error(w, "Server Error", http.StatusInternalServerError)
+				return
+			}
+			sh.passwordHash = string(hash)
+			sh.HasPassword = true
+		}
+
+		now := time.Now().UTC()
+		sh.ID = uuid.New().String()
+		sh.CreatedAt = now
+		sh.MaxDownloads = req.MaxDownloads
+		sh.Token = shareTokenPrefix + generateToken()
+		sh.URL = "/share.html#" + sh.Token
+		var expires string
+		if req.ExpiresIn > 0 {
+			e := now.Add(time.Duration(req.ExpiresIn) * time.Hour)
+			sh.ExpiresAt = &e
+			expires = e.Format(time.RFC3339)
+		}
+
+		_, err := s.DB.Exec(`INSERT INTO share_links (id, user_id, token_hash, file_id, folder, team_id, password_hash, expires_at, max_downloads, downloads, created_at)
+			VALUES (?, ?, ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?, 0, ?)`,
+			sh.ID, userID, hashToken(sh.Token), sh.FileID, sh.Folder, sh.TeamID, sh.passwordHash, expires,
+			sh.MaxDownloads, now.Format(time.RFC3339))
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		sh.Name = s.shareName(sh)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(sh.ShareLink)
+
+	case http.MethodDelete:
+		res, err := s.DB.Exec("DELETE FROM share_links WHERE id = ? AND user_id = ?", r.URL.Query().Get("id"), userID)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Link not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// shareName is the label recipients see: the file path or folder.
+func (s *Server) shareName(sh *shareRow) string {
+	if sh.FileID == "" {
+		return sh.Folder
+	}
+	var path string
+	s.DB.QueryRow("SELECT path FROM files WHERE id = ?", sh.FileID).Scan(&path)
+	return path
+}
+
+// openShare resolves the token and password of a public request. It writes
+// the error response and returns nil if the link can't be used.
+func (s *Server) openShare(w http.ResponseWriter, r *http.Request) *shareRow {
+	token := r.Header.Get("X-Share-Token")
+	if token == "" {
+		token = r.FormValue("token")
+	}
+	sh, err := scanShare(s.DB.QueryRow("SELECT "+shareColumns+" FROM share_links WHERE token_hash = ?", hashToken(token)))
+	if err != nil {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return nil
+	}
+	if sh.expired(time.Now()) {
+		http.Error(w, "Link expired", http.StatusGone)
+		return nil
+	}
+	// Links stop working while their creator is suspended
+	var suspended bool
+	s.DB.QueryRow("SELECT COALESCE(suspended, 0) FROM users WHERE id = ?", sh.userID).Scan(&suspended)
+	if suspended {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return nil
+	}
+	if sh.HasPassword {
+		password := r.Header.Get("X-Share-Password")
+		if password == "" {
+			password = r.FormValue("password")
+		}
+		if !s.attemptSharePassword(w, sh, password) {
+			return nil
+		}
+	}
+	return sh
+}
+
+// attemptSharePassword checks a link's password, counting failures. Too many
+// lock the link's password for sharePasswordLockout. It writes the refusal
+// itself when it returns false.
+func (s *Server) attemptSharePassword(w http.ResponseWriter, sh *shareRow, password string) bool {
+	refuse := func() bool {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"password_required":true}`))
+		return false
+	}
+	// Asking for the password isn't a wrong guess
+	if password == "" {
+		return refuse()
+	}
+
+	now := time.Now().UTC()
+	var lockedStr string
+	s.DB.QueryRow("SELECT COALESCE(password_locked_until, '') FROM share_links WHERE id = ?", sh.ID).Scan(&lockedStr)
+	if locked, err := time.Parse(time.RFC3339, lockedStr); err == nil && now.Before(locked) {
+		http.Error(w, "Too many wrong passwords, try again later", http.StatusTooManyRequests)
+		return false
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(sh.passwordHash), []byte(password)) == nil {
+		s.DB.Exec("UPDATE share_links SET password_failures = 0, password_locked_until = NULL WHERE id = ?", sh.ID)
+		return true
+	}
+
+	var failures int
+	s.DB.QueryRow("UPDATE share_links SET password_failures = COALESCE(password_failures, 0) + 1 WHERE id = ? RETURNING password_failures", sh.ID).Scan(&failures)
+	if failures >= sharePasswordAttempts {
+		s.DB.Exec("UPDATE share_links SET password_failures = 0, password_locked_until = ? WHERE id = ?", now.Add(sharePasswordLockout).Format(time.RFC3339), sh.ID)
+		slog.Warn("Share link locked after repeated wrong passwords", "share", sh.ID)
+	}
+	return refuse()
+}
+
+// sharedFiles lists the files a link exposes. Access is re-checked against
+// the link's creator, so links die with their rights to the files.
+func (s *Server) sharedFiles(sh *shareRow) ([]shared.FileMetadata, error) {
+	if sh.FileID != "" {
+		path, size, canWrite, err := s.fileAccess(sh.FileID, sh.userID)
+		if err != nil || !canWrite {
+			return nil, err
+		}
+		return []shared.FileMetadata{{ID: sh.FileID, Path: path, Size: size}}, nil
+	}
+
+	where, owner := "user_id = ? AND COALESCE(team_id, '') = ''", sh.userID
+	if sh.TeamID != "" {
+		if !teamRoleAtLeast(s.teamRole(sh.TeamID, sh.userID), TeamEditor) {
+			return nil, nil
+		}
+		where, owner = "team_id = ?", sh.TeamID
+	}
+	// Byte range on the prefix: everything under "folder/" sorts before "folder0"
+	rows, err := s.DB.Query("SELECT id, path, COALESCE(size, 0), updated_at FROM files WHERE "+where+
+		" AND path >= ? AND path < ? ORDER BY path", owner, sh.Folder+"/", sh.Folder+"0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []shared.FileMetadata
+	for rows.Next() {
+		var f shared.FileMetadata
+		var updatedStr string
+		rows.Scan(&f.ID, &f.Path, &f.Size, &updatedStr)
+		f.UpdatedAt, _ = time.Parse(time.RFC3339, updatedStr)
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// PublicShare describes a link to its recipient (no account needed).
+// GET ?token=, with the password in X-Share-Password when the link has one.
+func (s *Server) PublicShare(w http.ResponseWriter, r *http.Request) {
+	sh := s.openShare(w, r)
+	if sh == nil {
+		return
+	}
+	files, err := s.sharedFiles(sh)
+	if err != nil || (sh.FileID != "" && len(files) == 0) {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+	if files == nil {
+		files = []shared.FileMetadata{}
+	}
+
+	info := struct {
+		Name          string                `json:"name"`
+		Folder        bool                  `json:"folder"`
+		ExpiresAt     *time.Time            `json:"expires_at,omitempty"`
+		DownloadsLeft *int                  `json:"downloads_left,omitempty"`
+		Files         []shared.FileMetadata `json:"files"`
+	}{Name: s.shareName(sh), Folder: sh.FileID == "", ExpiresAt: sh.ExpiresAt, Files: files}
+	if sh.MaxDownloads > 0 {
+		left := sh.MaxDownloads - sh.Downloads
+		info.DownloadsLeft = &left
+	}
+	json.NewEncoder(w).Encode(info)
+}
+
+// PublicShareDownload streams a shared file (?token=, plus &id= for folder
+// links). Each download counts against the link's limit. POST is accepted
+// so a browser form can send the password without putting it in the URL.
+func (s *Server) PublicShareDownload(w http.ResponseWriter, r *http.Request) {
+	sh := s.openShare(w, r)
+	if sh == nil {
+		return
+	}
+	files, err := s.sharedFiles(sh)
+	if err != nil {
+		http.Error(w, "Link not found", http.StatusNotFound)
+		return
+	}
+	fileID := r.FormValue("id")
+	if sh.FileID != "" {
+		fileID = sh.FileID
+	}
+	var file *shared.FileMetadata
+	for i := range files {
+		if files[i].ID == fileID {
+			file = &files[i]
+			break
+		}
+	}
+	if file == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Claim a download atomically so concurrent requests can't exceed the limit
+	res, err := s.DB.Exec(`UPDATE share_links SET downloads = downloads + 1
+		WHERE id = ? AND (COALESCE(max_downloads, 0) = 0 OR downloads < max_downloads)`, sh.ID)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Link expired", http.StatusGone)
+		return
+	}
+
+	s.streamFile(r.Context(), w, file.ID, file.Path, file.Size)
+}
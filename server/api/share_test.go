@@ -0,0 +1,95 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"p2p-drive/server/db"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSharePasswordAttempts(t *testing.T) {
+	database := db.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	defer database.Close()
+	s := &Server{DB: database}
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("right"), bcrypt.MinCost)
+	newShare := func() (id, token string) {
+		id, token = generateToken(), shareTokenPrefix+generateToken()
+		database.Exec("INSERT INTO share_links (id, user_id, token_hash, file_id, password_hash, created_at) VALUES (?, 'owner', ?, 'file', ?, ?)",
+			id, hashToken(token), string(hash), time.Now().Format(time.RFC3339))
+		return id, token
+	}
+	open := func(token, password string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/share", nil)
+		req.Header.Set("X-Share-Token", token)
+		if password != "" {
+			req.Header.Set("X-Share-Password", password)
+		}
+		rec := httptest.NewRecorder()
+		if s.openShare(rec, req) != nil {
+			return http.StatusOK
+		}
+		return rec.Code
+	}
+
+	t.Run("wrong passwords lock the link", func(t *testing.T) {
+		_, token := newShare()
+		type step struct {
+			password string
+			want     int
+		}
+		steps := []step{
+			{"", http.StatusUnauthorized}, // Asking for the password
+			{"right", http.StatusOK},
+		}
+		for i := 0; i < sharePasswordAttempts; i++ {
+			steps = append(steps, step{"wrong", http.StatusUnauthorized})
+		}
+		steps = append(steps, step{"right", http.StatusTooManyRequests})
+		for i, st := range steps {
+			if got := open(token, st.password); got != st.want {
+				t.Fatalf("attempt %d with %q: status %d, want %d", i, st.password, got, st.want)
+			}
+		}
+	})
+
+	t.Run("empty passwords aren't counted", func(t *testing.T) {
+		_, token := newShare()
+		for i := 0; i < sharePasswordAttempts+1; i++ {
+			open(token, "")
+		}
+		if got := open(token, "right"); got != http.StatusOK {
+			t.Errorf("right password: status %d, want %d", got, http.StatusOK)
+		}
+	})
+
+	t.Run("success resets the count", func(t *testing.T) {
+		_, token := newShare()
+		for i := 0; i < sharePasswordAttempts-1; i++ {
+			open(token, "wrong")
+		}
+		if got := open(token, "right"); got != http.StatusOK {
+			t.Fatalf("right password: status %d", got)
+		}
+		open(token, "wrong")
+		if got := open(token, "right"); got != http.StatusOK {
+			t.Errorf("link locked although the count was reset: status %d", got)
+		}
+	})
+
+	t.Run("the lock lapses", func(t *testing.T) {
+		id, token := newShare()
+		for i := 0; i < sharePasswordAttempts; i++ {
+			open(token, "wrong")
+		}
+		database.Exec("UPDATE share_links SET password_locked_until = ? WHERE id = ?", time.Now().Add(-time.Second).Format(time.RFC3339), id)
+		if got := open(token, "right"); got != http.StatusOK {
+			t.Errorf("right password after the lock: status %d, want %d", got, http.StatusOK)
+		}
+	})
+}
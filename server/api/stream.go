@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// streamKeepAlive is how often an idle event stream gets a comment line, so
+// proxies don't close it. The user's team memberships are re-read as often.
+const streamKeepAlive = 25 * time.Second
+
+// StreamEvents pushes the caller's events from the event bus as
+// Server-Sent Events: their devices going online or offline, upload
+// progress, files created or deleted, rebalance and repair progress and
+// quota warnings. Team file events go to every member of the team. Each
+// event is sent with its type as the SSE event name and the Event as JSON
+// data.
+func (s *Server) StreamEvents(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Filter at the bus, so other users' traffic never fills this buffer
+	var teams atomic.Pointer[map[string]bool]
+	teams.Store(s.memberTeams(userID))
+	events, unsubscribe := s.Events.Subscribe(64, func(e Event) bool {
+		return e.UserID == userID || (e.TeamID != "" && (*teams.Load())[e.TeamID])
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			teams.Store(s.memberTeams(userID))
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+// memberTeams returns the set of teams a user belongs to.
+func (s *Server) memberTeams(userID string) *map[string]bool {
+	teams := make(map[string]bool)
+	rows, err := s.DB.Query("SELECT team_id FROM team_members WHERE user_id = ?", userID)
+	if err == nil {
+		for rows.Next() {
+			var id string
+			rows.Scan(&id)
+			teams[id] = true
+		}
+		rows.Close()
+	}
+	return &teams
+}
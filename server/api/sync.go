@@ -27,7 +27,8 @@ func (s *Server) GetDeletions(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := s.DB.Query("SELECT file_id, chunk_ids, deleted_at FROM deleted_files WHERE deleted_at > ?", since.Format(time.RFC3339))
+	ownerID := r.Header.Get(headerDeviceOwner)
+	rows, err := s.DB.Query("SELECT file_id, chunk_ids, deleted_at FROM deleted_files WHERE user_id = ? AND deleted_at > ?", ownerID, since.Format(time.RFC3339))
 	if err != nil {
 		http.Error(w, "DB Error", http.StatusInternalServerError)
 		return
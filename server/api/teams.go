@@ -0,0 +1,456 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"p2p-drive/shared"
+
+	"github.com/google/uuid"
+)
+
+// Team member roles, from least to most privileged. Viewers list and
+// download the shared folder, editors also upload and delete, owners also
+// manage members and the device pool.
+const (
+	TeamViewer = "viewer"
+	TeamEditor = "editor"
+	TeamOwner  = "owner"
+)
+
+var teamRoleRank = map[string]int{TeamViewer: 1, TeamEditor: 2, TeamOwner: 3}
+
+// teamRoleAtLeast reports whether role grants at least min. The empty role
+// (not a member) grants nothing.
+func teamRoleAtLeast(role, min string) bool {
+	return teamRoleRank[role] > 0 && teamRoleRank[role] >= teamRoleRank[min]
+}
+
+// Team is a team as seen by one of its members.
+type Team struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Role      string `json:"role"` // The caller's role
+	Members   int    `json:"members"`
+	Devices   int    `json:"devices"` // Devices in the shared pool
+	Files     int    `json:"files"`
+	CreatedAt string `json:"created_at"`
+}
+
+// TeamMember is one member of a team.
+type TeamMember struct {
+	UserID  string `json:"user_id"`
+	Email   string `json:"email"`
+	Role    string `json:"role"`
+	AddedAt string `json:"added_at"`
+}
+
+// MemberUsage is one member's share of a team's storage.
+type MemberUsage struct {
+	UserID        string `json:"user_id"`
+	Email         string `json:"email"`
+	Role          string `json:"role"`
+	Files         int    `json:"files"`          // Team files uploaded
+	LogicalBytes  int64  `json:"logical_bytes"`  // Size of those files
+	PhysicalBytes int64  `json:"physical_bytes"` // Including every replica
+	PoolDevices   int    `json:"pool_devices"`   // Devices contributed to the pool
+	HostedBytes   int64  `json:"hosted_bytes"`   // Team data stored on those devices
+}
+
+// teamRole returns the user's role in the team, or "" if not a member.
+func (s *Server) teamRole(teamID, userID string) string {
+	var role string
+	s.DB.QueryRow("SELECT role FROM team_members WHERE team_id = ? AND user_id = ?", teamID, userID).Scan(&role)
+	return role
+}
+
+// fileAccess resolves a file the user may read: their own personal file, or
+// a file in one of their teams. canWrite is set when they may also delete it.
+func (s *Server) fileAccess(fileID, userID string) (path string, size int64, canWrite bool, err error) {
+	var ownerID, teamID string
+	err = s.DB.QueryRow("SELECT path, COALESCE(size, 0), user_id, COALESCE(team_id, '') FROM files WHERE id = ?", fileID).
+		Scan(&path, &size, &ownerID, &teamID)
+	if err != nil {
+		return
+	}
+	if teamID == "" {
+		if ownerID != userID {
+			err = sql.ErrNoRows
+		}
+		return path, size, ownerID == userID, err
+	}
+	role := s.teamRole(teamID, userID)
+	if role == "" {
+		return "", 0, false, sql.ErrNoRows
+	}
+	return path, size, teamRoleAtLeast(role, TeamEditor), nil
+}
+
+// HandleTeams lists the caller's teams (GET), creates a team owned by the
+// caller (POST {name}) or deletes an empty team (DELETE ?id=, owners only).
+func (s *Server) HandleTeams(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := s.DB.Query(`
+			SELECT t.id, t.name, m.role, COALESCE(t.created_at, ''),
+				(SELECT COUNT(*) FROM team_members tm WHERE tm.team_id = t.id),
+				(SELECT COUNT(*) FROM devices d WHERE d.team_id = t.id),
+				(SELECT COUNT(*) FROM files f WHERE f.team_id = t.id)
+			FROM teams t JOIN team_members m ON m.team_id = t.id
+			WHERE m.user_id = ? ORDER BY t.name`, userID)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		teams := []Team{}
+		for rows.Next() {
+			var t Team
+			if err := rows.Scan(&t.ID, &t.Name, &t.Role, &t.CreatedAt, &t.Members, &t.Devices, &t.Files); err == nil {
+				teams = append(teams, t)
+			}
+		}
+		json.NewEncoder(w).Encode(teams)
+
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid body", http.StatusBadRequest)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			http.Error(w, "Team name required", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now().Format(time.RFC3339)
+		t := Team{ID: uuid.New().String(), Name: req.Name, Role: TeamOwner, Members: 1, CreatedAt: now}
+		tx, err := s.DB.Begin()
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		tx.Exec("INSERT INTO teams (id, name, created_at) VALUES (?, ?, ?)", t.ID, t.Name, now)
+		tx.Exec("INSERT INTO team_members (team_id, user_id, role, added_at) VALUES (?, ?, ?, ?)", t.ID, userID, TeamOwner, now)
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(t)
+
+	case http.MethodDelete:
+		teamID := r.URL.Query().Get("id")
+		if s.teamRole(teamID, userID) != TeamOwner {
+			http.Error(w, "Team not found or not an owner", http.StatusNotFound)
+			return
+		}
+		var files int
+		s.DB.QueryRow("SELECT COUNT(*) FROM files WHERE team_id = ?", teamID).Scan(&files)
+		if files > 0 {
+			http.Error(w, "Delete the team's files first", http.StatusConflict)
+			return
+		}
+		s.DB.Exec("UPDATE devices SET team_id = NULL WHERE team_id = ?", teamID)
+		s.DB.Exec("DELETE FROM team_members WHERE team_id = ?", teamID)
+		s.DB.Exec("DELETE FROM usage_counters WHERE kind = ? AND owner_id = ?", usageTeam, teamID)
+		s.DB.Exec("DELETE FROM teams WHERE id = ?", teamID)
+		w.Write([]byte(`{"status":"deleted"}`))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleTeamMembers lists members (GET ?team_id=), adds a member or changes
+// a role (POST {team_id, email, role}, owners only) and removes a member
+// (DELETE ?team_id=&user_id=, owners, or anyone leaving). A team always keeps
+// at least one owner.
+func (s *Server) HandleTeamMembers(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	switch r.Method {
+	case http.MethodGet:
+		teamID := r.URL.Query().Get("team_id")
+		if s.teamRole(teamID, userID) == "" {
+			http.Error(w, "Team not found", http.StatusNotFound)
+			return
+		}
+		rows, err := s.DB.Query(`
+			SELECT m.user_id, u.email, m.role, COALESCE(m.added_at, '') FROM team_members m
+			JOIN users u ON u.id = m.user_id
+			WHERE m.team_id = ? ORDER BY m.added_at`, teamID)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		members := []TeamMember{}
+		for rows.Next() {
+			var m TeamMember
+			if err := rows.Scan(&m.UserID, &m.Email, &m.Role, &m.AddedAt); err == nil {
+				members = append(members, m)
+			}
+		}
+		json.NewEncoder(w).Encode(members)
+
+	case http.MethodPost:
+		var req struct {
+			TeamID string `json:"team_id"`
+			Email  string `json:"email"`
+			Role   string `json:"role"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid body", http.StatusBadRequest)
+			return
+		}
+		if teamRoleRank[req.Role] == 0 {
+			http.Error(w, "Role must be owner, editor or viewer", http.StatusBadRequest)
+			return
+		}
+		if s.teamRole(req.TeamID, userID) != TeamOwner {
+			http.Error(w, "Team not found or not an owner", http.StatusNotFound)
+			return
+		}
+		var memberID string
+		if err := s.DB.QueryRow("SELECT id FROM users WHERE email = ?", req.Email).Scan(&memberID); err != nil {
+			http.Error(w, "No user with that email", http.StatusNotFound)
+			return
+		}
+		if req.Role != TeamOwner && s.isLastOwner(req.TeamID, memberID) {
+			http.Error(w, "A team needs at least one owner", http.StatusConflict)
+			return
+		}
+		_, err := s.DB.Exec(`INSERT INTO team_members (team_id, user_id, role, added_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(team_id, user_id) DO UPDATE SET role = excluded.role`,
+			req.TeamID, memberID, req.Role, time.Now().Format(time.RFC3339))
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		// Viewers can't contribute storage
+		if req.Role == TeamViewer {
+			s.withdrawPoolDevices("WHERE team_id = ? AND user_id = ?", req.TeamID, memberID)
+		}
+		w.Write([]byte(`{"status":"ok"}`))
+
+	case http.MethodDelete:
+		teamID := r.URL.Query().Get("team_id")
+		memberID := r.URL.Query().Get("user_id")
+		if memberID != userID && s.teamRole(teamID, userID) != TeamOwner {
+			http.Error(w, "Team not found or not an owner", http.StatusNotFound)
+			return
+		}
+		if s.isLastOwner(teamID, memberID) {
+			http.Error(w, "A team needs at least one owner", http.StatusConflict)
+			return
+		}
+		res, err := s.DB.Exec("DELETE FROM team_members WHERE team_id = ? AND user_id = ?", teamID, memberID)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Member not found", http.StatusNotFound)
+			return
+		}
+		s.withdrawPoolDevices("WHERE team_id = ? AND user_id = ?", teamID, memberID)
+		w.Write([]byte(`{"status":"removed"}`))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// isLastOwner reports whether the user is the team's only owner.
+func (s *Server) isLastOwner(teamID, userID string) bool {
+	if s.teamRole(teamID, userID) != TeamOwner {
+		return false
+	}
+	var owners int
+	s.DB.QueryRow("SELECT COUNT(*) FROM team_members WHERE team_id = ? AND role = ?", teamID, TeamOwner).Scan(&owners)
+	return owners <= 1
+}
+
+// HandleTeamDevices lists a team's device pool (GET ?team_id=), adds one of
+// the caller's devices to it (POST {team_id, device_id}, editors and owners)
+// or withdraws a device (DELETE ?device_id=, its owner or a team owner).
+func (s *Server) HandleTeamDevices(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	switch r.Method {
+	case http.MethodGet:
+		teamID := r.URL.Query().Get("team_id")
+		if s.teamRole(teamID, userID) == "" {
+			http.Error(w, "Team not found", http.StatusNotFound)
+			return
+		}
+		devices, err := s.queryDevices("WHERE team_id = ?", teamID)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		if devices == nil {
+			devices = []shared.Device{}
+		}
+		json.NewEncoder(w).Encode(devices)
+
+	case http.MethodPost:
+		var req struct {
+			TeamID   string `json:"team_id"`
+			DeviceID string `json:"device_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid body", http.StatusBadRequest)
+			return
+		}
+		if !teamRoleAtLeast(s.teamRole(req.TeamID, userID), TeamEditor) {
+			http.Error(w, "Team not found or not an editor", http.StatusNotFound)
+			return
+		}
+		var current string
+		if err := s.DB.QueryRow("SELECT COALESCE(team_id, '') FROM devices WHERE id = ? AND user_id = ?", req.DeviceID, userID).Scan(&current); err != nil {
+			http.Error(w, "Device not found or unauthorized", http.StatusNotFound)
+			return
+		}
+		if current != "" && current != req.TeamID {
+			http.Error(w, "Device already belongs to another team's pool", http.StatusConflict)
+			return
+		}
+		s.DB.Exec("UPDATE devices SET team_id = ? WHERE id = ?", req.TeamID, req.DeviceID)
+		w.Write([]byte(`{"status":"ok"}`))
+
+	case http.MethodDelete:
+		deviceID := r.URL.Query().Get("device_id")
+		var ownerID, teamID string
+		s.DB.QueryRow("SELECT COALESCE(user_id, ''), COALESCE(team_id, '') FROM devices WHERE id = ?", deviceID).Scan(&ownerID, &teamID)
+		if teamID == "" || (ownerID != userID && s.teamRole(teamID, userID) != TeamOwner) {
+			http.Error(w, "Device not found or unauthorized", http.StatusNotFound)
+			return
+		}
+		s.withdrawPoolDevices("WHERE id = ?", deviceID)
+		w.Write([]byte(`{"status":"withdrawn"}`))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// withdrawPoolDevices takes the matching devices out of their team pool and
+// moves the team chunks they hold back onto the pool in the background.
+func (s *Server) withdrawPoolDevices(where string, args ...interface{}) {
+	devices, err := s.queryDevices(where, args...)
+	if err != nil {
+		return
+	}
+	for _, d := range devices {
+		if d.TeamID == "" {
+			continue
+		}
+		s.DB.Exec("UPDATE devices SET team_id = NULL WHERE id = ?", d.ID)
+		go s.evacuateTeamChunks(d.TeamID, d.ID)
+	}
+}
+
+// evacuateTeamChunks moves a team's chunks off a device that left its pool.
+func (s *Server) evacuateTeamChunks(teamID, deviceID string) {
+	ctx := backgroundContext()
+	rows, err := s.DB.Query(`
+		SELECT cl.chunk_id FROM chunk_locations cl
+		JOIN chunks c ON c.id = cl.chunk_id
+		JOIN files f ON f.id = c.file_id
+		WHERE cl.device_id = ? AND f.team_id = ?`, deviceID, teamID)
+	if err != nil {
+		return
+	}
+	var chunkIDs []string
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		chunkIDs = append(chunkIDs, id)
+	}
+	rows.Close()
+
+	for _, chunkID := range chunkIDs {
+		if err := s.evacuateChunk(ctx, chunkID, deviceID); err != nil {
+			slog.WarnContext(ctx, "Team chunk left on device", "team", teamID, "chunk", chunkID, "device", deviceID, "err", err)
+		}
+	}
+}
+
+// listTeamFiles writes a team's shared files, with who uploaded each.
+func (s *Server) listTeamFiles(w http.ResponseWriter, teamID string) {
+	rows, err := s.DB.Query(`
+		SELECT f.id, f.path, COALESCE(f.size, 0), f.updated_at, COALESCE(u.email, '') FROM files f
+		LEFT JOIN users u ON u.id = f.user_id
+		WHERE f.team_id = ? ORDER BY f.updated_at DESC`, teamID)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	files := []shared.FileMetadata{}
+	for rows.Next() {
+		var f shared.FileMetadata
+		var updatedStr string
+		rows.Scan(&f.ID, &f.Path, &f.Size, &updatedStr, &f.Owner)
+		f.UpdatedAt, _ = time.Parse(time.RFC3339, updatedStr)
+		f.TeamID = teamID
+		files = append(files, f)
+	}
+	json.NewEncoder(w).Encode(files)
+}
+
+// TeamUsage reports each member's share of a team's storage: what they
+// uploaded and what their pooled devices host. GET ?team_id=
+func (s *Server) TeamUsage(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	teamID := r.URL.Query().Get("team_id")
+	if s.teamRole(teamID, userID) == "" {
+		http.Error(w, "Team not found", http.StatusNotFound)
+		return
+	}
+
+	rows, err := s.DB.Query(`
+		SELECT m.user_id, u.email, m.role,
+			(SELECT COUNT(*) FROM files f WHERE f.team_id = m.team_id AND f.user_id = m.user_id),
+			(SELECT COALESCE(SUM(f.size), 0) FROM files f WHERE f.team_id = m.team_id AND f.user_id = m.user_id),
+			(SELECT COALESCE(SUM(c.size), 0) FROM chunk_locations cl
+				JOIN chunks c ON c.id = cl.chunk_id
+				JOIN files f ON f.id = c.file_id
+				WHERE f.team_id = m.team_id AND f.user_id = m.user_id),
+			(SELECT COUNT(*) FROM devices d WHERE d.team_id = m.team_id AND d.user_id = m.user_id),
+			(SELECT COALESCE(SUM(c.size), 0) FROM chunk_locations cl
+				JOIN chunks c ON c.id = cl.chunk_id
+				JOIN files f ON f.id = c.file_id
+				JOIN devices d ON d.id = cl.device_id
+				WHERE f.team_id = m.team_id AND d.user_id = m.user_id)
+		FROM team_members m JOIN users u ON u.id = m.user_id
+		WHERE m.team_id = ? ORDER BY u.email`, teamID)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	usage := []MemberUsage{}
+	for rows.Next() {
+		var u MemberUsage
+		if err := rows.Scan(&u.UserID, &u.Email, &u.Role, &u.Files, &u.LogicalBytes,
+			&u.PhysicalBytes, &u.PoolDevices, &u.HostedBytes); err == nil {
+			usage = append(usage, u)
+		}
+	}
+	json.NewEncoder(w).Encode(usage)
+}
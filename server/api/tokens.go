@@ -0,0 +1,184 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Personal API token scopes. Sessions carry every permission of their user.
+const (
+	ScopeRead    = "read"    // GET/HEAD only
+	ScopeWrite   = "write"   // Everything except /api/admin/*
+	ScopeAdmin   = "admin"   // Everything
+	ScopeSession = "session" // Browser session
+)
+
+const (
+	tokenPrefix = "gd_"       // Makes leaked tokens easy to grep for
+	tokenTouch  = time.Minute // last_used_at granularity
+)
+
+var scopeRank = map[string]int{ScopeRead: 1, ScopeWrite: 2, ScopeAdmin: 3, ScopeSession: 3}
+
+// APIToken describes a personal access token. The secret itself is only
+// returned once, when the token is created.
+type APIToken struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scope      string     `json:"scope"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Token      string     `json:"token,omitempty"`
+}
+
+// CreateTokenRequest
+type CreateTokenRequest struct {
+	Name      string `json:"name"`
+	Scope     string `json:"scope"`
+	ExpiresIn int    `json:"expires_in_days"` // 0 = never
+}
+
+// HandleTokens lists (GET), creates (POST) and revokes (DELETE ?id=) the
+// caller's API tokens.
+func (a *AuthHandler) HandleTokens(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	switch r.Method {
+	case http.MethodGet:
+		rows, err := a.DB.Query(`SELECT id, name, scope, created_at, COALESCE(expires_at, ''), COALESCE(last_used_at, '')
+			FROM api_tokens WHERE user_id = ? ORDER BY created_at`, userID)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		tokens := []APIToken{}
+		for rows.Next() {
+			var t APIToken
+			var created, expires, lastUsed string
+			if err := rows.Scan(&t.ID, &t.Name, &t.Scope, &created, &expires, &lastUsed); err != nil {
+				continue
+			}
+			t.CreatedAt, _ = time.Parse(time.RFC3339, created)
+			t.ExpiresAt = parseOptionalTime(expires)
+			t.LastUsedAt = parseOptionalTime(lastUsed)
+			tokens = append(tokens, t)
+		}
+		json.NewEncoder(w).Encode(tokens)
+
+	case http.MethodPost:
+		var req CreateTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := scopeRank[req.Scope]; !ok || req.Scope == ScopeSession {
+			http.Error(w, "Scope must be read, write or admin", http.StatusBadRequest)
+			return
+		}
+		// A token can't mint a more powerful one
+		if scopeRank[req.Scope] > scopeRank[r.Header.Get("X-Auth-Scope")] {
+			http.Error(w, "Scope exceeds your own", http.StatusForbidden)
+			return
+		}
+		if !a.recentMFA(w, r) {
+			return
+		}
+		if req.ExpiresIn < 0 {
+			http.Error(w, "Invalid expiry", http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now().UTC()
+		t := APIToken{
+			ID:        uuid.New().String(),
+			Name:      req.Name,
+			Scope:     req.Scope,
+			CreatedAt: now,
+			Token:     tokenPrefix + generateToken(),
+		}
+		var expires string
+		if req.ExpiresIn > 0 {
+			e := now.Add(time.Duration(req.ExpiresIn) * 24 * time.Hour)
+			t.ExpiresAt = &e
+			expires = e.Format(time.RFC3339)
+		}
+
+		_, err := a.DB.Exec(`INSERT INTO api_tokens (id, user_id, name, scope, token_hash, created_at, expires_at)
+			VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''))`,
+			t.ID, userID, t.Name, t.Scope, hashToken(t.Token), now.Format(time.RFC3339), expires)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+
+	case http.MethodDelete:
+		res, err := a.DB.Exec("DELETE FROM api_tokens WHERE id = ? AND user_id = ?", r.URL.Query().Get("id"), userID)
+		if err != nil {
+			http.Error(w, "DB Error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// checkToken resolves a bearer token to its user and scope.
+func (a *AuthHandler) checkToken(token string) (userID, scope string, ok bool) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return "", "", false
+	}
+	var id, expires, lastUsed string
+	err := a.DB.QueryRow(`SELECT id, user_id, scope, COALESCE(expires_at, ''), COALESCE(last_used_at, '')
+		FROM api_tokens WHERE token_hash = ?`, hashToken(token)).Scan(&id, &userID, &scope, &expires, &lastUsed)
+	if err != nil {
+		return "", "", false
+	}
+
+	now := time.Now().UTC()
+	if e := parseOptionalTime(expires); e != nil && now.After(*e) {
+		return "", "", false
+	}
+	if l := parseOptionalTime(lastUsed); l == nil || now.Sub(*l) >= tokenTouch {
+		a.DB.Exec("UPDATE api_tokens SET last_used_at = ? WHERE id = ?", now.Format(time.RFC3339), id)
+	}
+	return userID, scope, true
+}
+
+// scopeAllows reports whether a request may proceed under a scope.
+func scopeAllows(scope string, r *http.Request) bool {
+	switch scope {
+	case ScopeSession, ScopeAdmin:
+		return true
+	case ScopeWrite:
+		return !strings.HasPrefix(r.URL.Path, "/api/admin/")
+	case ScopeRead:
+		return (r.Method == http.MethodGet || r.Method == http.MethodHead) && !strings.HasPrefix(r.URL.Path, "/api/admin/")
+	}
+	return false
+}
+
+func parseOptionalTime(s string) *time.Time {
+	if s == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
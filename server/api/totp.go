@@ -0,0 +1,376 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238 defaults, which every authenticator app accepts).
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	totpSkew   = 1 // Steps accepted either side of now
+	totpIssuer = "GenDrive"
+
+	recoveryCodeCount = 10
+
+	// Sensitive operations need a second factor this recent
+	mfaFreshness = 10 * time.Minute
+
+	// Wrong codes are limited per session, which is then ended, and per
+	// user, who is then locked out of second-factor checks for a while
+	mfaSessionAttempts = 5
+	mfaUserAttempts    = 10
+	mfaLockout         = 15 * time.Minute
+)
+
+// headerMFARequired tells the dashboard to prompt for a code and retry.
+const headerMFARequired = "X-MFA-Required"
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the code for one time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	off := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%1000000)
+}
+
+// matchTOTP returns the time step the code is valid for, or -1.
+func matchTOTP(secretB32, code string, now time.Time) int64 {
+	secret, err := totpEncoding.DecodeString(strings.ToUpper(secretB32))
+	if err != nil || len(code) != totpDigits {
+		return -1
+	}
+	step := now.Unix() / totpPeriod
+	for d := int64(-totpSkew); d <= totpSkew; d++ {
+		if hmac.Equal([]byte(totpCode(secret, step+d)), []byte(code)) {
+			return step + d
+		}
+	}
+	return -1
+}
+
+// TOTPStatus
+type TOTPStatus struct {
+	Enabled       bool `json:"enabled"`
+	RecoveryCodes int  `json:"recovery_codes_left"`
+}
+
+// TOTPSetup is returned when enrollment starts. The URI is what goes in the
+// QR code.
+type TOTPSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// CodeRequest carries a TOTP or recovery code.
+type CodeRequest struct {
+	Code string `json:"code"`
+}
+
+// GetTOTPStatus reports whether 2FA is on for the current user.
+func (a *AuthHandler) GetTOTPStatus(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	var st TOTPStatus
+	a.DB.QueryRow("SELECT COALESCE(totp_enabled, 0) FROM users WHERE id = ?", userID).Scan(&st.Enabled)
+	a.DB.QueryRow("SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL", userID).Scan(&st.RecoveryCodes)
+	json.NewEncoder(w).Encode(st)
+}
+
+// SetupTOTP starts enrollment with a fresh secret. 2FA stays off until
+// EnableTOTP confirms a code from it.
+func (a *AuthHandler) SetupTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Header.Get("X-User-ID")
+
+	var email string
+	var enabled bool
+	a.DB.QueryRow("SELECT email, COALESCE(totp_enabled, 0) FROM users WHERE id = ?", userID).Scan(&email, &enabled)
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	raw := make([]byte, 20)
+	rand.Read(raw)
+	secret := totpEncoding.EncodeToString(raw)
+	a.DB.Exec("UPDATE users SET totp_secret = ?, totp_last_step = 0 WHERE id = ?", secret, userID)
+
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	uri := "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + v.Encode()
+
+	json.NewEncoder(w).Encode(TOTPSetup{Secret: secret, URI: uri})
+}
+
+// EnableTOTP confirms enrollment with a valid code and returns the recovery
+// codes, which are shown only this once.
+func (a *AuthHandler) EnableTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Header.Get("X-User-ID")
+
+	var req CodeRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	var secret string
+	var enabled bool
+	a.DB.QueryRow("SELECT COALESCE(totp_secret, ''), COALESCE(totp_enabled, 0) FROM users WHERE id = ?", userID).Scan(&secret, &enabled)
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if secret == "" {
+		http.Error(w, "Start setup first", http.StatusBadRequest)
+		return
+	}
+	step := matchTOTP(secret, strings.TrimSpace(req.Code), time.Now())
+	if step < 0 {
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	a.DB.Exec("UPDATE users SET totp_enabled = 1, totp_last_step = ? WHERE id = ?", step, userID)
+	// The session that just proved the factor counts as verified
+	a.markMFAVerified(r)
+
+	codes := a.issueRecoveryCodes(userID)
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+}
+
+// DisableTOTP turns 2FA off. Routed through RequireMFA.
+func (a *AuthHandler) DisableTOTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resetTOTP(a.DB, r.Header.Get("X-User-ID"))
+	w.WriteHeader(http.StatusOK)
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes. Routed through
+// RequireMFA.
+func (a *AuthHandler) RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Header.Get("X-User-ID")
+	var enabled bool
+	a.DB.QueryRow("SELECT COALESCE(totp_enabled, 0) FROM users WHERE id = ?", userID).Scan(&enabled)
+	if !enabled {
+		http.Error(w, "Two-factor authentication is not enabled", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": a.issueRecoveryCodes(userID)})
+}
+
+// VerifyMFA re-verifies the current session before a sensitive operation.
+func (a *AuthHandler) VerifyMFA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req CodeRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	if !a.attemptSecondFactor(w, r.Header.Get("X-User-ID"), r.Header.Get("X-Session-ID"), req.Code) {
+		return
+	}
+	a.markMFAVerified(r)
+	w.WriteHeader(http.StatusOK)
+}
+
+// LoginSecondFactor completes a login that is waiting for a TOTP or
+// recovery code.
+func (a *AuthHandler) LoginSecondFactor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		http.Error(w, "Log in first", http.StatusUnauthorized)
+		return
+	}
+	sess, ok := a.lookupSession(c.Value)
+	if !ok || !sess.Pending {
+		http.Error(w, "No login awaiting verification", http.StatusUnauthorized)
+		return
+	}
+
+	var req CodeRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	if !a.attemptSecondFactor(w, sess.UserID, sess.TokenHash, req.Code) {
+		return
+	}
+
+	now := time.Now().UTC()
+	expires := now.Add(sessionIdle)
+	a.DB.Exec("UPDATE sessions SET mfa_pending = 0, mfa_verified_at = ?, last_seen = ?, expires_at = ? WHERE token_hash = ?",
+		now.Format(time.RFC3339), now.Format(time.RFC3339), expires.Format(time.RFC3339), sess.TokenHash)
+	a.setCookie(w, r, c.Value, expires)
+	json.NewEncoder(w).Encode(map[string]string{"user_id": sess.UserID})
+}
+
+// RequireMFA guards sensitive operations. Users with 2FA must have verified
+// a code in this session within mfaFreshness; API tokens can't, so they are
+// refused for these operations.
+func (a *AuthHandler) RequireMFA(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.recentMFA(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+// recentMFA writes the refusal itself when it returns false.
+func (a *AuthHandler) recentMFA(w http.ResponseWriter, r *http.Request) bool {
+	var enabled bool
+	a.DB.QueryRow("SELECT COALESCE(totp_enabled, 0) FROM users WHERE id = ?", r.Header.Get("X-User-ID")).Scan(&enabled)
+	if !enabled {
+		return true
+	}
+	if r.Header.Get("X-Auth-Scope") != ScopeSession {
+		http.Error(w, "This operation requires a dashboard session with two-factor verification", http.StatusForbidden)
+		return false
+	}
+
+	var verifiedStr string
+	a.DB.QueryRow("SELECT COALESCE(mfa_verified_at, '') FROM sessions WHERE token_hash = ?", r.Header.Get("X-Session-ID")).Scan(&verifiedStr)
+	if verified, err := time.Parse(time.RFC3339, verifiedStr); err == nil && time.Since(verified) < mfaFreshness {
+		return true
+	}
+	w.Header().Set(headerMFARequired, "1")
+	http.Error(w, "Two-factor re-verification required", http.StatusForbidden)
+	return false
+}
+
+func (a *AuthHandler) markMFAVerified(r *http.Request) {
+	a.DB.Exec("UPDATE sessions SET mfa_verified_at = ? WHERE token_hash = ?",
+		time.Now().UTC().Format(time.RFC3339), r.Header.Get("X-Session-ID"))
+}
+
+// attemptSecondFactor checks a code for a session, counting failures. Too
+// many in one session end it; too many for the user lock their second
+// factor for mfaLockout. It writes the refusal itself when it returns false.
+func (a *AuthHandler) attemptSecondFactor(w http.ResponseWriter, userID, sessionHash, code string) bool {
+	now := time.Now().UTC()
+	var lockedStr string
+	a.DB.QueryRow("SELECT COALESCE(mfa_locked_until, '') FROM users WHERE id = ?", userID).Scan(&lockedStr)
+	if locked, err := time.Parse(time.RFC3339, lockedStr); err == nil && now.Before(locked) {
+		http.Error(w, "Too many invalid codes, try again later", http.StatusTooManyRequests)
+		return false
+	}
+
+	if a.checkSecondFactor(userID, code) {
+		a.DB.Exec("UPDATE users SET mfa_failures = 0, mfa_locked_until = NULL WHERE id = ?", userID)
+		a.DB.Exec("UPDATE sessions SET mfa_failures = 0 WHERE token_hash = ?", sessionHash)
+		return true
+	}
+
+	var userFailures, sessionFailures int
+	a.DB.QueryRow("UPDATE users SET mfa_failures = COALESCE(mfa_failures, 0) + 1 WHERE id = ? RETURNING mfa_failures", userID).Scan(&userFailures)
+	a.DB.QueryRow("UPDATE sessions SET mfa_failures = COALESCE(mfa_failures, 0) + 1 WHERE token_hash = ? RETURNING mfa_failures", sessionHash).Scan(&sessionFailures)
+	if userFailures >= mfaUserAttempts {
+		a.DB.Exec("UPDATE users SET mfa_failures = 0, mfa_locked_until = ? WHERE id = ?", now.Add(mfaLockout).Format(time.RFC3339), userID)
+		slog.Warn("Second factor locked after repeated invalid codes", "user", userID)
+	}
+	if sessionFailures >= mfaSessionAttempts {
+		a.DB.Exec("DELETE FROM sessions WHERE token_hash = ?", sessionHash)
+		http.Error(w, "Too many invalid codes, log in again", http.StatusUnauthorized)
+		return false
+	}
+	http.Error(w, "Invalid code", http.StatusUnauthorized)
+	return false
+}
+
+// checkSecondFactor accepts a current TOTP code (once) or an unused
+// recovery code (consuming it).
+func (a *AuthHandler) checkSecondFactor(userID, code string) bool {
+	code = strings.TrimSpace(code)
+	var secret string
+	var lastStep int64
+	if err := a.DB.QueryRow("SELECT COALESCE(totp_secret, ''), COALESCE(totp_last_step, 0) FROM users WHERE id = ? AND totp_enabled = 1",
+		userID).Scan(&secret, &lastStep); err != nil {
+		return false
+	}
+
+	if step := matchTOTP(secret, code, time.Now()); step > lastStep {
+		// Only one use per code, so a shoulder-surfed code can't be replayed
+		res, err := a.DB.Exec("UPDATE users SET totp_last_step = ? WHERE id = ? AND COALESCE(totp_last_step, 0) < ?", step, userID, step)
+		if err != nil {
+			return false
+		}
+		n, _ := res.RowsAffected()
+		return n == 1
+	}
+
+	res, err := a.DB.Exec("UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now().Format(time.RFC3339), userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n == 1
+}
+
+func (a *AuthHandler) issueRecoveryCodes(userID string) []string {
+	a.DB.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		rand.Read(b)
+		h := hex.EncodeToString(b)
+		codes[i] = h[:5] + "-" + h[5:]
+		a.DB.Exec("INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hashToken(normalizeRecoveryCode(codes[i])))
+	}
+	return codes
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(code, "-", ""))
+}
+
+// resetTOTP turns 2FA off for a user and forgets their secret and codes.
+func resetTOTP(db *sql.DB, userID string) {
+	db.Exec("UPDATE users SET totp_enabled = 0, totp_secret = NULL, totp_last_step = 0, mfa_failures = 0, mfa_locked_until = NULL WHERE id = ?", userID)
+	db.Exec("DELETE FROM recovery_codes WHERE user_id = ?", userID)
+}
+
+// ResetTOTPByEmail is the operator override for a user locked out of their
+// authenticator and recovery codes.
+func ResetTOTPByEmail(db *sql.DB, email string) error {
+	var userID string
+	if err := db.QueryRow("SELECT id FROM users WHERE email = ?", email).Scan(&userID); err != nil {
+		return fmt.Errorf("no user with email %s", email)
+	}
+	resetTOTP(db, userID)
+	return nil
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"p2p-drive/server/db"
+)
+
+// The RFC 6238 SHA-1 test secret, base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	secret, _ := totpEncoding.DecodeString(rfcSecret)
+	// RFC 6238 appendix B, truncated to six digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret, _ := totpEncoding.DecodeString(rfcSecret)
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+		want   int64
+	}{
+		{"current step", rfcSecret, totpCode(secret, step), step},
+		{"previous step", rfcSecret, totpCode(secret, step-1), step - 1},
+		{"next step", rfcSecret, totpCode(secret, step+1), step + 1},
+		{"outside the skew", rfcSecret, totpCode(secret, step-2), -1},
+		{"lowercase secret", "gezdgnbvgy3tqojqgezdgnbvgy3tqojq", totpCode(secret, step), step},
+		{"wrong code", rfcSecret, "000000", -1},
+		{"too short", rfcSecret, "05924", -1},
+		{"too long", rfcSecret, "0005924", -1},
+		{"invalid secret", "not base32!", totpCode(secret, step), -1},
+	}
+	for _, tt := range tests {
+		if got := matchTOTP(tt.secret, tt.code, now); got != tt.want {
+			t.Errorf("%s: matchTOTP = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSecondFactorAttempts(t *testing.T) {
+	database := db.InitDB(filepath.Join(t.TempDir(), "test.db"))
+	defer database.Close()
+	a := &AuthHandler{DB: database}
+
+	secret, _ := totpEncoding.DecodeString(rfcSecret)
+	current := func() string { return totpCode(secret, time.Now().Unix()/totpPeriod) }
+
+	newUser := func() (userID string, recovery []string) {
+		userID = generateToken()
+		database.Exec("INSERT INTO users (id, email, password, created_at, totp_enabled, totp_secret) VALUES (?, ?, '', ?, 1, ?)",
+			userID, userID+"@example.com", time.Now().Format(time.RFC3339), rfcSecret)
+		return userID, a.issueRecoveryCodes(userID)
+	}
+	newSession := func(userID string) string {
+		hash := hashToken(generateToken())
+		database.Exec("INSERT INTO sessions (token_hash, user_id, created_at, last_seen, expires_at, mfa_pending) VALUES (?, ?, ?, ?, ?, 1)",
+			hash, userID, time.Now().Format(time.RFC3339), time.Now().Format(time.RFC3339), time.Now().Add(time.Hour).Format(time.RFC3339))
+		return hash
+	}
+	attempt := func(userID, sessionHash, code string) int {
+		rec := httptest.NewRecorder()
+		if a.attemptSecondFactor(rec, userID, sessionHash, code) {
+			return http.StatusOK
+		}
+		return rec.Code
+	}
+	sessionExists := func(hash string) bool {
+		var n int
+		database.QueryRow("SELECT COUNT(*) FROM sessions WHERE token_hash = ?", hash).Scan(&n)
+		return n == 1
+	}
+
+	t.Run("codes are single use", func(t *testing.T) {
+		userID, recovery := newUser()
+		sess := newSession(userID)
+		code := current()
+		steps := []struct {
+			code string
+			want int
+		}{
+			{code, http.StatusOK},
+			{code, http.StatusUnauthorized}, // Replayed TOTP code
+			{recovery[0], http.StatusOK},
+			{recovery[0], http.StatusUnauthorized}, // Used recovery code
+			{" " + strings.ToUpper(strings.ReplaceAll(recovery[1], "-", "")) + " ", http.StatusOK}, // Normalised
+		}
+		for i, s := range steps {
+			if got := attempt(userID, sess, s.code); got != s.want {
+				t.Errorf("attempt %d with %q: status %d, want %d", i, s.code, got, s.want)
+			}
+		}
+	})
+
+	t.Run("session ends after too many wrong codes", func(t *testing.T) {
+		userID, _ := newUser()
+		sess := newSession(userID)
+		for i := 1; i <= mfaSessionAttempts; i++ {
+			got := attempt(userID, sess, "000000")
+			if got != http.StatusUnauthorized {
+				t.Fatalf("wrong code %d: status %d, want %d", i, got, http.StatusUnauthorized)
+			}
+			if want := i < mfaSessionAttempts; sessionExists(sess) != want {
+				t.Fatalf("after %d wrong codes session exists = %v, want %v", i, !want, want)
+			}
+		}
+	})
+
+	t.Run("success resets the session count", func(t *testing.T) {
+		userID, recovery := newUser()
+		sess := newSession(userID)
+		for i := 0; i < mfaSessionAttempts-1; i++ {
+			attempt(userID, sess, "000000")
+		}
+		if got := attempt(userID, sess, recovery[0]); got != http.StatusOK {
+			t.Fatalf("valid code: status %d", got)
+		}
+		attempt(userID, sess, "000000")
+		if !sessionExists(sess) {
+			t.Error("session ended although the count was reset")
+		}
+	})
+
+	t.Run("user locked across sessions", func(t *testing.T) {
+		userID, recovery := newUser()
+		for i := 0; i < mfaUserAttempts; i++ {
+			// New sessions so the per-session limit doesn't end things first
+			attempt(userID, newSession(userID), "000000")
+		}
+		if got := attempt(userID, newSession(userID), recovery[0]); got != http.StatusTooManyRequests {
+			t.Errorf("valid code while locked: status %d, want %d", got, http.StatusTooManyRequests)
+		}
+
+		// The lock lapses
+		database.Exec("UPDATE users SET mfa_locked_until = ? WHERE id = ?", time.Now().Add(-time.Second).Format(time.RFC3339), userID)
+		if got := attempt(userID, newSession(userID), recovery[0]); got != http.StatusOK {
+			t.Errorf("valid code after the lock: status %d, want %d", got, http.StatusOK)
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package api
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"p2p-drive/shared"
+)
+
+var tracer = otel.Tracer("p2p-drive/server")
+
+// startSpan starts a span tagged with the context's request ID, so traces
+// and logs of one request can be matched up.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if id := shared.RequestID(ctx); id != "" {
+		attrs = append(attrs, attribute.String("request_id", id))
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends a span, marking it failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
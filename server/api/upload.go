@@ -1,11 +1,11 @@
 package api
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
-	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"path/filepath"
 	"time"
@@ -13,6 +13,8 @@ import (
 	"p2p-drive/shared"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
 )
 
 const ChunkSize = 1024 * 1024 // 1MB
@@ -23,9 +25,15 @@ func (s *Server) UploadFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
+	ctx, span := startSpan(r.Context(), "UploadFile", attribute.String("user", userID))
+	defer span.End()
+	start, ok := time.Now(), false
+	defer func() { observeTransfer(uploadDuration, start, ok) }()
 
 	// Parse Multipart
+	_, parseSpan := startSpan(ctx, "ParseMultipartForm")
 	err := r.ParseMultipartForm(512 << 20) // 512MB max memory
+	endSpan(parseSpan, err)
 	if err != nil {
 		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
@@ -40,27 +48,89 @@ func (s *Server) UploadFile(w http.ResponseWriter, r *http.Request) {
 
 	// Create File Metadata
 	fileID := uuid.New().String()
+	span.SetAttributes(attribute.String("file", fileID))
 	fileHash := sha256.New()
 	var totalSize int64 = 0
 
+	// Team uploads need editor rights and go to the team's device pool
+	teamID := r.FormValue("team_id")
+	if teamID != "" && !teamRoleAtLeast(s.teamRole(teamID, userID), TeamEditor) {
+		http.Error(w, "Not allowed to upload to this team", http.StatusForbidden)
+		return
+	}
+
+	// Personal files of users in the community mode are encrypted so they
+	// can also go on other users' devices
+	target := chunkFile{UserID: userID, TeamID: teamID, Encrypted: teamID == "" && s.communityEnabled(userID)}
+	var key []byte
+	if target.Encrypted {
+		if key, err = s.userChunkKey(userID); err != nil {
+			http.Error(w, "Encryption key unavailable", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Get User's Online Devices
-	devices, err := s.getUserOnlineDevices(userID)
+	devices, err := s.placementDevices(target)
 	if err != nil || len(devices) == 0 {
 		http.Error(w, "No online devices found to store chunks", http.StatusServiceUnavailable)
 		return
 	}
 
+	// Optional folder, stored as a path prefix
+	filePath := filepath.Base(header.Filename)
+	if folder := normalizeFolder(r.FormValue("folder")); folder != "" {
+		filePath = folder + "/" + filePath
+	}
+	policy := s.policyForFile(userID, filePath)
+
+	// Reserve the file against the quota, counting every replica, so
+	// concurrent uploads can't overrun it. Replicas are charged as they are
+	// stored, and each one stored releases as much of the reservation, so
+	// nothing is counted twice; the rest is returned when the upload ends.
+	// A failed upload returns everything and removes what it stored.
+	reserved := header.Size * int64(policy.Replicas)
+	if err := s.reserveQuota(userID, teamID, header.Size, reserved); err != nil {
+		s.warnQuota(userID, teamID, true)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	account, accountID := usageAccount(userID, teamID)
+	created := false
+	defer func() {
+		s.addUsage(account, accountID, 0, 0, -reserved)
+		if ok {
+			return
+		}
+		if !created {
+			s.addUsage(account, accountID, -1, -header.Size, 0)
+			return
+		}
+		// deleteFile refunds the file and its stored replicas; its logical
+		// bytes were only reserved
+		s.addUsage(account, accountID, 0, -header.Size, 0)
+		if err := s.deleteFile(detachedContext(ctx), userID, fileID); err != nil {
+			slog.ErrorContext(ctx, "Failed to remove partial upload", "file", fileID, "err", err)
+		}
+	}()
+
+	// Bytes assigned to each device so far, so placement sees shrinking free space
+	placed := make(map[string]int64)
+	go s.GDrive.UpdateQuota(userID)
+
 	// DB Transaction? For now, straight inserts.
-	_, err = s.DB.Exec("INSERT INTO files (id, user_id, path, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
-		fileID, userID, filepath.Base(header.Filename), time.Now().Format(time.RFC3339), time.Now().Format(time.RFC3339))
+	_, err = s.DB.Exec("INSERT INTO files (id, user_id, team_id, path, encrypted, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		fileID, userID, teamID, filePath, target.Encrypted, time.Now().Format(time.RFC3339), time.Now().Format(time.RFC3339))
 	if err != nil {
 		http.Error(w, "DB Error", http.StatusInternalServerError)
 		return
 	}
+	created = true
 
 	// Chunking Loop
 	buffer := make([]byte, ChunkSize)
 	sequence := 0
+	expected := int((header.Size + ChunkSize - 1) / ChunkSize)
 
 	for {
 		n, err := file.Read(buffer)
@@ -75,6 +145,15 @@ func (s *Server) UploadFile(w http.ResponseWriter, r *http.Request) {
 		chunkData := buffer[:n]
 		totalSize += int64(n)
 		fileHash.Write(chunkData)
+		if key != nil {
+			sealed, encErr := encryptChunk(key, chunkData)
+			if encErr != nil {
+				http.Error(w, "Encryption Error", http.StatusInternalServerError)
+				return
+			}
+			chunkData = sealed
+		}
+		size := int64(len(chunkData))
 
 		// Hash Chunk
 		sum := sha256.Sum256(chunkData)
@@ -82,56 +161,49 @@ func (s *Server) UploadFile(w http.ResponseWriter, r *http.Request) {
 
 		// Save Chunk Metadata
 		_, err = s.DB.Exec("INSERT OR IGNORE INTO chunks (id, file_id, sequence, hash, size) VALUES (?, ?, ?, ?, ?)",
-			chunkID, fileID, sequence, chunkID, n)
+			chunkID, fileID, sequence, chunkID, size)
 		if err != nil {
 			// Log error
 		}
 
 		// Distribute
-		sent := false
-        // Determine target device by sequence
-        // This ensures uniform distribution: 0->DevA, 1->DevB, 2->DevA...
-        if len(devices) > 0 {
-            targetIndex := sequence % len(devices)
-            // We try the target device first. If it fails, we try others.
-            // Create a sorted list starting with targetIndex
-            sortedDevices := append(devices[targetIndex:], devices[:targetIndex]...)
-
-            for _, device := range sortedDevices {
-                if device.Type == "gdrive" {
-                    // Upload directly to GDrive
-                    err := s.GDrive.UploadChunk(userID, chunkID, chunkData)
-                    if err == nil {
-                        s.DB.Exec("INSERT OR IGNORE INTO chunk_locations (chunk_id, device_id) VALUES (?, ?)", chunkID, device.ID)
-                        sent = true
-                        break
-                    } else {
-                        fmt.Printf("GDrive Upload Failed for chunk %s: %v\n", chunkID, err)
-                    }
-                } else {
-                    // Agent Relay
-                    msgBytes, _ := json.Marshal(shared.RelayMessage{Type: shared.RelayTypeStore, Payload: chunkData})
-                    if s.injectRelayMessage(device.ID, "inbox", msgBytes) {
-                        _, err := s.waitForRelayData("server", "ack-"+chunkID, 30*time.Second)
-                        if err == nil {
-                            s.DB.Exec("INSERT OR IGNORE INTO chunk_locations (chunk_id, device_id) VALUES (?, ?)", chunkID, device.ID)
-                            sent = true
-                            break
-                        } else {
-                            fmt.Printf("Device %s failed to ACK %s\n", device.ID, chunkID)
-                        }
-                    }
-                }
-            }
-        }
-
-		if !sent {
+		// Walk devices in capacity-weighted random order, keeping those the
+		// placement policy allows, until the policy's replica count is met
+		var holders []shared.Device
+		for _, device := range rankByCapacity(devices, size, placed) {
+			if len(holders) >= policy.Replicas {
+				break
+			}
+			if !policy.Allows(holders, device) || !s.mayPlace(userID, teamID, device, size) {
+				continue
+			}
+			if err := s.storeChunk(ctx, device, chunkID, chunkData); err != nil {
+				slog.WarnContext(ctx, "Chunk store failed", "chunk", chunkID, "device", device.ID, "err", err)
+				continue
+			}
+			placed[device.ID] += size
+			holders = append(holders, device)
+			if release := min(size, reserved); release > 0 {
+				s.addUsage(account, accountID, 0, 0, -release)
+				reserved -= release
+			}
+		}
+
+		if len(holders) == 0 {
 			http.Error(w, "Failed to store chunk", http.StatusServiceUnavailable)
 			return
 		}
-
+		if !policy.Satisfied(holders) {
+			// Keep the upload; repair tops it up when devices become available
+			slog.InfoContext(ctx, "Chunk placement policy not yet satisfied", "chunk", chunkID, "replicas", len(holders))
+			s.QueueRepair(repairRequest{ChunkID: chunkID})
+		}
 
 		sequence++
+		s.Events.Publish(Event{Type: EventUploadProgress, UserID: userID, TeamID: teamID, Data: UploadProgress{
+			FileID: fileID, Path: filePath, Chunk: sequence, Chunks: expected,
+			Bytes: totalSize, TotalBytes: header.Size, Replicas: len(holders),
+		}})
 		if err == io.EOF {
 			break
 		}
@@ -140,25 +212,36 @@ func (s *Server) UploadFile(w http.ResponseWriter, r *http.Request) {
 	// Update File Size/Hash
 	fullHash := hex.EncodeToString(fileHash.Sum(nil))
 	s.DB.Exec("UPDATE files SET size = ?, hash = ? WHERE id = ?", totalSize, fullHash, fileID)
+	s.addUsage(account, accountID, 0, totalSize-header.Size, -reserved)
+	reserved = 0
+	uploadBytes.Add(float64(totalSize))
+	ok = true
+	span.SetAttributes(attribute.Int64("bytes", totalSize), attribute.Int("chunks", sequence))
+	slog.InfoContext(ctx, "File uploaded", "file", fileID, "user", userID, "bytes", totalSize, "chunks", sequence)
+	s.Events.Publish(Event{Type: EventFileCreated, UserID: userID, TeamID: teamID, Data: FileEvent{FileID: fileID, Path: filePath, Size: totalSize}})
+	s.warnQuota(userID, teamID, false)
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("File uploaded and distributed"))
 }
 
-func (s *Server) getUserOnlineDevices(userID string) ([]shared.Device, error) {
-	rows, err := s.DB.Query("SELECT id, name, type FROM devices WHERE user_id = ? AND online = 1", userID)
-	if err != nil {
-		return nil, err
+// placementDevices returns the devices a file's chunks may be placed on: the
+// team's pool for team files, the owner's own devices plus community devices
+// for encrypted files, and the owner's own devices otherwise.
+func (s *Server) placementDevices(f chunkFile) ([]shared.Device, error) {
+	if f.TeamID != "" {
+		return s.queryDevices("WHERE team_id = ? AND online = 1 AND COALESCE(state, 'active') = 'active'", f.TeamID)
 	}
-	defer rows.Close()
-
-	var devices []shared.Device
-	for rows.Next() {
-		var d shared.Device
-		rows.Scan(&d.ID, &d.Name, &d.Type)
-		devices = append(devices, d)
+	if f.Encrypted {
+		return s.communityDevices(f.UserID)
 	}
-	return devices, nil
+	return s.getUserOnlineDevices(f.UserID)
+}
+
+// getUserOnlineDevices returns the devices that may receive new chunks:
+// online and not being drained.
+func (s *Server) getUserOnlineDevices(userID string) ([]shared.Device, error) {
+	return s.queryDevices("WHERE user_id = ? AND online = 1 AND COALESCE(state, 'active') = 'active'", userID)
 }
 
 func (s *Server) getDeviceLoads(devices []shared.Device) map[string]int {
@@ -186,7 +269,11 @@ func (s *Server) getDeviceLoads(devices []shared.Device) map[string]int {
 
 // Ensure we access the global relayChannels from relay.go
 // Ensure we access the global relayChannels from relay.go
-func (s *Server) injectRelayMessage(to, session string, data []byte) bool {
+func (s *Server) injectRelayMessage(ctx context.Context, to, session string, data []byte) bool {
+	_, span := startSpan(ctx, "injectRelayMessage",
+		attribute.String("device", to), attribute.String("session", session), attribute.Int("bytes", len(data)))
+	defer span.End()
+
 	key := to + "-" + session
 	relayLock.Lock()
 	
@@ -213,7 +300,9 @@ func (s *Server) injectRelayMessage(to, session string, data []byte) bool {
 	case ch <- data:
 		return true
 	case <-time.After(15 * time.Second): // Increased to 15s for mobile latency
-		fmt.Println("Dropped chunk for " + to + " (Buffer Full/Timeout)")
+		relayTimeouts.WithLabelValues("inject").Inc()
+		slog.WarnContext(ctx, "Relay message dropped, inbox full", "device", to, "session", session)
+		span.SetStatus(codes.Error, "inbox full")
 		return false
 	}
 }
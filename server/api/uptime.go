@@ -0,0 +1,267 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// uptimeWindow is the default period availability is computed over
+	uptimeWindow = 30 * 24 * time.Hour
+
+	// Sessions that end sooner than this count as flaps
+	flapThreshold = 10 * time.Minute
+
+	// How long queryDevices reuses a device's uptime summary. Device rows
+	// are loaded on hot paths (placement, quota checks, repair), and a
+	// minute-old availability figure is good enough for reputation.
+	uptimeCacheTTL = time.Minute
+)
+
+type cachedUptime struct {
+	uptime   *DeviceUptime
+	computed time.Time
+}
+
+// DeviceSession is one continuous stretch of heartbeats from a device.
+type DeviceSession struct {
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"` // Unset while the session is ongoing
+}
+
+// DeviceUptime summarises a device's sessions over a window.
+type DeviceUptime struct {
+	DeviceID           string          `json:"device_id"`
+	Name               string          `json:"name,omitempty"`
+	WindowDays         int             `json:"window_days"`
+	ObservedSeconds    int64           `json:"observed_seconds"` // Part of the window since the device was first seen
+	OnlineSeconds      int64           `json:"online_seconds"`
+	Availability       float64         `json:"availability"` // OnlineSeconds / ObservedSeconds
+	Sessions           int             `json:"sessions"`
+	MeanSessionSeconds float64         `json:"mean_session_seconds"`
+	Flaps              int             `json:"flaps"` // Sessions shorter than 10 minutes
+	OnlineSince        *time.Time      `json:"online_since,omitempty"`
+	MeetsSLO           bool            `json:"meets_slo"`
+	History            []DeviceSession `json:"history,omitempty"`
+}
+
+// recordSession extends a device's current session on a heartbeat, or
+// starts a new one if the device had gone quiet for longer than OfflineAfter.
+func (s *Server) recordSession(deviceID string, now time.Time) {
+	var id, lastSeen string
+	err := s.DB.QueryRow("SELECT id, last_seen FROM device_sessions WHERE device_id = ? AND ended_at IS NULL ORDER BY started_at DESC LIMIT 1", deviceID).
+		Scan(&id, &lastSeen)
+	if err == nil {
+		last, _ := time.Parse(time.RFC3339, lastSeen)
+		if now.Sub(last) <= s.Liveness.OfflineAfter {
+			s.DB.Exec("UPDATE device_sessions SET last_seen = ? WHERE id = ?", now.Format(time.RFC3339), id)
+			return
+		}
+		// The device went offline after its last heartbeat
+		s.DB.Exec("UPDATE device_sessions SET ended_at = last_seen WHERE id = ?", id)
+	}
+	s.DB.Exec("INSERT INTO device_sessions (id, device_id, started_at, last_seen) VALUES (?, ?, ?, ?)",
+		uuid.New().String(), deviceID, now.Format(time.RFC3339), now.Format(time.RFC3339))
+}
+
+// deviceUptime computes uptime statistics for the given devices over the
+// window ending now. An open session whose device has been quiet longer than
+// OfflineAfter is treated as having ended at its last heartbeat.
+func (s *Server) deviceUptime(deviceIDs []string, window time.Duration, history bool) map[string]*DeviceUptime {
+	stats := make(map[string]*DeviceUptime, len(deviceIDs))
+	if len(deviceIDs) == 0 {
+		return stats
+	}
+	now := time.Now()
+	from := now.Add(-window)
+	args := make([]interface{}, 0, len(deviceIDs)+1)
+	for _, id := range deviceIDs {
+		stats[id] = &DeviceUptime{DeviceID: id, WindowDays: int(window / (24 * time.Hour))}
+		args = append(args, id)
+	}
+	in := "(?" + strings.Repeat(", ?", len(deviceIDs)-1) + ")"
+
+	// When each device was first seen bounds how much of the window counts
+	firstSeen := make(map[string]time.Time)
+	rows, err := s.DB.Query("SELECT device_id, MIN(started_at) FROM device_sessions WHERE device_id IN "+in+" GROUP BY device_id", args...)
+	if err != nil {
+		return stats
+	}
+	for rows.Next() {
+		var id, started string
+		rows.Scan(&id, &started)
+		firstSeen[id], _ = time.Parse(time.RFC3339, started)
+	}
+	rows.Close()
+
+	rows, err = s.DB.Query("SELECT device_id, started_at, last_seen, COALESCE(ended_at, '') FROM device_sessions WHERE device_id IN "+in+
+		" AND COALESCE(ended_at, last_seen) >= ? ORDER BY started_at", append(args, from.Format(time.RFC3339))...)
+	if err != nil {
+		return stats
+	}
+	defer rows.Close()
+
+	total := make(map[string]time.Duration)
+	for rows.Next() {
+		var id, startedStr, lastStr, endedStr string
+		if err := rows.Scan(&id, &startedStr, &lastStr, &endedStr); err != nil {
+			continue
+		}
+		u := stats[id]
+		start, _ := time.Parse(time.RFC3339, startedStr)
+		last, _ := time.Parse(time.RFC3339, lastStr)
+
+		end := now
+		ongoing := endedStr == "" && now.Sub(last) <= s.Liveness.OfflineAfter
+		if !ongoing {
+			end = last
+			if endedStr != "" {
+				end, _ = time.Parse(time.RFC3339, endedStr)
+			}
+		}
+		length := end.Sub(start)
+
+		u.Sessions++
+		total[id] += length
+		if !ongoing && length < flapThreshold {
+			u.Flaps++
+		}
+		if ongoing {
+			since := start
+			u.OnlineSince = &since
+		}
+		clipped := start
+		if clipped.Before(from) {
+			clipped = from
+		}
+		if end.After(clipped) {
+			u.OnlineSeconds += int64(end.Sub(clipped) / time.Second)
+		}
+		if history {
+			sess := DeviceSession{Start: start}
+			if !ongoing {
+				e := end
+				sess.End = &e
+			}
+			u.History = append(u.History, sess)
+		}
+	}
+
+	for id, u := range stats {
+		first, seen := firstSeen[id]
+		if !seen {
+			continue
+		}
+		if first.Before(from) {
+			first = from
+		}
+		u.ObservedSeconds = int64(now.Sub(first) / time.Second)
+		if u.ObservedSeconds > 0 {
+			u.Availability = float64(u.OnlineSeconds) / float64(u.ObservedSeconds)
+			if u.Availability > 1 {
+				u.Availability = 1
+			}
+		}
+		if u.Sessions > 0 {
+			u.MeanSessionSeconds = (total[id] / time.Duration(u.Sessions)).Seconds()
+		}
+		u.MeetsSLO = u.Availability >= s.AvailabilitySLO
+	}
+	return stats
+}
+
+// recentUptime returns the 30-day uptime of the given devices, scanning
+// sessions only for devices without a summary from the last uptimeCacheTTL.
+func (s *Server) recentUptime(deviceIDs []string) map[string]*DeviceUptime {
+	now := time.Now()
+	stats := make(map[string]*DeviceUptime, len(deviceIDs))
+	var stale []string
+
+	s.uptimeMu.Lock()
+	for _, id := range deviceIDs {
+		if c, ok := s.uptimeCache[id]; ok && now.Sub(c.computed) < uptimeCacheTTL {
+			stats[id] = c.uptime
+		} else {
+			stale = append(stale, id)
+		}
+	}
+	s.uptimeMu.Unlock()
+	if len(stale) == 0 {
+		return stats
+	}
+
+	fresh := s.deviceUptime(stale, uptimeWindow, false)
+	s.uptimeMu.Lock()
+	defer s.uptimeMu.Unlock()
+	for id, c := range s.uptimeCache {
+		if now.Sub(c.computed) >= uptimeCacheTTL {
+			delete(s.uptimeCache, id)
+		}
+	}
+	for id, u := range fresh {
+		s.uptimeCache[id] = cachedUptime{uptime: u, computed: now}
+		stats[id] = u
+	}
+	return stats
+}
+
+// GetDeviceUptime reports availability, mean session length and flaps for
+// the caller's devices over ?days= (default 30). With ?id= it reports one
+// device, including its session history.
+func (s *Server) GetDeviceUptime(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+
+	window := uptimeWindow
+	if v := r.URL.Query().Get("days"); v != "" {
+		days, err := strconv.Atoi(v)
+		if err != nil || days < 1 || days > 365 {
+			http.Error(w, "days must be between 1 and 365", http.StatusBadRequest)
+			return
+		}
+		window = time.Duration(days) * 24 * time.Hour
+	}
+
+	where, args := "WHERE user_id = ?", []interface{}{userID}
+	deviceID := r.URL.Query().Get("id")
+	if deviceID != "" {
+		where, args = "WHERE id = ? AND user_id = ?", []interface{}{deviceID, userID}
+	}
+	rows, err := s.DB.Query("SELECT id, COALESCE(name, '') FROM devices "+where+" ORDER BY name", args...)
+	if err != nil {
+		http.Error(w, "DB Error", http.StatusInternalServerError)
+		return
+	}
+	var ids []string
+	names := make(map[string]string)
+	for rows.Next() {
+		var id, name string
+		rows.Scan(&id, &name)
+		ids = append(ids, id)
+		names[id] = name
+	}
+	rows.Close()
+	if deviceID != "" && len(ids) == 0 {
+		http.Error(w, "Device not found or unauthorized", http.StatusNotFound)
+		return
+	}
+
+	stats := s.deviceUptime(ids, window, deviceID != "")
+	if deviceID != "" {
+		u := stats[deviceID]
+		u.Name = names[deviceID]
+		json.NewEncoder(w).Encode(u)
+		return
+	}
+	report := []*DeviceUptime{}
+	for _, id := range ids {
+		u := stats[id]
+		u.Name = names[id]
+		report = append(report, u)
+	}
+	json.NewEncoder(w).Encode(report)
+}
@@ -3,12 +3,13 @@ package db
 import (
 	"database/sql"
 	"log"
-
-	_ "modernc.org/sqlite"
+	"log/slog"
 )
 
 func InitDB(filepath string) *sql.DB {
-	db, err := sql.Open("sqlite", filepath)
+	// Concurrent writers wait for the lock instead of failing with
+	// SQLITE_BUSY; every pooled connection gets the pragma
+	db, err := sql.Open("sqlite-timed", filepath+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -19,7 +20,7 @@ func InitDB(filepath string) *sql.DB {
 
 	// Enable WAL mode for concurrency
 	if _, err := db.Exec("PRAGMA journal_mode=WAL;"); err != nil {
-		log.Printf("Failed to enable WAL mode: %v", err)
+		slog.Warn("Failed to enable WAL mode", "err", err)
 	}
 
 	createTables(db)
@@ -34,6 +35,37 @@ func createTables(db *sql.DB) {
 			password TEXT NOT NULL,
 			created_at DATETIME
 		);`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			token_hash TEXT PRIMARY KEY, /* sha256 of the cookie value */
+			user_id TEXT NOT NULL,
+			created_at DATETIME,
+			last_seen DATETIME,
+			expires_at DATETIME,
+			user_agent TEXT,
+			ip TEXT,
+			mfa_pending INTEGER DEFAULT 0, /* waiting for the second factor */
+			mfa_verified_at DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+			user_id TEXT,
+			code_hash TEXT,
+			used_at DATETIME,
+			PRIMARY KEY (user_id, code_hash),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);`,
+		`CREATE TABLE IF NOT EXISTS api_tokens (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			name TEXT,
+			scope TEXT NOT NULL, /* read, write, admin */
+			token_hash TEXT UNIQUE NOT NULL,
+			created_at DATETIME,
+			expires_at DATETIME, /* NULL = never */
+			last_used_at DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);`,
 		`CREATE TABLE IF NOT EXISTS devices (
 			id TEXT PRIMARY KEY,
 			user_id TEXT,
@@ -77,6 +109,91 @@ func createTables(db *sql.DB) {
 			chunk_ids TEXT, /* JSON array */
 			deleted_at DATETIME
 		);`,
+		`CREATE TABLE IF NOT EXISTS chunk_challenges (
+			id TEXT PRIMARY KEY,
+			chunk_id TEXT,
+			nonce TEXT,
+			range_offset INTEGER,
+			range_length INTEGER,
+			expected TEXT,
+			created_at DATETIME
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_chunk_challenges_chunk ON chunk_challenges(chunk_id);`,
+		`CREATE TABLE IF NOT EXISTS placement_policies (
+			user_id TEXT,
+			path_prefix TEXT, /* '' = user default */
+			policy TEXT NOT NULL,
+			updated_at DATETIME,
+			PRIMARY KEY (user_id, path_prefix),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS inventory_diffs (
+			device_id TEXT,
+			chunk_id TEXT,
+			kind TEXT, /* 'orphan' or 'missing' */
+			first_seen DATETIME,
+			PRIMARY KEY (device_id, chunk_id),
+			FOREIGN KEY(device_id) REFERENCES devices(id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS teams (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			created_at DATETIME
+		);`,
+		`CREATE TABLE IF NOT EXISTS team_members (
+			team_id TEXT,
+			user_id TEXT,
+			role TEXT NOT NULL, /* 'owner', 'editor' or 'viewer' */
+			added_at DATETIME,
+			PRIMARY KEY (team_id, user_id),
+			FOREIGN KEY(team_id) REFERENCES teams(id),
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_team_members_user ON team_members(user_id);`,
+		`CREATE TABLE IF NOT EXISTS share_links (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			token_hash TEXT UNIQUE NOT NULL,
+			file_id TEXT, /* Either a file... */
+			folder TEXT, /* ...or a folder, of team_id's space if set */
+			team_id TEXT,
+			password_hash TEXT, /* bcrypt, NULL = no password */
+			expires_at DATETIME, /* NULL = never */
+			max_downloads INTEGER DEFAULT 0, /* 0 = unlimited */
+			downloads INTEGER DEFAULT 0,
+			created_at DATETIME,
+			FOREIGN KEY(user_id) REFERENCES users(id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS usage_counters (
+			kind TEXT, /* 'user' or 'team' */
+			owner_id TEXT,
+			files INTEGER DEFAULT 0,
+			logical_bytes INTEGER DEFAULT 0, /* Sum of file sizes */
+			physical_bytes INTEGER DEFAULT 0, /* Sum over every stored replica */
+			PRIMARY KEY (kind, owner_id)
+		);`,
+		`CREATE TABLE IF NOT EXISTS ledger (
+			host_id TEXT, /* User whose device stores the data */
+			owner_id TEXT, /* User the data belongs to */
+			bytes INTEGER DEFAULT 0,
+			PRIMARY KEY (host_id, owner_id)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_ledger_owner ON ledger(owner_id);`,
+		`CREATE TABLE IF NOT EXISTS device_sessions (
+			id TEXT PRIMARY KEY,
+			device_id TEXT,
+			started_at DATETIME, /* First heartbeat */
+			last_seen DATETIME, /* Latest heartbeat */
+			ended_at DATETIME, /* NULL while ongoing */
+			FOREIGN KEY(device_id) REFERENCES devices(id)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_device_sessions_device ON device_sessions(device_id, started_at);`,
+		`CREATE TABLE IF NOT EXISTS device_nonces (
+			device_id TEXT NOT NULL,
+			nonce TEXT NOT NULL,
+			expires_at DATETIME NOT NULL, /* After this the timestamp check rejects it anyway */
+			PRIMARY KEY (device_id, nonce)
+		);`,
 		`CREATE TABLE IF NOT EXISTS gdrive_tokens (
 			user_id TEXT PRIMARY KEY,
 			access_token TEXT,
@@ -90,7 +207,7 @@ func createTables(db *sql.DB) {
 	for _, query := range queries {
 		_, err := db.Exec(query)
 		if err != nil {
-			log.Printf("DB Init Warning/Error: %v", err)
+			slog.Warn("DB init statement failed", "err", err)
 		}
 	}
 
@@ -100,6 +217,46 @@ func createTables(db *sql.DB) {
 		"ALTER TABLE devices ADD COLUMN claim_token TEXT",
 		"ALTER TABLE files ADD COLUMN user_id TEXT",
 		"ALTER TABLE devices ADD COLUMN type TEXT DEFAULT 'agent'", 
+		"ALTER TABLE devices ADD COLUMN challenges_passed INTEGER DEFAULT 0",
+		"ALTER TABLE devices ADD COLUMN challenges_failed INTEGER DEFAULT 0",
+		"ALTER TABLE devices ADD COLUMN total_bytes INTEGER DEFAULT 0",
+		"ALTER TABLE devices ADD COLUMN free_bytes INTEGER DEFAULT 0",
+		"ALTER TABLE devices ADD COLUMN used_bytes INTEGER DEFAULT 0",
+		"ALTER TABLE devices ADD COLUMN storage_cap INTEGER DEFAULT 0",
+		"ALTER TABLE devices ADD COLUMN zone TEXT DEFAULT ''",
+		"ALTER TABLE devices ADD COLUMN class TEXT DEFAULT ''",
+		"ALTER TABLE devices ADD COLUMN tags TEXT DEFAULT ''",
+		"ALTER TABLE devices ADD COLUMN state TEXT DEFAULT 'active'",
+		"ALTER TABLE deleted_files ADD COLUMN user_id TEXT",
+		"ALTER TABLE users ADD COLUMN oidc_issuer TEXT",
+		"ALTER TABLE users ADD COLUMN oidc_subject TEXT",
+		"ALTER TABLE users ADD COLUMN totp_secret TEXT",
+		"ALTER TABLE users ADD COLUMN totp_enabled INTEGER DEFAULT 0",
+		"ALTER TABLE users ADD COLUMN totp_last_step INTEGER DEFAULT 0",
+		"ALTER TABLE sessions ADD COLUMN mfa_pending INTEGER DEFAULT 0",
+		"ALTER TABLE sessions ADD COLUMN mfa_verified_at DATETIME",
+		"ALTER TABLE users ADD COLUMN role TEXT DEFAULT 'user'",
+		"ALTER TABLE users ADD COLUMN suspended INTEGER DEFAULT 0",
+		"ALTER TABLE devices ADD COLUMN drain_total INTEGER DEFAULT 0",
+		"ALTER TABLE devices ADD COLUMN team_id TEXT",
+		"ALTER TABLE files ADD COLUMN team_id TEXT",
+		"ALTER TABLE users ADD COLUMN quota_logical INTEGER", /* NULL = server default */
+		"ALTER TABLE users ADD COLUMN quota_physical INTEGER",
+		"ALTER TABLE teams ADD COLUMN quota_logical INTEGER", /* NULL = unlimited */
+		"ALTER TABLE teams ADD COLUMN quota_physical INTEGER",
+		"ALTER TABLE users ADD COLUMN community INTEGER DEFAULT 0", /* Opted in to placing on others' devices */
+		"ALTER TABLE users ADD COLUMN chunk_key TEXT", /* AES-256 key for chunks placed on others' devices */
+		"ALTER TABLE files ADD COLUMN encrypted INTEGER DEFAULT 0",
+		"ALTER TABLE devices ADD COLUMN community INTEGER DEFAULT 0", /* Owner accepts others' encrypted chunks */
+		"ALTER TABLE devices ADD COLUMN ack_latency_ms REAL", /* Moving average, NULL until the first store */
+		"ALTER TABLE devices ADD COLUMN retrievals_ok INTEGER DEFAULT 0",
+		"ALTER TABLE devices ADD COLUMN retrievals_failed INTEGER DEFAULT 0",
+		"ALTER TABLE devices ADD COLUMN telemetry TEXT", /* JSON of the agent's latest shared.DeviceTelemetry */
+		"ALTER TABLE users ADD COLUMN mfa_failures INTEGER DEFAULT 0", /* Wrong codes since the last good one */
+		"ALTER TABLE users ADD COLUMN mfa_locked_until DATETIME",
+		"ALTER TABLE sessions ADD COLUMN mfa_failures INTEGER DEFAULT 0",
+		"ALTER TABLE share_links ADD COLUMN password_failures INTEGER DEFAULT 0", /* Wrong passwords since the last good one */
+		"ALTER TABLE share_links ADD COLUMN password_locked_until DATETIME",
 	}
 	for _, m := range migrations {
 		db.Exec(m) // Ignore errors
@@ -1,46 +1,164 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
+	"flag"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"p2p-drive/server/api"
 	"p2p-drive/server/db"
+	"p2p-drive/shared"
 )
 
 func main() {
+	rebalanceConcurrency := flag.Int("rebalance-concurrency", 3, "Chunk moves in flight during a rebalance")
+	rebalanceBandwidth := flag.Int64("rebalance-bandwidth", 0, "Rebalance transfer limit in bytes/sec (0 = unlimited)")
+	orphanGrace := flag.Duration("orphan-grace", 24*time.Hour, "How long unreferenced chunks are kept on devices before deletion")
+	secureCookies := flag.Bool("secure-cookies", false, "Always mark session cookies Secure (set when TLS terminates at a proxy)")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer URL (enables SSO)")
+	oidcClientID := flag.String("oidc-client-id", "", "OIDC client ID")
+	oidcRedirect := flag.String("oidc-redirect-url", "http://localhost:8085/api/oidc/callback", "OIDC redirect URL registered with the provider")
+	oidcDomains := flag.String("oidc-allowed-domains", "", "Comma-separated email domains allowed to log in via SSO")
+	oidcGroupsClaim := flag.String("oidc-groups-claim", "groups", "ID token claim listing the user's groups")
+	oidcGroups := flag.String("oidc-allowed-groups", "", "Comma-separated groups allowed to log in via SSO")
+	quotaLogical := flag.Int64("quota-logical", 0, "Default per-user quota on file bytes (0 = unlimited)")
+	quotaPhysical := flag.Int64("quota-physical", 0, "Default per-user quota on stored bytes including replicas (0 = unlimited)")
+	fairShare := flag.Float64("fair-share-ratio", 1, "Bytes a user may place on others' devices per byte of capacity they contribute (0 = unlimited)")
+	minReputation := flag.Float64("min-reputation", 0.3, "Reputation below which a device's chunks are re-replicated elsewhere (0 = off)")
+	availabilitySLO := flag.Float64("availability-slo", 0.95, "Target share of time a device should be online over 30 days")
+	livenessInterval := flag.Duration("liveness-interval", 10*time.Second, "How often devices are checked for missed heartbeats")
+	offlineAfter := flag.Duration("offline-after", 30*time.Second, "Heartbeat silence after which a device is marked offline")
+	repairAfter := flag.Duration("repair-after", 30*time.Minute, "How long a device may stay offline before its chunks are re-replicated (0 = never)")
+	reset2FA := flag.String("reset-2fa", "", "Turn off two-factor authentication for the user with this email, then exit")
+	makeAdmin := flag.String("make-admin", "", "Grant the admin role to the user with this email, then exit")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	logJSON := flag.Bool("log-json", false, "Write logs as JSON lines")
+	otlpEndpoint := flag.String("otlp-endpoint", "", "OTLP/HTTP collector to export traces to, e.g. http://localhost:4318 (empty = off)")
+	flag.Parse()
+
+	if err := shared.SetupLogging(os.Stderr, *logLevel, *logJSON); err != nil {
+		log.Fatal(err)
+	}
+	shutdownTracing, err := setupTracing(context.Background(), "gendrive-server", *otlpEndpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *otlpEndpoint != "" {
+		flushTracingOnExit(shutdownTracing)
+	}
+
 	// Ensure data directory exists
 	if err := os.MkdirAll("./data", 0755); err != nil {
 		log.Fatal(err)
 	}
 
 	database := db.InitDB("./data/p2p.db")
+	if *makeAdmin != "" {
+		if err := api.MakeAdminByEmail(database, *makeAdmin); err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("Granted admin role", "email", *makeAdmin)
+		return
+	}
+	if *reset2FA != "" {
+		if err := api.ResetTOTPByEmail(database, *reset2FA); err != nil {
+			log.Fatal(err)
+		}
+		slog.Info("Two-factor authentication reset", "email", *reset2FA)
+		return
+	}
+
     gdriveManager := api.NewGDriveManager(database) // Init here
 	server := api.NewServer(database, gdriveManager)
 	authHandler := api.NewAuthHandler(database)
+	authHandler.SecureCookies = *secureCookies
+	oidcHandler := api.NewOIDCHandler(authHandler, api.OIDCConfig{
+		Issuer:         *oidcIssuer,
+		ClientID:       *oidcClientID,
+		ClientSecret:   os.Getenv("OIDC_CLIENT_SECRET"), // Kept out of the process list
+		RedirectURL:    *oidcRedirect,
+		AllowedDomains: splitList(*oidcDomains),
+		GroupsClaim:    *oidcGroupsClaim,
+		AllowedGroups:  splitList(*oidcGroups),
+	})
+	server.OrphanGrace = *orphanGrace
+	server.DefaultQuota = api.Quota{Logical: *quotaLogical, Physical: *quotaPhysical}
+	server.FairShareRatio = *fairShare
+	server.MinReputation = *minReputation
+	server.AvailabilitySLO = *availabilitySLO
+	server.Liveness = api.LivenessConfig{Interval: *livenessInterval, OfflineAfter: *offlineAfter, RepairAfter: *repairAfter}
+	server.BackfillUsage()
+	server.BackfillLedger()
+	server.Rebalance = api.RebalanceLimits{Concurrency: *rebalanceConcurrency, BytesPerSec: *rebalanceBandwidth}
+
+	server.StartRepairWorker()
+	server.StartScrubber(6 * time.Hour)
+	server.StartChallenger(time.Minute, 5)
+	server.StartDrainWorker(5 * time.Minute)
+	server.StartReputationWorker(5 * time.Minute)
+	server.StartLivenessSweeper()
+	server.StartNoncePruner(time.Minute)
 
 	// Public Auth
 	http.HandleFunc("/api/signup", authHandler.Signup)
 	http.HandleFunc("/api/login", authHandler.Login)
 
+	http.HandleFunc("/api/logout", authHandler.Logout)
+	http.HandleFunc("/api/oidc/config", oidcHandler.HandleConfig)
+	http.HandleFunc("/api/oidc/login", oidcHandler.HandleLogin)
+	http.HandleFunc("/api/oidc/callback", oidcHandler.HandleCallback)
+
 	// Protected Routes Wrapper
 	auth := authHandler.Middleware
 
+	http.HandleFunc("/api/login/2fa", authHandler.LoginSecondFactor)
+	http.HandleFunc("/api/share", server.PublicShare)
+	http.HandleFunc("/api/share/download", server.PublicShareDownload)
+	http.HandleFunc("/api/logout/all", auth(authHandler.LogoutAll))
+	http.HandleFunc("/api/2fa", auth(authHandler.GetTOTPStatus))
+	http.HandleFunc("/api/2fa/setup", auth(authHandler.SetupTOTP))
+	http.HandleFunc("/api/2fa/enable", auth(authHandler.EnableTOTP))
+	http.HandleFunc("/api/2fa/verify", auth(authHandler.VerifyMFA))
+	http.HandleFunc("/api/2fa/disable", auth(authHandler.RequireMFA(authHandler.DisableTOTP)))
+	http.HandleFunc("/api/2fa/recovery-codes", auth(authHandler.RequireMFA(authHandler.RegenerateRecoveryCodes)))
+	http.HandleFunc("/api/tokens", auth(authHandler.HandleTokens))
+
 	http.HandleFunc("/api/me", auth(func(w http.ResponseWriter, r *http.Request) {
 		userID := r.Header.Get("X-User-ID")
-		var email string
-		database.QueryRow("SELECT email FROM users WHERE id = ?", userID).Scan(&email)
-		w.Write([]byte(`{"id":"` + userID + `", "email":"` + email + `"}`))
+		var email, role string
+		database.QueryRow("SELECT email, COALESCE(role, 'user') FROM users WHERE id = ?", userID).Scan(&email, &role)
+		w.Write([]byte(`{"id":"` + userID + `", "email":"` + email + `", "role":"` + role + `"}`))
 	}))
 
 	http.HandleFunc("/api/devices/claim", auth(server.ClaimDevice))
 	http.HandleFunc("/api/devices", auth(server.GetMyDevices))
-	http.HandleFunc("/api/devices/delete", auth(server.DeleteDevice))
+	http.HandleFunc("/api/devices/delete", auth(authHandler.RequireMFA(server.DeleteDevice)))
+	http.HandleFunc("/api/devices/cap", auth(server.SetDeviceCap))
+	http.HandleFunc("/api/devices/labels", auth(server.SetDeviceLabels))
+	http.HandleFunc("/api/devices/drain", auth(server.DrainDevice))
+	http.HandleFunc("/api/devices/community", auth(server.SetDeviceCommunity))
+	http.HandleFunc("/api/devices/uptime", auth(server.GetDeviceUptime))
+	http.HandleFunc("/api/community", auth(server.HandleCommunity))
+	http.HandleFunc("/api/policies", auth(server.HandlePolicies))
 	http.HandleFunc("/api/upload", auth(server.UploadFile))
 	http.HandleFunc("/api/files", auth(server.GetFiles))
 	http.HandleFunc("/api/download", auth(server.DownloadFile))
 	http.HandleFunc("/api/delete", auth(server.DeleteFile))
+	http.HandleFunc("/api/files/all", auth(authHandler.RequireMFA(server.DeleteAllFiles)))
+	http.HandleFunc("/api/shares", auth(server.HandleShares))
+	http.HandleFunc("/api/usage", auth(server.GetUsage))
+	http.HandleFunc("/api/events", auth(server.StreamEvents))
+	http.HandleFunc("/api/ledger", auth(server.GetLedger))
+	http.HandleFunc("/api/teams", auth(server.HandleTeams))
+	http.HandleFunc("/api/teams/members", auth(server.HandleTeamMembers))
+	http.HandleFunc("/api/teams/devices", auth(server.HandleTeamDevices))
+	http.HandleFunc("/api/teams/usage", auth(server.TeamUsage))
 
 	// Agent Download
 	http.HandleFunc("/agent.exe", func(w http.ResponseWriter, r *http.Request) {
@@ -57,29 +175,70 @@ func main() {
     http.HandleFunc("/api/gdrive/callback", auth(gdriveManager.HandleCallback))
 
 	http.HandleFunc("/register", server.RegisterDevice)
-	http.HandleFunc("/heartbeat", server.Heartbeat)
-	http.HandleFunc("/peers", server.GetPeers)
-	http.HandleFunc("/relay/send", server.RelaySend)
-	http.HandleFunc("/relay/recv", server.RelayRecv)
-	http.HandleFunc("/chunk/location", server.RegisterChunkLocation)
+	// Agent requests are signed with the device key and scoped to its owner
+	device := server.DeviceAuth
+	http.HandleFunc("/heartbeat", server.DeviceAuthPending(server.Heartbeat))
+	http.HandleFunc("/peers", device(server.GetPeers))
+	http.HandleFunc("/relay/send", device(server.RelaySend))
+	http.HandleFunc("/relay/recv", device(server.RelayRecv))
+	http.HandleFunc("/chunk/list", device(server.ListDeviceChunks))
+	http.HandleFunc("/chunk/report", device(server.ReportChunkHealth))
+	http.HandleFunc("/chunk/inventory", device(server.ReceiveInventory))
 
-	http.HandleFunc("/metadata", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/metadata", device(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodPost {
 			server.CreateFileMetadata(w, r)
 		} else {
 			server.GetFileMetadata(w, r)
 		}
-	})
+	}))
 	
-	http.HandleFunc("/api/sync/deletions", server.GetDeletions)
-	http.HandleFunc("/api/admin/rebalance", auth(server.RebalanceHandler))
+	http.HandleFunc("/api/sync/deletions", device(server.GetDeletions))
+	http.HandleFunc("/api/rebalance", auth(server.RebalanceHandler))
+
+	// Admin API
+	admin := func(h http.HandlerFunc) http.HandlerFunc { return auth(authHandler.RequireAdmin(h)) }
+	http.HandleFunc("/api/admin/users", admin(server.AdminListUsers))
+	http.HandleFunc("/api/admin/users/suspend", admin(server.AdminSuspendUser))
+	http.HandleFunc("/api/admin/users/role", admin(server.AdminSetRole))
+	http.HandleFunc("/api/admin/users/reset-2fa", admin(server.AdminResetTOTP))
+	http.HandleFunc("/api/admin/stats", admin(server.AdminStats))
+	http.HandleFunc("/api/admin/repair", admin(server.AdminRepair))
+	http.HandleFunc("/api/admin/gc", admin(server.AdminGC))
+	http.HandleFunc("/api/admin/rebalance", admin(server.AdminRebalance))
+	http.HandleFunc("/api/admin/quota", admin(server.AdminSetQuota))
+	http.HandleFunc("/api/admin/ledger", admin(server.AdminLedger))
+
+	// Prometheus metrics, for admins (session or admin-scoped API token) or
+	// scrapers sending METRICS_TOKEN as a bearer token
+	metrics := server.MetricsHandler()
+	metricsToken := os.Getenv("METRICS_TOKEN")
+	adminMetrics := admin(metrics.ServeHTTP)
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if metricsToken != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+metricsToken)) == 1 {
+			metrics.ServeHTTP(w, r)
+			return
+		}
+		adminMetrics(w, r)
+	})
 
 	// Static
 	fs := http.FileServer(http.Dir("../web"))
 	http.Handle("/", fs)
 
-	log.Println("GenDrive Server starting on :8085...")
-	if err := http.ListenAndServe(":8085", nil); err != nil {
+	slog.Info("GenDrive Server starting", "addr", ":8085")
+	if err := http.ListenAndServe(":8085", api.RequestIDs(http.DefaultServeMux)); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// splitList parses a comma-separated flag value.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is a local OTLP/HTTP endpoint that records the spans it's sent.
+type collector struct {
+	mu    sync.Mutex
+	spans map[string]string // Span name -> service.name of its resource
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req collectortrace.ExportTraceServiceRequest
+	if err := proto.Unmarshal(data, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		var service string
+		for _, kv := range rs.GetResource().GetAttributes() {
+			if kv.Key == "service.name" {
+				service = kv.Value.GetStringValue()
+			}
+		}
+		for _, ss := range rs.ScopeSpans {
+			for _, span := range ss.Spans {
+				c.spans[span.Name] = service
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	out, _ := proto.Marshal(&collectortrace.ExportTraceServiceResponse{})
+	w.Write(out)
+}
+
+func TestTracingExport(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint bool // Point the exporter at the collector
+		want     bool // The span reaches the collector
+	}{
+		{"exports to the collector", true, true},
+		{"no endpoint exports nothing", false, false},
+	}
+	for _, tt := range tests {
+		c := &collector{spans: make(map[string]string)}
+		srv := httptest.NewServer(c)
+
+		endpoint := ""
+		if tt.endpoint {
+			endpoint = srv.URL
+		}
+		shutdown, err := setupTracing(context.Background(), "gendrive-server", endpoint)
+		if err != nil {
+			srv.Close()
+			t.Fatalf("%s: setupTracing: %v", tt.name, err)
+		}
+		_, span := otel.Tracer("test").Start(context.Background(), "upload")
+		span.End()
+		// Shutting down flushes the batch to the collector
+		if err := shutdown(context.Background()); err != nil {
+			t.Errorf("%s: shutdown: %v", tt.name, err)
+		}
+		srv.Close()
+
+		c.mu.Lock()
+		service, got := c.spans["upload"]
+		c.mu.Unlock()
+		if got != tt.want {
+			t.Errorf("%s: span exported = %v, want %v", tt.name, got, tt.want)
+		}
+		if got && service != "gendrive-server" {
+			t.Errorf("%s: span exported with service.name %q, want %q", tt.name, service, "gendrive-server")
+		}
+	}
+}
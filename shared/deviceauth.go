@@ -0,0 +1,24 @@
+package shared
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Agents sign every request to the control server with their device key.
+// The signature covers the device ID, method, request URI, timestamp, a
+// single-use nonce and the SHA-256 of the body, so a captured request can't
+// be replayed or have its body swapped.
+const (
+	HeaderDeviceID        = "X-Device-ID"
+	HeaderDeviceTimestamp = "X-Device-Timestamp" // Unix seconds
+	HeaderDeviceNonce     = "X-Device-Nonce"     // Random, never reused
+	HeaderDeviceSignature = "X-Device-Signature" // base64 RSA PKCS#1 v1.5 over SHA-256
+)
+
+// DeviceSigningString is the message an agent signs for one request.
+func DeviceSigningString(deviceID, method, requestURI, timestamp, nonce string, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(strings.Join([]string{deviceID, method, requestURI, timestamp, nonce, hex.EncodeToString(sum[:])}, "\n"))
+}
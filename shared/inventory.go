@@ -0,0 +1,58 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// ChunkInventory lists every chunk a device holds. Chunk IDs are SHA-256
+// hashes, so they are sent as a sorted run of raw 32-byte digests rather
+// than hex strings. Base64 in JSON, that is about 43 bytes per chunk
+// against 64 for hex, about a third smaller.
+type ChunkInventory struct {
+	DeviceID string `json:"device_id"`
+	Count    int    `json:"count"`
+	Hashes   []byte `json:"hashes"` // base64 in JSON
+}
+
+// InventoryResponse tells the agent which chunks nobody references any more
+// and can be deleted.
+type InventoryResponse struct {
+	Delete []string `json:"delete,omitempty"`
+}
+
+const chunkHashSize = 32
+
+// EncodeInventory packs chunk IDs into sorted binary digests. IDs that are
+// not hex SHA-256 hashes are skipped.
+func EncodeInventory(ids []string) ChunkInventory {
+	digests := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		b, err := hex.DecodeString(id)
+		if err != nil || len(b) != chunkHashSize {
+			continue
+		}
+		digests = append(digests, b)
+	}
+	sort.Slice(digests, func(i, j int) bool { return bytes.Compare(digests[i], digests[j]) < 0 })
+
+	inv := ChunkInventory{Count: len(digests), Hashes: make([]byte, 0, len(digests)*chunkHashSize)}
+	for _, d := range digests {
+		inv.Hashes = append(inv.Hashes, d...)
+	}
+	return inv
+}
+
+// ChunkIDs unpacks the inventory back into hex chunk IDs.
+func (inv ChunkInventory) ChunkIDs() ([]string, error) {
+	if len(inv.Hashes)%chunkHashSize != 0 || len(inv.Hashes)/chunkHashSize != inv.Count {
+		return nil, fmt.Errorf("malformed inventory: %d bytes for %d chunks", len(inv.Hashes), inv.Count)
+	}
+	ids := make([]string, 0, inv.Count)
+	for i := 0; i < len(inv.Hashes); i += chunkHashSize {
+		ids = append(ids, hex.EncodeToString(inv.Hashes[i:i+chunkHashSize]))
+	}
+	return ids, nil
+}
@@ -0,0 +1,29 @@
+package shared
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// Each binary sets up its own exporter and the W3C propagator; these carry
+// the trace context across relay messages between them.
+
+// InjectTrace returns the context's trace context for a relay message.
+func InjectTrace(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// ExtractTrace continues the trace carried by a relay message.
+func ExtractTrace(ctx context.Context, trace map[string]string) context.Context {
+	if len(trace) == 0 {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(trace))
+}
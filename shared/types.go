@@ -1,6 +1,9 @@
 package shared
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 // Device represents a registered device in the mesh.
 type Device struct {
@@ -11,6 +14,37 @@ type Device struct {
 	IP        string    `json:"ip"` // Last known IP (for potential direct connect optimization later)
 	Online    bool      `json:"online"`
     Type      string    `json:"type"` // "agent" or "gdrive"
+
+	// Failure domain labels used by placement policies
+	Zone  string   `json:"zone,omitempty"`  // e.g. "home", "office"
+	Class string   `json:"class,omitempty"` // e.g. "laptop", "server"
+	Tags  []string `json:"tags,omitempty"`  // Owner-defined
+
+	TotalBytes int64 `json:"total_bytes"` // Filesystem size as reported by the device (0 = unknown)
+	FreeBytes  int64 `json:"free_bytes"`
+	UsedBytes  int64 `json:"used_bytes"`  // Bytes used by GenDrive chunks
+	StorageCap int64 `json:"storage_cap"` // Owner-set limit on UsedBytes (0 = no cap)
+
+	State      string `json:"state,omitempty"`       // "active", "draining" or "drained"
+	DrainTotal int    `json:"drain_total,omitempty"` // Chunks held when the drain started
+	ChunkCount int    `json:"chunk_count"`
+	TeamID     string `json:"team_id,omitempty"` // Team pool the device is shared with
+	Owner      string `json:"-"`                 // Owning user, server-side only
+
+	ChallengesPassed int     `json:"challenges_passed"`
+	ChallengesFailed int     `json:"challenges_failed"`
+	Reliability      float64 `json:"reliability"` // Smoothed pass rate of storage challenges
+
+	Community        bool    `json:"community"`        // Accepts other users' encrypted chunks
+	Availability     float64 `json:"availability"`     // Share of the last 30 days online, since first seen
+	ObservedSeconds  int64   `json:"observed_seconds"` // Part of those 30 days the device has been known
+	Flaps            int     `json:"flaps"`            // Sessions shorter than 10 minutes in those 30 days
+	AckLatencyMs     float64 `json:"ack_latency_ms"`   // Moving average store ACK latency (0 = unknown)
+	RetrievalsOK     int     `json:"retrievals_ok"`
+	RetrievalsFailed int     `json:"retrievals_failed"`
+	Reputation       float64 `json:"reputation"` // Weighted score from the above, 0..1
+
+	Telemetry *DeviceTelemetry `json:"telemetry,omitempty"` // Latest agent report
 }
 
 // FileMetadata represents a file tracked by the system.
@@ -21,6 +55,8 @@ type FileMetadata struct {
 	Hash      string    `json:"hash"` // SHA-256 of the whole file
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	TeamID    string    `json:"team_id,omitempty"` // Set for files in a team's shared folder
+	Owner     string    `json:"owner,omitempty"`   // Uploader's email, listed for team files
 	Chunks    []Chunk   `json:"chunks,omitempty"`
 }
 
@@ -49,27 +85,87 @@ type RegisterResponse struct {
 
 // HeartbeatRequest is the payload for keep-alive.
 type HeartbeatRequest struct {
-	DeviceID string `json:"device_id"`
+	DeviceID   string `json:"device_id"`
+	TotalBytes int64  `json:"total_bytes,omitempty"`
+	FreeBytes  int64  `json:"free_bytes,omitempty"`
+	UsedBytes  int64  `json:"used_bytes,omitempty"`
+	DeviceTelemetry
+}
+
+// DeviceTelemetry is what an agent reports about itself with each heartbeat.
+// The server keeps the latest report.
+type DeviceTelemetry struct {
+	AgentVersion string         `json:"agent_version,omitempty"`
+	Platform     string         `json:"platform,omitempty"`   // GOOS/GOARCH
+	StoreType    string         `json:"store_type,omitempty"` // "disk" or "gdrive"
+	ChunkCount   int            `json:"chunks_held"`          // Chunks in the agent's store
+	RelayQueue   int            `json:"relay_queue"`          // Relay messages received but not yet handled
+	Errors       map[string]int `json:"errors,omitempty"`     // Errors in the last 5 minutes, by kind
+	UploadBps    int64          `json:"upload_bps"`           // Measured send throughput, bytes/sec (0 = not measured yet)
+	DownloadBps  int64          `json:"download_bps"`
+	ReportedAt   time.Time      `json:"reported_at,omitzero"` // Set by the server
+}
+
+// HeartbeatResponse carries settings the owner controls from the dashboard.
+type HeartbeatResponse struct {
+	StorageCap int64 `json:"storage_cap"`       // 0 = no cap
+	Pending    bool  `json:"pending,omitempty"` // Not yet claimed by a user
 }
 
 // RelayProtocol
 const (
-	RelayTypeStore    = "STORE"
-	RelayTypeRequest  = "REQUEST"
-	RelayTypeRetrieve = "RETRIEVE"
-	RelayTypeDelete   = "DELETE"
-	RelayTypeData     = "DATA"
+	RelayTypeStore     = "STORE"
+	RelayTypeRequest   = "REQUEST"
+	RelayTypeRetrieve  = "RETRIEVE"
+	RelayTypeDelete    = "DELETE"
+	RelayTypeData      = "DATA"
+	RelayTypeChallenge = "CHALLENGE"
+)
+
+// Sessions on which devices answer the server. Each is issued to one
+// device: the server only accepts a reply on it from that device.
+const (
+	RelaySessionAck   = "ack"   // Store result, "OK" or a refusal
+	RelaySessionChunk = "chunk" // Retrieved chunk bytes
+	RelaySessionProof = "proof" // Storage challenge answer
 )
 
+// ServerSession names the session a device answers the server on, e.g.
+// "ack-<operation>-<device>". The server picks a fresh operation ID for each
+// request, so concurrent requests for the same chunk don't share a session.
+// Dashes are dropped from the operation ID and the device ID comes last, so
+// everything after the second dash is the device, whatever its ID.
+func ServerSession(kind, deviceID, id string) string {
+	return kind + "-" + strings.ReplaceAll(id, "-", "") + "-" + deviceID
+}
+
 type RelayMessage struct {
-	Type    string `json:"type"`
-	Payload []byte `json:"payload"` // JSON or Raw bytes depending on type
+	Type      string            `json:"type"`
+	Payload   []byte            `json:"payload"`              // JSON or Raw bytes depending on type
+	Session   string            `json:"session,omitempty"`    // Server session the device answers on
+	RequestID string            `json:"request_id,omitempty"` // Request that caused the message, for log correlation
+	Trace     map[string]string `json:"trace,omitempty"`      // W3C trace context of the sending span
 }
 
-// Chunk Location Reporting
-type ChunkLocationRequest struct {
-	ChunkID  string `json:"chunk_id"`
-	DeviceID string `json:"device_id"`
+// StorageChallenge asks a device to prove it still holds a chunk by returning
+// HMAC-SHA256(key=Nonce) over the byte range [Offset, Offset+Length).
+// The answer is relayed back to "server" on session "proof-{ID}-{device}".
+type StorageChallenge struct {
+	ID      string `json:"id"`
+	ChunkID string `json:"chunk_id"`
+	Nonce   []byte `json:"nonce"`
+	Offset  int64  `json:"offset"`
+	Length  int64  `json:"length"`
+}
+
+// ChunkHealthReport is sent by an agent after scrubbing its local store.
+// Corrupt chunks have already been removed from the device; missing chunks
+// are ones the server lists for the device but that were not found.
+type ChunkHealthReport struct {
+	DeviceID string   `json:"device_id"`
+	Checked  int      `json:"checked"`
+	Corrupt  []string `json:"corrupt,omitempty"`
+	Missing  []string `json:"missing,omitempty"`
 }
 
 // DeletionEvent represents a file deletion event for sync.
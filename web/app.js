@@ -1,6 +1,6 @@
 async function loadDevices() {
     try {
-        const res = await fetch('/peers');
+        const res = await fetch('/api/devices');
         const devices = await res.json();
         const tbody = document.querySelector('#deviceTable tbody');
         tbody.innerHTML = '';
@@ -22,7 +22,7 @@ async function loadDevices() {
 
 async function loadFiles() {
     try {
-        const res = await fetch('/metadata');
+        const res = await fetch('/api/files');
         const files = await res.json();
         const tbody = document.querySelector('#fileTable tbody');
         tbody.innerHTML = '';
@@ -32,7 +32,7 @@ async function loadFiles() {
                 tr.innerHTML = `
                     <td>${f.path}</td>
                     <td>${f.size}</td>
-                    <td>${f.hash.substring(0, 10)}...</td>
+                    <td>${f.hash ? f.hash.substring(0, 10) + '...' : '-'}</td>
                     <td>${f.chunks ? f.chunks.length : '?'}</td>
                 `;
                 tbody.appendChild(tr);
@@ -45,5 +45,10 @@ async function loadFiles() {
 
 loadDevices();
 loadFiles();
-setInterval(loadDevices, 5000);
-setInterval(loadFiles, 10000);
+
+// Refresh on server events instead of polling
+const events = new EventSource('/api/events');
+events.addEventListener('device.online', loadDevices);
+events.addEventListener('device.offline', loadDevices);
+events.addEventListener('file.created', loadFiles);
+events.addEventListener('file.deleted', loadFiles);